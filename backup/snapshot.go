@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/starlingbank/vaultsmith/plan"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	Snapshots of the paths a run is about to change, taken before any change is made, so that a bad
+	change can be undone. Each snapshot is written to a gzipped tarball holding snapshot.json.
+*/
+
+// Increment when the format of Snapshot changes in an incompatible way
+const snapshotVersion = 1
+
+// The name of the snapshot within an archive
+const snapshotFile = "snapshot.json"
+
+// A Snapshot holds the value of each path in Vault before a run changed it
+type Snapshot struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// The changes about to be made, with Before holding the value captured from Vault, or nil if
+	// the path was not present
+	Changes []plan.Change `json:"changes"`
+}
+
+func New(changes []plan.Change) *Snapshot {
+	return &Snapshot{
+		Version: snapshotVersion,
+		Created: time.Now().UTC(),
+		Changes: changes,
+	}
+}
+
+// Write the snapshot to a timestamped archive in dir, creating dir if need be, and return the path
+// of the archive
+func (s *Snapshot) Save(dir string) (string, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("could not encode snapshot: %s", err)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("could not create backup directory %s: %s", dir, err)
+	}
+
+	archive := filepath.Join(dir, fmt.Sprintf("vaultsmith-backup-%s.tar.gz",
+		s.Created.Format("20060102T150405.000Z")))
+	// the snapshot holds secrets, so is only readable by its owner
+	file, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not create backup archive: %s", err)
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    snapshotFile,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: s.Created,
+	})
+	if err == nil {
+		_, err = tarWriter.Write(data)
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write backup archive %s: %s", archive, err)
+	}
+	return archive, nil
+}
+
+// Read the snapshot from an archive written by Save
+func Load(archive string) (*Snapshot, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("could not open backup archive: %s", err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup archive %s: %s", archive, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("could not find %s in backup archive %s: %s", snapshotFile,
+				archive, err)
+		}
+		if header.Name != snapshotFile {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("could not read backup archive %s: %s", archive, err)
+		}
+		var s Snapshot
+		err = json.Unmarshal(data, &s)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse snapshot in %s: %s", archive, err)
+		}
+		if s.Version != snapshotVersion {
+			return nil, fmt.Errorf("snapshot in %s has version %d, expected %d", archive,
+				s.Version, snapshotVersion)
+		}
+		return &s, nil
+	}
+}
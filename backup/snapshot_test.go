@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"github.com/starlingbank/vaultsmith/plan"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot_SaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New([]plan.Change{
+		{
+			Path:    "secret/foo",
+			Action:  plan.Update,
+			Handler: "Generic",
+			Before:  map[string]interface{}{"key": "old"},
+		},
+		{Path: "sys/policy/new", Action: plan.Create, Handler: "SysPolicy"},
+	})
+	archive, err := s.Save(filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	}
+	if !strings.HasPrefix(filepath.Base(archive), "vaultsmith-backup-") {
+		t.Errorf("Expected timestamped archive name, got %s", archive)
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected archive to be readable only by its owner, got %s", info.Mode())
+	}
+
+	loaded, err := Load(archive)
+	if err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.Changes, s.Changes) {
+		t.Errorf("Expected %+v, got %+v", s.Changes, loaded.Changes)
+	}
+	if !loaded.Created.Equal(s.Created) {
+		t.Errorf("Expected created time %s, got %s", s.Created, loaded.Created)
+	}
+}
+
+func TestLoad_notAnArchive(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"version": 1}`)
+	file.Close()
+
+	_, err = Load(file.Name())
+	if err == nil {
+		t.Errorf("Expected error loading a file which is not an archive")
+	}
+}
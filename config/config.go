@@ -1,11 +1,45 @@
 package config
 
+import (
+	"github.com/starlingbank/vaultsmith/safety"
+	"time"
+)
+
 type VaultsmithConfig struct {
-	DocumentPath   string
-	Dry            bool
-	VaultRole      string
-	TemplateFile   string
-	TemplateParams []string
-	HttpAuthToken  string
-	TarDir         string
+	DocumentPath     string
+	Dry              bool
+	VaultRole        string
+	TemplateFile     string
+	TemplateParams   []string
+	HttpAuthToken    string
+	TarDir           string
+	PlanFile         string // write the planned changes to this file
+	ApplyPlanFile    string // apply the changes from this plan file, instead of the document path
+	ReportFile       string // write a json report of the run to this file
+	ExportDir        string // export the configuration of Vault to this directory, instead of applying
+	ExportPaths      []string
+	AllowNoAudit     bool   // allow disabling the last audit device
+	AllowAuthRemount bool   // allow re-creating auth mounts whose type, local or seal_wrap has changed
+	AllowUnmount     bool   // allow unmounting undeclared secret engines, deleting their secrets
+	Namespace        string // Vault Enterprise namespace to apply documents in, root if empty
+	AuthMethod       string // method to log in to Vault with when VAULT_TOKEN is not set
+	AuthMount        string // path the auth method is mounted at, its default path if empty
+	StatePath        string // document recording the paths vaultsmith owns, if ownership is tracked
+	Strict           bool   // delete all undeclared documents, even those vaultsmith does not own
+	BackupDir        string // save the paths about to be changed to an archive in this directory
+	RestoreFile      string // restore the paths in this archive, instead of applying documents
+	Workers          int    // documents and policies reconciled at once
+
+	// Limits on what a run may change, whatever the documents say. Nil allows anything.
+	Safety         *safety.Rules          // paths which may never be changed, or the only ones which may be
+	DeletionLimits *safety.DeletionLimits // most deletions a run may make
+
+	// The lock which stops runs changing Vault at the same time
+	LockPath    string        // KV version 2 secret holding the lock, no locking if empty
+	LockTimeout time.Duration // how long to wait for a lock held by another run
+	ForceUnlock bool          // remove the lock whoever holds it, instead of applying documents
+
+	// How requests are made to Vault
+	MaxRetries int     // retries of a request which fails for a reason which may pass
+	RateLimit  float64 // most requests per second, unlimited if 0
 }
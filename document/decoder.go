@@ -0,0 +1,135 @@
+package document
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"strings"
+)
+
+// Decoders for each supported document format, keyed by file extension. Files without an extension
+// are json, as they always have been.
+var decoders = map[string]func(content string, out interface{}) error{
+	"":      decodeJson,
+	".json": decodeJson,
+	".yaml": decodeYaml,
+	".yml":  decodeYaml,
+}
+
+// Decode a document into out, using the decoder for the extension of fileName. Whatever the format
+// of the document, out is populated according to its json tags, so the same types can be used for
+// every format.
+func Decode(fileName string, content string, out interface{}) error {
+	decode, ok := decoders[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		return fmt.Errorf("unsupported document type %q", filepath.Ext(fileName))
+	}
+	return decode(content, out)
+}
+
+func decodeJson(content string, out interface{}) error {
+	err := json.Unmarshal([]byte(content), out)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// the offset is just after the invalid character, which may be a newline
+		return fmt.Errorf("line %d: %s", lineAt(content, e.Offset-1), err)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("line %d: %s", lineAt(content, e.Offset), err)
+	default:
+		return err
+	}
+}
+
+// yaml is decoded generically and then converted via json, so that json tags apply. Syntax errors
+// from the yaml decoder already include the line. Type errors come from the json step, so the line
+// is found from the field they name.
+func decodeYaml(content string, out interface{}) error {
+	var data interface{}
+	err := yaml.Unmarshal([]byte(content), &data)
+	if err != nil {
+		return err
+	}
+
+	converted, err := json.Marshal(convertYamlValue(data))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(converted, out)
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		if line := yamlKeyLine(content, e.Field); line > 0 {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return err
+}
+
+// Return the line of the key at a dotted path of yaml content, e.g. config.max_lease_ttl, or 0 if
+// it cannot be found. Each key of the path is looked for in the block of the key before it, i.e.
+// on the following lines which are indented further.
+func yamlKeyLine(content string, field string) int {
+	if field == "" {
+		return 0
+	}
+	keys := strings.Split(field, ".")
+	k := 0
+	indent := -1 // of the last key found
+	for i, line := range strings.Split(content, "\n") {
+		// list items are indented by their dash as much as by spaces
+		trimmed := strings.TrimLeft(line, " -")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lineIndent := len(line) - len(trimmed)
+		if k > 0 && lineIndent <= indent {
+			return 0 // the block of the last key ended without the next one
+		}
+		if (k > 0 || lineIndent == 0) && isYamlKey(trimmed, keys[k]) {
+			if k == len(keys)-1 {
+				return i + 1
+			}
+			k++
+			indent = lineIndent
+		}
+	}
+	return 0
+}
+
+// Return true if a line, without its indentation, starts with key, which may be quoted
+func isYamlKey(line string, key string) bool {
+	for _, quoted := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+		if strings.HasPrefix(line, quoted+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// The yaml decoder produces maps with interface{} keys, which cannot be encoded as json
+func convertYamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = convertYamlValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = convertYamlValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Return the line number of a byte offset in content
+func lineAt(content string, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	} else if offset < 0 {
+		offset = 0
+	}
+	return strings.Count(content[:offset], "\n") + 1
+}
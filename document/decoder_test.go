@@ -0,0 +1,89 @@
+package document
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type decodeTarget struct {
+	Type   string `json:"type"`
+	Policy string `json:"policy"`
+	Local  bool   `json:"local"`
+	Config struct {
+		TTL int `json:"ttl"`
+	} `json:"config"`
+}
+
+func TestDecode_yaml(t *testing.T) {
+	content := `
+# comments are allowed
+type: approle # and here
+policy: |
+  path "secret/*" {
+    capabilities = ["read"]
+  }
+local: true
+`
+	for _, fileName := range []string{"foo.yaml", "foo.yml", "FOO.YAML"} {
+		var out decodeTarget
+		err := Decode(fileName, content, &out)
+		if err != nil {
+			t.Fatalf("Error decoding %s: %s", fileName, err)
+		}
+		expected := decodeTarget{
+			Type:   "approle",
+			Policy: "path \"secret/*\" {\n  capabilities = [\"read\"]\n}\n",
+			Local:  true,
+		}
+		if out != expected {
+			t.Errorf("Unexpected result decoding %s: %+v", fileName, out)
+		}
+	}
+}
+
+// yaml and json documents with the same content should decode to the same value
+func TestDecode_yamlMatchesJson(t *testing.T) {
+	var fromJson, fromYaml map[string]interface{}
+	err := Decode("foo.json", `{"ttl": 60, "policies": ["a"], "nested": {"key": true}}`, &fromJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Decode("foo.yaml", "ttl: 60\npolicies: [a]\nnested:\n  key: true\n", &fromYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJson, fromYaml) {
+		t.Errorf("Expected %+v, got %+v", fromJson, fromYaml)
+	}
+}
+
+func TestDecode_errorLine(t *testing.T) {
+	tests := []struct {
+		fileName string
+		content  string
+		expected string
+	}{
+		{"foo.json", "{\n  \"type\": \"approle\",\n  \"local\": tru\n}", "line 3"},
+		{"foo.json", "{\n  \"type\": \"approle\",\n  \"local\": \"yes\"\n}", "line 3"},
+		{"foo.yaml", "type: approle\nlocal: [true\n", "line 2"},
+		{"foo.yaml", "type: approle\nlocal: \"yes\"\n", "line 2"},
+		{"foo.yaml", "type: approle\nconfig:\n  # a comment\n  ttl: an hour\nlocal: true\n", "line 4"},
+		{"foo.yaml", "ttl: 1\nconfig:\n  \"ttl\": [1]\n", "line 3"},
+	}
+	for _, test := range tests {
+		var out decodeTarget
+		err := Decode(test.fileName, test.content, &out)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected error containing %q for %q, got %v", test.expected, test.content, err)
+		}
+	}
+}
+
+func TestDecode_unsupported(t *testing.T) {
+	var out decodeTarget
+	err := Decode("README.md", "# readme", &out)
+	if err == nil {
+		t.Errorf("Expected error for unsupported document type")
+	}
+}
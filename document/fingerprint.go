@@ -0,0 +1,48 @@
+package document
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Return a sha256 fingerprint of all files under docPath, covering both their paths relative to
+// docPath and their contents. It changes if any document is added, removed, renamed or edited.
+func Fingerprint(docPath string) (string, error) {
+	hash := sha256.New()
+
+	// filepath.Walk visits files in lexical order, so the result is deterministic
+	err := filepath.Walk(docPath, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(docPath, path)
+		if err != nil {
+			return fmt.Errorf("could not determine relative path of %s to %s: %s",
+				path, docPath, err)
+		}
+		// separate path from content, so "a" + "bc" differs from "ab" + "c"
+		fmt.Fprintf(hash, "%s\x00%d\x00", filepath.ToSlash(relPath), f.Size())
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening file: %s", err)
+		}
+		defer file.Close()
+
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not fingerprint %s: %s", docPath, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,45 @@
+package document
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "foo.json"), []byte(`{"foo": "bar"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := Fingerprint(dir)
+	if err != nil {
+		t.Fatalf("Error fingerprinting %s: %s", dir, err)
+	}
+
+	again, err := Fingerprint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != again {
+		t.Errorf("Fingerprint of unchanged directory changed: %s != %s", before, again)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "foo.json"), []byte(`{"foo": "baz"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := Fingerprint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Errorf("Fingerprint did not change when a document was edited")
+	}
+}
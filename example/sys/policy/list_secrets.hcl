@@ -0,0 +1,4 @@
+# Allow listing, but not reading, all secrets
+path "secret/*" {
+  capabilities = ["list"]
+}
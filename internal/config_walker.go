@@ -4,7 +4,10 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/starlingbank/vaultsmith/config"
+	"github.com/starlingbank/vaultsmith/lock"
 	"github.com/starlingbank/vaultsmith/path_handlers"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
 	"path"
@@ -19,18 +22,29 @@ import (
 type Walker interface {
 }
 
+// The directory containing a directory of documents for each Vault Enterprise namespace
+const namespacesDir = "_namespaces"
+
 type ConfigWalker struct {
 	HandlerMap map[string]path_handlers.PathHandler
 	Client     vault.Vault
+	Config     config.VaultsmithConfig
 	ConfigDir  string
 	Visited    map[string]bool
+	Changes    *plan.ChangeSet // changes made by all handlers
+	Report     *report.Report  // outcome of each handler run
+	Lock       *lock.Lock      // checked before each handler run, nil if the run is not locked
+	namespaces *path_handlers.SysNamespaces
+	generic    *path_handlers.Generic
 }
 
-// Instantiates a configWalker and the required handlers
+// Instantiates a configWalker and the required handlers. The outcome of each handler run is recorded
+// in runReport, which may be nil.
 // TODO this mixes configuration and code, could be declared in a better way
-func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath string) (configWalker ConfigWalker, err error) {
+func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath string, runReport *report.Report) (configWalker ConfigWalker, err error) {
 	// Map configuration directories to specific path handlers
 	var handlerMap = map[string]path_handlers.PathHandler{}
+	changes := plan.NewChangeSet()
 
 	// Instantiate our path handlers
 	// We handle any unknown directories with this one
@@ -40,6 +54,14 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 			DocumentPath:      docPath,
 			TemplateFile:      config.TemplateFile,
 			TemplateOverrides: config.TemplateParams,
+			Changes:           changes,
+			Report:            runReport,
+			Namespace:         config.Namespace,
+			Safety:            config.Safety,
+			StatePath:         config.StatePath,
+			Strict:            config.Strict,
+			LockPath:          config.LockPath,
+			Workers:           config.Workers,
 		})
 	if err != nil {
 		return configWalker, fmt.Errorf("could not create genericHandler: %s", err)
@@ -53,7 +75,53 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 	}
 	handlerMap["sys"] = nullHandler
 
-	// The two sys path handlers
+	// The sys path handlers
+	sysAuditDir := filepath.Join(docPath, "sys", "audit")
+	if f, err := os.Stat(sysAuditDir); !os.IsNotExist(err) {
+		if f.Mode().IsDir() {
+			sysAuditHandler, err := path_handlers.NewSysAuditHandler(
+				client,
+				path_handlers.PathHandlerConfig{
+					DocumentPath:      docPath,
+					Order:             1,
+					TemplateFile:      config.TemplateFile,
+					TemplateOverrides: config.TemplateParams,
+					Changes:           changes,
+					Report:            runReport,
+					Namespace:         config.Namespace,
+					Safety:            config.Safety,
+					AllowNoAudit:      config.AllowNoAudit,
+				})
+			if err != nil {
+				return configWalker, fmt.Errorf("could not create sysAuditHandler: %s", err)
+			}
+			handlerMap["sys/audit"] = sysAuditHandler
+		}
+	}
+
+	sysMountsDir := filepath.Join(docPath, "sys", "mounts")
+	if f, err := os.Stat(sysMountsDir); !os.IsNotExist(err) {
+		if f.Mode().IsDir() {
+			sysMountsHandler, err := path_handlers.NewSysMountsHandler(
+				client,
+				path_handlers.PathHandlerConfig{
+					DocumentPath:      docPath,
+					Order:             5,
+					TemplateFile:      config.TemplateFile,
+					TemplateOverrides: config.TemplateParams,
+					Changes:           changes,
+					Report:            runReport,
+					Namespace:         config.Namespace,
+					Safety:            config.Safety,
+					AllowUnmount:      config.AllowUnmount,
+				})
+			if err != nil {
+				return configWalker, fmt.Errorf("could not create sysMountsHandler: %s", err)
+			}
+			handlerMap["sys/mounts"] = sysMountsHandler
+		}
+	}
+
 	sysAuthDir := filepath.Join(docPath, "sys", "auth")
 	if f, err := os.Stat(sysAuthDir); !os.IsNotExist(err) {
 		if f.Mode().IsDir() {
@@ -64,6 +132,11 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 					Order:             10,
 					TemplateFile:      config.TemplateFile,
 					TemplateOverrides: config.TemplateParams,
+					Changes:           changes,
+					Report:            runReport,
+					Namespace:         config.Namespace,
+					Safety:            config.Safety,
+					AllowAuthRemount:  config.AllowAuthRemount,
 				})
 			if err != nil {
 				return configWalker, fmt.Errorf("could not create sysAuthHandler: %s", err)
@@ -72,6 +145,28 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 		}
 	}
 
+	identityDir := filepath.Join(docPath, "identity")
+	if f, err := os.Stat(identityDir); !os.IsNotExist(err) {
+		if f.Mode().IsDir() {
+			identityHandler, err := path_handlers.NewIdentityHandler(
+				client,
+				path_handlers.PathHandlerConfig{
+					DocumentPath:      docPath,
+					Order:             15,
+					TemplateFile:      config.TemplateFile,
+					TemplateOverrides: config.TemplateParams,
+					Changes:           changes,
+					Report:            runReport,
+					Namespace:         config.Namespace,
+					Safety:            config.Safety,
+				})
+			if err != nil {
+				return configWalker, fmt.Errorf("could not create identityHandler: %s", err)
+			}
+			handlerMap["identity"] = identityHandler
+		}
+	}
+
 	sysPolicyDir := filepath.Join(docPath, "sys", "policy")
 	if f, err := os.Stat(sysPolicyDir); !os.IsNotExist(err) {
 		if f.Mode().IsDir() {
@@ -82,6 +177,11 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 					Order:             20,
 					TemplateFile:      config.TemplateFile,
 					TemplateOverrides: config.TemplateParams,
+					Changes:           changes,
+					Report:            runReport,
+					Namespace:         config.Namespace,
+					Safety:            config.Safety,
+					Workers:           config.Workers,
 				})
 			if err != nil {
 				return configWalker, fmt.Errorf("could not create sysPolicyHandler: %s", err)
@@ -90,11 +190,36 @@ func NewConfigWalker(client vault.Vault, config config.VaultsmithConfig, docPath
 		}
 	}
 
+	// Namespaces are not in the handler map, as the documents within them are applied by a
+	// ConfigWalker for each namespace rather than by the handlers of this one
+	var namespacesHandler *path_handlers.SysNamespaces
+	if f, err := os.Stat(filepath.Join(docPath, namespacesDir)); !os.IsNotExist(err) {
+		if f.Mode().IsDir() {
+			namespacesHandler, err = path_handlers.NewSysNamespacesHandler(
+				client,
+				path_handlers.PathHandlerConfig{
+					DocumentPath: docPath,
+					Changes:      changes,
+					Report:       runReport,
+					Namespace:    config.Namespace,
+					Safety:       config.Safety,
+				})
+			if err != nil {
+				return configWalker, fmt.Errorf("could not create sysNamespacesHandler: %s", err)
+			}
+		}
+	}
+
 	return ConfigWalker{
 		HandlerMap: handlerMap,
 		Client:     client,
+		Config:     config,
 		ConfigDir:  path.Clean(docPath),
 		Visited:    map[string]bool{},
+		Changes:    changes,
+		Report:     runReport,
+		namespaces: namespacesHandler,
+		generic:    genericHandler,
 	}, nil
 }
 
@@ -106,9 +231,79 @@ func (cw ConfigWalker) Run() error {
 	if err != nil {
 		return err
 	}
+	err = cw.saveState()
+	if err != nil {
+		return err
+	}
+	return cw.walkNamespaces()
+}
+
+// Record the documents the generic handler owns, now that it has processed every directory
+func (cw ConfigWalker) saveState() error {
+	if cw.Config.StatePath == "" || cw.generic == nil {
+		return nil
+	}
+	cw.Report.StartHandler(cw.generic.Name(), "", cw.Config.Namespace)
+	err := cw.Lock.Check()
+	if err == nil {
+		err = cw.generic.SaveState()
+	}
+	cw.Report.FinishHandler(err)
+	return err
+}
+
+// Ensure the declared namespaces exist, then apply the documents for each in turn. Namespaces may
+// be nested, as each may have a _namespaces directory of its own.
+func (cw ConfigWalker) walkNamespaces() error {
+	if cw.namespaces == nil {
+		return nil
+	}
+	dir := filepath.Join(cw.ConfigDir, namespacesDir)
+	log.WithField("path", namespacesDir).Infof("Processing with %s handler", cw.namespaces.Name())
+	err := cw.runHandler(cw.namespaces, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range cw.namespaces.Namespaces() {
+		logger := log.WithField("namespace", path.Join(cw.Config.Namespace, name))
+		if cw.Config.Dry && !cw.namespaces.Exists(name) {
+			// nothing can be read from a namespace which does not exist yet
+			logger.Warn("Namespace does not exist yet, so changes within it cannot be planned")
+			continue
+		}
+
+		logger.Info("Applying documents in namespace")
+		err = cw.walkNamespace(name, filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("error in namespace %s: %s", name, err)
+		}
+	}
 	return nil
 }
 
+// Apply the documents in docPath to a namespace within this walker's namespace
+func (cw ConfigWalker) walkNamespace(name string, docPath string) error {
+	nsConfig := cw.Config
+	nsConfig.Namespace = path.Join(cw.Config.Namespace, name)
+	client, err := cw.Client.WithNamespace(nsConfig.Namespace)
+	if err != nil {
+		return fmt.Errorf("could not create client: %s", err)
+	}
+
+	nsWalker, err := NewConfigWalker(client, nsConfig, docPath, cw.Report)
+	if err != nil {
+		return err
+	}
+	nsWalker.Lock = cw.Lock
+	err = nsWalker.Run()
+	// changes made before an error are still recorded
+	for _, change := range nsWalker.Changes.Changes {
+		cw.Changes.Add(change)
+	}
+	return err
+}
+
 // Return a sorted slice of paths based on the Order() of its handler
 func (cw ConfigWalker) sortedPaths() (paths []string) {
 	for p := range cw.HandlerMap {
@@ -148,7 +343,7 @@ func (cw ConfigWalker) walkConfigDir(path string, handlerMap map[string]path_han
 		if handler.Name() != "Dummy" {
 			// Dummy handler is a way of marking as "do not process"
 			logger.Infof("Processing with %s handler", handler.Name())
-			err := handler.PutPoliciesFromDir(p)
+			err := cw.runHandler(handler, p)
 			if err != nil {
 				return err
 			}
@@ -173,6 +368,10 @@ func (cw ConfigWalker) walkFile(path string, f os.FileInfo, err error) error {
 		return nil
 	}
 
+	if relPath, _ := filepath.Rel(cw.ConfigDir, path); relPath == namespacesDir {
+		// the documents of each namespace are applied by walkNamespaces()
+		return filepath.SkipDir
+	}
 	if strings.HasPrefix(f.Name(), "_") {
 		// Don't process files that start with an underscore; e.g. template json
 		return nil
@@ -202,7 +401,7 @@ func (cw ConfigWalker) walkFile(path string, f os.FileInfo, err error) error {
 	handler, ok := cw.HandlerMap[relPath]
 	if ok {
 		logger.Infof("Processing with %T handler", handler)
-		return handler.PutPoliciesFromDir(path)
+		return cw.runHandler(handler, path)
 	}
 
 	// At this point, we have a directory, which has no handler assigned to itself or any parent
@@ -211,7 +410,24 @@ func (cw ConfigWalker) walkFile(path string, f os.FileInfo, err error) error {
 	genericHandler := cw.HandlerMap["*"]
 	// and mark it so recursing into child directories doesn't re-process them
 	cw.HandlerMap[relPath] = genericHandler
-	return genericHandler.PutPoliciesFromDir(path)
+	return cw.runHandler(genericHandler, path)
+}
+
+// Apply the documents in path with handler, recording the run in the report
+func (cw ConfigWalker) runHandler(handler path_handlers.PathHandler, path string) error {
+	relPath, err := filepath.Rel(cw.ConfigDir, path)
+	if err != nil {
+		relPath = path
+	}
+
+	cw.Report.StartHandler(handler.Name(), relPath, cw.Config.Namespace)
+	// stop before changing Vault if another run may be changing it too
+	err = cw.Lock.Check()
+	if err == nil {
+		err = handler.PutPoliciesFromDir(path)
+	}
+	cw.Report.FinishHandler(err)
+	return err
 }
 
 // Determine whether this directory is already covered by a parent handler
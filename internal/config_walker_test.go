@@ -5,6 +5,7 @@ import (
 	"github.com/starlingbank/vaultsmith/path_handlers"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -158,3 +159,17 @@ func (f *fakeFileInfo) Mode() os.FileMode {
 	}
 	return 0644
 }
+
+// The documents of namespaces are applied by walkNamespaces, not as generic paths
+func TestConfigWalker_walkFile_namespaces(t *testing.T) {
+	cw := ConfigWalker{
+		HandlerMap: map[string]path_handlers.PathHandler{},
+		ConfigDir:  "docs",
+	}
+	f := &fakeFileInfo{dir: true, basename: "_namespaces"}
+
+	err := cw.walkFile(filepath.Join("docs", "_namespaces"), f, nil)
+	if err != filepath.SkipDir {
+		t.Errorf("Expected SkipDir for namespaces directory, got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/vault"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	A lease-style lock held in a KV version 2 secret, which stops two runs from changing the same
+	Vault at once. The secret records who holds the lock and when it expires, and is only ever
+	written with check-and-set, so that two runs cannot both take it. The holder renews the lock
+	while it runs and deletes it when done. A lock which has expired, e.g. because its holder was
+	killed, may be taken by another run, so the holder checks it still has the lock before each
+	step of the run.
+*/
+
+// How long a lock lasts without being renewed. It is renewed three times in this period.
+var DefaultTTL = 2 * time.Minute
+
+// How often to try again for a lock which is held by another run
+var pollInterval = 5 * time.Second
+
+// The error text Vault gives when a check-and-set write finds another version
+const casMismatch = "check-and-set"
+
+// The contents of the lock secret
+type Record struct {
+	Holder   string
+	Acquired time.Time
+	Expires  time.Time
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s, taken at %s and expiring at %s", r.Holder,
+		r.Acquired.Format(time.RFC3339), r.Expires.Format(time.RFC3339))
+}
+
+type Lock struct {
+	client   vault.Vault
+	path     string // as given, e.g. secret/vaultsmith/lock
+	mount    string // the KV version 2 mount containing path, e.g. secret/
+	holder   string
+	ttl      time.Duration
+	acquired time.Time
+	version  int // the version of the secret last written by this lock
+
+	mutex   sync.Mutex // guards the fields below, which are set while renewing
+	expires time.Time  // when the lock expires unless renewed, as last written
+	lost    error      // set if the lock could not be renewed
+
+	stop chan struct{} // closed to stop renewing the lock
+	done chan struct{} // closed once renewal has stopped
+}
+
+// Create a lock held in the secret at path, which must be in a KV version 2 mount
+func New(client vault.Vault, path string) (*Lock, error) {
+	path = strings.Trim(path, "/")
+	secret, err := client.Read("sys/internal/ui/mounts/" + path)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine mount of lock %s: %s", path, err)
+	}
+	var mount, mountType string
+	var options map[string]interface{}
+	if secret != nil && secret.Data != nil {
+		mount, _ = secret.Data["path"].(string)
+		mountType, _ = secret.Data["type"].(string)
+		options, _ = secret.Data["options"].(map[string]interface{})
+	}
+	if mountType != "kv" || options == nil || fmt.Sprintf("%v", options["version"]) != "2" ||
+		!strings.HasPrefix(path+"/", mount) {
+		return nil, fmt.Errorf("lock %s must be in a KV version 2 mount, which supports "+
+			"check-and-set", path)
+	}
+
+	return &Lock{
+		client: client,
+		path:   path,
+		mount:  mount,
+		holder: holderName(),
+		ttl:    DefaultTTL,
+	}, nil
+}
+
+// Identify this process to other runs waiting for the lock. The random suffix tells apart
+// processes with the same pid in different containers on the same host.
+func holderName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Rewrite the path of the lock to the given sub-path of its mount, e.g. secret/data/vaultsmith/lock
+func (l *Lock) kvPath(subPath string) string {
+	return l.mount + subPath + "/" + strings.TrimPrefix(l.path, l.mount)
+}
+
+// Take the lock, waiting up to timeout for another run to release it, and renew it in the
+// background until Release is called
+func (l *Lock) Acquire(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var waitingFor string
+	for {
+		held, err := l.take()
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out after %s waiting for lock %s, held by %s. If that run "+
+				"is no longer running, remove the lock with --force-unlock", timeout, l.path, held)
+		}
+		if held.Holder != waitingFor {
+			log.Infof("Waiting for lock %s, held by %s", l.path, held)
+			waitingFor = held.Holder
+		}
+		time.Sleep(pollInterval)
+	}
+
+	log.WithFields(log.Fields{"path": l.path, "holder": l.holder}).Info("Took lock")
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.renew()
+	return nil
+}
+
+// Try to take the lock once. If another run holds it, or takes it first, return its record.
+func (l *Lock) take() (*Record, error) {
+	current, version, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if current != nil && current.Holder != l.holder && now.Before(current.Expires) {
+		return current, nil
+	}
+	if current != nil && current.Holder != l.holder {
+		log.Warnf("Taking expired lock %s, held by %s", l.path, current)
+	}
+
+	l.acquired = now
+	err = l.write(version)
+	if err != nil && strings.Contains(err.Error(), casMismatch) {
+		// another run wrote the lock since it was read, so return who has it for Acquire to wait on
+		current, _, err = l.read()
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			// and has already released it again
+			current = &Record{Holder: "another run", Acquired: now, Expires: now}
+		}
+		return current, nil
+	}
+	return nil, err
+}
+
+// Return the record in the lock secret and the version of the secret. The record is nil if the
+// lock is not held.
+func (l *Lock) read() (*Record, int, error) {
+	secret, err := l.client.Read(l.kvPath("data"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read lock %s: %s", l.path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, 0, nil
+	}
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	version, err := strconv.Atoi(fmt.Sprintf("%v", metadata["version"]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read version of lock %s: %+v", l.path, metadata)
+	}
+	// the data is nil when the latest version has been deleted
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, version, nil
+	}
+
+	record := Record{Holder: fmt.Sprintf("%v", data["holder"])}
+	record.Acquired, _ = time.Parse(time.RFC3339Nano, fmt.Sprintf("%v", data["acquired"]))
+	record.Expires, err = time.Parse(time.RFC3339Nano, fmt.Sprintf("%v", data["expires"]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read expiry of lock %s: %s", l.path, err)
+	}
+	return &record, version, nil
+}
+
+// Write the lock, extending its expiry, provided the secret is still at version
+func (l *Lock) write(version int) error {
+	expires := time.Now().Add(l.ttl)
+	secret, err := l.client.Write(l.kvPath("data"), map[string]interface{}{
+		"options": map[string]interface{}{"cas": version},
+		"data": map[string]interface{}{
+			"holder":   l.holder,
+			"acquired": l.acquired.UTC().Format(time.RFC3339Nano),
+			"expires":  expires.UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not write lock %s: %s", l.path, err)
+	}
+	l.mutex.Lock()
+	l.expires = expires
+	l.mutex.Unlock()
+	l.version = version + 1
+	if secret != nil && secret.Data != nil {
+		if v, err := strconv.Atoi(fmt.Sprintf("%v", secret.Data["version"])); err == nil {
+			l.version = v
+		}
+	}
+	return nil
+}
+
+// Extend the lock three times per TTL until stop is closed. If the lock cannot be renewed, it
+// will be taken by another run once it expires, so the failure is kept to be returned by Check
+// and Release.
+func (l *Lock) renew() {
+	defer close(l.done)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(l.ttl / 3):
+		}
+
+		err := l.write(l.version)
+		if err != nil {
+			log.Errorf("Lost lock %s, so another run may now change Vault too: %s", l.path, err)
+			l.mutex.Lock()
+			l.lost = err
+			l.mutex.Unlock()
+			return
+		}
+		log.WithField("path", l.path).Debug("Renewed lock")
+	}
+}
+
+// Return an error if the lock is no longer held by this run: if it could not be renewed, has
+// expired, or has been taken or removed by another run. A run checks this before each change it
+// makes, so that it stops rather than change Vault alongside another. Safe to call on a nil Lock,
+// which stands for no locking.
+func (l *Lock) Check() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	lost, expires := l.lost, l.expires
+	l.mutex.Unlock()
+	if lost != nil {
+		return fmt.Errorf("lock %s was lost during the run: %s", l.path, lost)
+	}
+	if !time.Now().Before(expires) {
+		return fmt.Errorf("lock %s expired at %s without being renewed", l.path,
+			expires.Format(time.RFC3339))
+	}
+
+	current, _, err := l.read()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Holder != l.holder {
+		return fmt.Errorf("lock %s is no longer held by this run", l.path)
+	}
+	return nil
+}
+
+// Stop renewing the lock and remove it. Returns an error if the lock was lost during the run.
+func (l *Lock) Release() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+	// renewal has stopped, so lost is no longer written
+	if l.lost != nil {
+		return fmt.Errorf("lock %s was lost during the run: %s", l.path, l.lost)
+	}
+
+	current, _, err := l.read()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Holder != l.holder {
+		return fmt.Errorf("lock %s is no longer held by this run", l.path)
+	}
+	err = l.remove()
+	if err == nil {
+		log.WithField("path", l.path).Info("Released lock")
+	}
+	return err
+}
+
+// Delete every version of the lock secret, so that the next run takes it with version 0
+func (l *Lock) remove() error {
+	_, err := l.client.Delete(l.kvPath("metadata"))
+	if err != nil {
+		return fmt.Errorf("could not remove lock %s: %s", l.path, err)
+	}
+	return nil
+}
+
+// Remove the lock at path whoever holds it, e.g. when a run was killed before it could release it,
+// and return the record of its holder, or nil if it was not held
+func ForceUnlock(client vault.Vault, path string) (*Record, error) {
+	l, err := New(client, path)
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, nil
+	}
+	return current, l.remove()
+}
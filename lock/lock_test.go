@@ -0,0 +1,277 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/vault"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A KV version 2 mount at secret/ holding a single secret, which honours check-and-set
+type kvClient struct {
+	vault.MockClient
+	mutex   sync.Mutex // the lock is renewed in the background
+	data    map[string]interface{}
+	version int
+	writes  int
+	taken   bool // if set, another run takes the lock just before the next write
+}
+
+func (c *kvClient) Read(path string) (*vaultApi.Secret, error) {
+	if strings.HasPrefix(path, "sys/internal/ui/mounts/") {
+		return &vaultApi.Secret{Data: map[string]interface{}{
+			"path":    "secret/",
+			"type":    "kv",
+			"options": map[string]interface{}{"version": "2"},
+		}}, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.version == 0 {
+		return nil, nil
+	}
+	return &vaultApi.Secret{Data: map[string]interface{}{
+		"data":     c.data,
+		"metadata": map[string]interface{}{"version": json.Number(fmt.Sprintf("%d", c.version))},
+	}}, nil
+}
+
+func (c *kvClient) Write(path string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	if path != "secret/data/vaultsmith/lock" {
+		return nil, fmt.Errorf("unexpected write to %s", path)
+	}
+	if c.taken {
+		c.taken = false
+		c.holdUntil(time.Now().Add(time.Hour))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writes++
+	options := data["options"].(map[string]interface{})
+	if options["cas"] != c.version {
+		return nil, fmt.Errorf("check-and-set parameter did not match the current version")
+	}
+	c.version++
+	c.data = data["data"].(map[string]interface{})
+	return &vaultApi.Secret{Data: map[string]interface{}{"version": c.version}}, nil
+}
+
+func (c *kvClient) Delete(path string) (*vaultApi.Secret, error) {
+	if path != "secret/metadata/vaultsmith/lock" {
+		return nil, fmt.Errorf("unexpected delete of %s", path)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data = nil
+	c.version = 0
+	return nil, nil
+}
+
+// Set the lock as held by another run until expires
+func (c *kvClient) holdUntil(expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version++
+	c.data = map[string]interface{}{
+		"holder":   "other-host:1:abcd",
+		"acquired": time.Now().UTC().Format(time.RFC3339Nano),
+		"expires":  expires.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func TestLock_AcquireAndRelease(t *testing.T) {
+	client := &kvClient{}
+	l, err := New(client, "/secret/vaultsmith/lock")
+	if err != nil {
+		t.Fatalf("Error calling New: %s", err)
+	}
+	err = l.Acquire(0)
+	if err != nil {
+		t.Fatalf("Error calling Acquire: %s", err)
+	}
+	if client.data["holder"] != l.holder {
+		t.Errorf("Expected lock to be held by %s, got %+v", l.holder, client.data)
+	}
+
+	other, _ := New(client, "secret/vaultsmith/lock")
+	err = other.Acquire(0)
+	if err == nil || !strings.Contains(err.Error(), l.holder) {
+		t.Errorf("Expected error naming the holder taking a held lock, got %v", err)
+	}
+
+	err = l.Release()
+	if err != nil {
+		t.Fatalf("Error calling Release: %s", err)
+	}
+	if client.version != 0 {
+		t.Errorf("Expected lock to be removed")
+	}
+	err = other.Acquire(0)
+	if err != nil {
+		t.Errorf("Expected released lock to be taken, got %s", err)
+	}
+	other.Release()
+}
+
+func TestLock_AcquireWaitsForRelease(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	client := &kvClient{}
+	client.holdUntil(time.Now().Add(time.Hour))
+	l, _ := New(client, "secret/vaultsmith/lock")
+	done := make(chan error)
+	go func() { done <- l.Acquire(time.Minute) }()
+
+	time.Sleep(50 * time.Millisecond)
+	client.Delete("secret/metadata/vaultsmith/lock")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error calling Acquire: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for Acquire")
+	}
+	l.Release()
+}
+
+// A lock whose holder has stopped renewing it may be taken
+func TestLock_AcquireExpired(t *testing.T) {
+	client := &kvClient{}
+	client.holdUntil(time.Now().Add(-time.Second))
+	l, _ := New(client, "secret/vaultsmith/lock")
+	err := l.Acquire(0)
+	if err != nil {
+		t.Fatalf("Expected expired lock to be taken, got %s", err)
+	}
+	if client.data["holder"] != l.holder || client.version != 2 {
+		t.Errorf("Expected lock to be written over version 1, got version %d %+v", client.version,
+			client.data)
+	}
+	l.Release()
+}
+
+// A run which takes the lock between it being read and written should be waited on like any other
+func TestLock_AcquireRace(t *testing.T) {
+	client := &kvClient{taken: true}
+	l, _ := New(client, "secret/vaultsmith/lock")
+	err := l.Acquire(0)
+	if err == nil || !strings.Contains(err.Error(), "other-host") {
+		t.Errorf("Expected error naming the run which took the lock first, got %v", err)
+	}
+	if client.writes != 1 {
+		t.Errorf("Expected 1 write, got %d", client.writes)
+	}
+}
+
+func TestLock_renew(t *testing.T) {
+	client := &kvClient{}
+	l, _ := New(client, "secret/vaultsmith/lock")
+	l.ttl = 30 * time.Millisecond
+	err := l.Acquire(0)
+	if err != nil {
+		t.Fatalf("Error calling Acquire: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	err = l.Release()
+	if err != nil {
+		t.Fatalf("Error calling Release: %s", err)
+	}
+	if client.writes < 2 {
+		t.Errorf("Expected lock to be renewed, got %d writes", client.writes)
+	}
+}
+
+// If another run takes the lock, e.g. after it expired, renewal fails and Release reports it
+func TestLock_lost(t *testing.T) {
+	client := &kvClient{}
+	l, _ := New(client, "secret/vaultsmith/lock")
+	l.ttl = 30 * time.Millisecond
+	err := l.Acquire(0)
+	if err != nil {
+		t.Fatalf("Error calling Acquire: %s", err)
+	}
+	client.holdUntil(time.Now().Add(time.Hour))
+	time.Sleep(50 * time.Millisecond)
+
+	err = l.Release()
+	if err == nil || !strings.Contains(err.Error(), "lost") {
+		t.Errorf("Expected error for lost lock, got %v", err)
+	}
+	if client.version == 0 {
+		t.Errorf("Expected lock of the other run to be left alone")
+	}
+}
+
+func TestLock_Check(t *testing.T) {
+	var none *Lock
+	if err := none.Check(); err != nil {
+		t.Errorf("Expected no error checking nil lock, got %s", err)
+	}
+
+	client := &kvClient{}
+	l, _ := New(client, "secret/vaultsmith/lock")
+	err := l.Acquire(0)
+	if err != nil {
+		t.Fatalf("Error calling Acquire: %s", err)
+	}
+	defer l.Release()
+	if err = l.Check(); err != nil {
+		t.Errorf("Expected no error checking held lock, got %s", err)
+	}
+
+	// taken by another run before renewal notices
+	client.holdUntil(time.Now().Add(time.Hour))
+	err = l.Check()
+	if err == nil || !strings.Contains(err.Error(), "no longer held") {
+		t.Errorf("Expected error for lock taken by another run, got %v", err)
+	}
+}
+
+// A lock which has not been renewed in time is lost, even if renewal has not yet failed
+func TestLock_Check_expired(t *testing.T) {
+	client := &kvClient{}
+	l, _ := New(client, "secret/vaultsmith/lock")
+	l.ttl = 30 * time.Millisecond
+	// taken without renewal
+	if held, err := l.take(); err != nil || held != nil {
+		t.Fatalf("Could not take lock: %v %v", held, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	err := l.Check()
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected error for expired lock, got %v", err)
+	}
+}
+
+func TestNew_notKv2(t *testing.T) {
+	client := &vault.MockClient{ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{
+		"path": "secret/",
+		"type": "kv",
+	}}}
+	_, err := New(client, "secret/vaultsmith/lock")
+	if err == nil {
+		t.Errorf("Expected error for lock in a KV version 1 mount")
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	client := &kvClient{}
+	client.holdUntil(time.Now().Add(time.Hour))
+	held, err := ForceUnlock(client, "secret/vaultsmith/lock")
+	if err != nil {
+		t.Fatalf("Error calling ForceUnlock: %s", err)
+	}
+	if held == nil || held.Holder != "other-host:1:abcd" {
+		t.Errorf("Expected record of the holder, got %+v", held)
+	}
+	if client.version != 0 {
+		t.Errorf("Expected lock to be removed")
+	}
+}
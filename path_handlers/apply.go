@@ -0,0 +1,259 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+	"strings"
+)
+
+/*
+	Functions for applying changes from a saved plan, without walking the document set again.
+
+	Each handler records its changes in its own form (see recordChange calls in the handlers), so
+	these need to know which handler produced a change in order to check and execute it.
+*/
+
+// Return the value currently in Vault for the path of a change, in the same form that the handler
+// which produced the change recorded in Change.Before
+func LiveValue(client vault.Vault, change plan.Change) (interface{}, error) {
+	client, err := namespaceClient(client, change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch change.Handler {
+	case "Generic":
+		data, err := readDocument(client, newKvMounts(client), change.Path)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		return data, nil
+	case "SysPolicy":
+		policy, err := client.GetPolicy(strings.TrimPrefix(change.Path, "sys/policy/"))
+		if err != nil {
+			return nil, err
+		}
+		if policy == "" {
+			// Vault returns an empty policy when it is not present
+			return nil, nil
+		}
+		return policy, nil
+	case "SysAuth":
+		authMounts, err := client.ListAuth()
+		if err != nil {
+			return nil, err
+		}
+		if authMount, ok := authMounts[strings.TrimPrefix(change.Path, "sys/auth/")]; ok {
+			return authMount, nil
+		}
+		return nil, nil
+	case "SysAudit":
+		audits, err := client.ListAudit()
+		if err != nil {
+			return nil, err
+		}
+		if audit, ok := audits[strings.TrimPrefix(change.Path, "sys/audit/")]; ok {
+			return audit, nil
+		}
+		return nil, nil
+	case "SysMounts":
+		mounts, err := client.ListMounts()
+		if err != nil {
+			return nil, err
+		}
+		if mount, ok := mounts[strings.TrimPrefix(change.Path, "sys/mounts/")]; ok {
+			return mount, nil
+		}
+		return nil, nil
+	case "SysNamespaces":
+		names, err := client.ListNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(change.Path, "sys/namespaces/")
+		for _, n := range names {
+			if n == name {
+				return n, nil
+			}
+		}
+		return nil, nil
+	case "Identity":
+		kind, mount, name, err := parseIdentityPath(change.Path)
+		if err != nil {
+			return nil, err
+		}
+		return readIdentity(client, newIdentityListing(client), kind, mount, name)
+	default:
+		return nil, fmt.Errorf("unknown handler %q for path %s", change.Handler, change.Path)
+	}
+}
+
+// Return the changes whose path has been modified in Vault since the change was recorded
+func DriftedChanges(client vault.Vault, changes []plan.Change) (drifted []plan.Change, err error) {
+	for _, change := range changes {
+		live, err := LiveValue(client, change)
+		if err != nil {
+			return drifted, fmt.Errorf("could not read %s: %s", change.FullPath(), err)
+		}
+
+		liveFingerprint, err := plan.Fingerprint(live)
+		if err != nil {
+			return drifted, err
+		}
+		recordedFingerprint, err := plan.Fingerprint(change.Before)
+		if err != nil {
+			return drifted, err
+		}
+
+		if liveFingerprint != recordedFingerprint {
+			log.WithFields(log.Fields{
+				"path":     change.Path,
+				"recorded": change.Before,
+				"live":     live,
+			}).Debug("Path has changed in Vault")
+			drifted = append(drifted, change)
+		}
+	}
+	return drifted, nil
+}
+
+// Make a recorded change in Vault
+func ApplyChange(client vault.Vault, change plan.Change) error {
+	client, err := namespaceClient(client, change)
+	if err != nil {
+		return err
+	}
+
+	switch change.Handler {
+	case "Generic":
+		if change.Action == plan.Delete {
+			return deleteDocument(client, newKvMounts(client), change.Path)
+		}
+		data, ok := change.After.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("document for %s is not a json object: %+v", change.Path, change.After)
+		}
+		return putDocument(client, newKvMounts(client), change.Path, data)
+	case "SysPolicy":
+		name := strings.TrimPrefix(change.Path, "sys/policy/")
+		if change.Action == plan.Delete {
+			return client.DeletePolicy(name)
+		}
+		policy, ok := change.After.(string)
+		if !ok {
+			return fmt.Errorf("policy for %s is not a string: %+v", change.Path, change.After)
+		}
+		return client.PutPolicy(name, policy)
+	case "SysAuth":
+		path := strings.TrimPrefix(change.Path, "sys/auth/")
+		if change.Action == plan.Delete {
+			return client.DisableAuth(path)
+		}
+		// After has been through json, so convert it back to the options type
+		var enableOpts vaultApi.EnableAuthOptions
+		err := convertType(change.After, &enableOpts)
+		if err != nil {
+			return fmt.Errorf("could not read auth options for %s: %s", change.Path, err)
+		}
+		if change.Action == plan.Update {
+			var liveAuth vaultApi.AuthMount
+			err = convertType(change.Before, &liveAuth)
+			if err != nil {
+				return fmt.Errorf("could not read auth mount for %s: %s", change.Path, err)
+			}
+			configured, err := configuredAuthMount(enableOpts)
+			if err != nil {
+				return err
+			}
+			if !requiresRemount(&configured, &liveAuth) {
+				return client.TuneAuth(path, authTuneData(enableOpts))
+			}
+			// only planned when remounting was allowed
+			err = client.DisableAuth(path)
+			if err != nil {
+				return err
+			}
+		}
+		return client.EnableAuth(path, &enableOpts)
+	case "SysAudit":
+		path := strings.TrimPrefix(change.Path, "sys/audit/")
+		if change.Action == plan.Delete || change.Action == plan.Update {
+			// audit devices cannot be tuned, so must be re-created
+			err := client.DisableAudit(path)
+			if err != nil || change.Action == plan.Delete {
+				return err
+			}
+		}
+		var auditOpts vaultApi.EnableAuditOptions
+		err := convertType(change.After, &auditOpts)
+		if err != nil {
+			return fmt.Errorf("could not read audit options for %s: %s", change.Path, err)
+		}
+		return client.EnableAudit(path, &auditOpts)
+	case "SysMounts":
+		path := strings.TrimPrefix(change.Path, "sys/mounts/")
+		if change.Action == plan.Delete {
+			return client.Unmount(path)
+		}
+		var mountInput vaultApi.MountInput
+		err := convertType(change.After, &mountInput)
+		if err != nil {
+			return fmt.Errorf("could not read mount options for %s: %s", change.Path, err)
+		}
+		if change.Action == plan.Update {
+			return client.TuneMount(path, tuneConfig(mountInput))
+		}
+		return client.Mount(path, &mountInput)
+	case "SysNamespaces":
+		name := strings.TrimPrefix(change.Path, "sys/namespaces/")
+		if change.Action == plan.Delete {
+			return client.DeleteNamespace(name)
+		}
+		return client.CreateNamespace(name)
+	case "Identity":
+		kind, mount, name, err := parseIdentityPath(change.Path)
+		if err != nil {
+			return err
+		}
+		if change.Action == plan.Delete {
+			return deleteIdentity(client, newIdentityListing(client), kind, mount, name)
+		}
+		value := newIdentityValue(kind)
+		// After has been through json, so convert it back to the declared type
+		err = convertType(change.After, value)
+		if err != nil {
+			return fmt.Errorf("could not read %s for %s: %s", kind, change.Path, err)
+		}
+		// the plan is applied in order, so everything referred to has been created by now
+		return writeIdentity(client, newIdentityListing(client), kind, mount, name, value,
+			pendingIdentities{})
+	default:
+		return fmt.Errorf("unknown handler %q for path %s", change.Handler, change.Path)
+	}
+}
+
+// Return a client for the namespace a change was recorded in. Changes without a namespace are made
+// with client as it is, which may itself have been created for a namespace.
+func namespaceClient(client vault.Vault, change plan.Change) (vault.Vault, error) {
+	if change.Namespace == "" {
+		return client, nil
+	}
+	nsClient, err := client.WithNamespace(change.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not create client for namespace %s: %s", change.Namespace, err)
+	}
+	return nsClient, nil
+}
+
+// Convert a value to another type with the same json representation
+func convertType(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
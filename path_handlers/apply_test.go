@@ -0,0 +1,88 @@
+package path_handlers
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+	"testing"
+)
+
+func TestDriftedChanges(t *testing.T) {
+	client := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"key": "live"}},
+	}
+
+	changes := []plan.Change{
+		{Path: "unchanged", Handler: "Generic", Before: map[string]interface{}{"key": "live"}},
+		{Path: "changed", Handler: "Generic", Before: map[string]interface{}{"key": "planned"}},
+	}
+	drifted, err := DriftedChanges(client, changes)
+	if err != nil {
+		t.Fatalf("Error calling DriftedChanges: %s", err)
+	}
+	if len(drifted) != 1 || drifted[0].Path != "changed" {
+		t.Errorf("Expected only path \"changed\" to have drifted, got %+v", drifted)
+	}
+}
+
+// A policy that is missing in Vault should match a recorded create
+func TestLiveValue_missingPolicy(t *testing.T) {
+	client := &vault.MockClient{ReturnString: ""}
+	live, err := LiveValue(client, plan.Change{Path: "sys/policy/foo", Handler: "SysPolicy"})
+	if err != nil {
+		t.Fatalf("Error calling LiveValue: %s", err)
+	}
+	if live != nil {
+		t.Errorf("Expected nil for missing policy, got %+v", live)
+	}
+}
+
+// Auth options are stored as a map once saved in a plan file, and should still be applied
+func TestApplyChange_authFromJson(t *testing.T) {
+	change := plan.Change{
+		Path:    "sys/auth/approle/",
+		Action:  plan.Create,
+		Handler: "SysAuth",
+		After:   map[string]interface{}{"type": "approle"},
+	}
+	err := ApplyChange(&vault.MockClient{}, change)
+	if err != nil {
+		t.Errorf("Error calling ApplyChange: %s", err)
+	}
+}
+
+func TestApplyChange_unknownHandler(t *testing.T) {
+	err := ApplyChange(&vault.MockClient{}, plan.Change{Path: "foo", Handler: "Unknown"})
+	if err == nil {
+		t.Errorf("Expected error for unknown handler")
+	}
+}
+
+// Records the namespaces that clients are created for
+type namespaceRecordingClient struct {
+	vault.MockClient
+	namespaces []string
+}
+
+func (c *namespaceRecordingClient) WithNamespace(namespace string) (vault.Vault, error) {
+	c.namespaces = append(c.namespaces, namespace)
+	return c, nil
+}
+
+// Changes recorded in a namespace should be applied in that namespace
+func TestApplyChange_namespace(t *testing.T) {
+	client := &namespaceRecordingClient{}
+	change := plan.Change{
+		Path:      "sys/namespaces/team-b",
+		Namespace: "org/team-a",
+		Action:    plan.Create,
+		Handler:   "SysNamespaces",
+	}
+	err := ApplyChange(client, change)
+	if err != nil {
+		t.Fatalf("Error calling ApplyChange: %s", err)
+	}
+	if len(client.namespaces) != 1 || client.namespaces[0] != "org/team-a" {
+		t.Errorf("Expected a client for namespace org/team-a, got %v", client.namespaces)
+	}
+}
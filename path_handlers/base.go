@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/safety"
 	"github.com/starlingbank/vaultsmith/vault"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -16,6 +21,29 @@ type PathHandlerConfig struct {
 	Order             int    // order to process (lower int is earlier, except 0 is last)
 	TemplateFile      string
 	TemplateOverrides []string
+	Changes           *plan.ChangeSet // changes made by all handlers are recorded here
+	Report            *report.Report  // outcome for every path handled, including unchanged ones
+	AllowNoAudit      bool            // allow SysAudit to disable the last audit device
+	AllowAuthRemount  bool            // allow SysAuth to re-create mounts, deleting their roles
+	AllowUnmount      bool            // allow SysMounts to unmount undeclared secret engines
+	Namespace         string          // Vault Enterprise namespace the documents are applied in
+	Safety            *safety.Rules   // paths which may not be changed, whatever the documents say
+	StatePath         string          // where Generic records the documents it owns, if anywhere
+	Strict            bool            // let Generic delete undeclared documents it does not own
+	LockPath          string          // the run lock, which Generic never deletes
+	Workers           int             // paths Generic and SysPolicy reconcile at once, at least 1
+}
+
+// The report action for each type of change
+var reportActions = map[plan.Action]report.Action{
+	plan.Create: report.Created,
+	plan.Update: report.Updated,
+	plan.Delete: report.Deleted,
+}
+
+// Return the report action for a change, e.g. one from a plan file
+func ReportAction(action plan.Action) report.Action {
+	return reportActions[action]
 }
 
 // A PathHandler takes a path and applies the policies within
@@ -46,6 +74,31 @@ func (h *BaseHandler) Order() int {
 	return h.order
 }
 
+// Record a change this handler is about to make to Vault, and return whether the safety rules allow
+// it. Every change goes through here, so a change which is refused is reported as skipped and must
+// not be made.
+func (h *BaseHandler) recordChange(change plan.Change) bool {
+	change.Handler = h.name
+	change.Namespace = h.config.Namespace
+	if err := h.config.Safety.Check(change.FullPath(), change.Action); err != nil {
+		h.log.Warnf("Skipping %s of %s: %s", change.Action, change.FullPath(), err)
+		h.recordResult(change.Path, report.SkippedProtected, change.SourceFile)
+		return false
+	}
+	h.config.Changes.Add(change)
+	h.recordResult(change.Path, reportActions[change.Action], change.SourceFile)
+	return true
+}
+
+// Record the outcome for a path in the run report
+func (h *BaseHandler) recordResult(path string, action report.Action, sourceFile string) {
+	h.config.Report.AddPath(report.PathResult{
+		Path:       path,
+		Action:     action,
+		SourceFile: sourceFile,
+	})
+}
+
 func (h *BaseHandler) readFile(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -106,3 +159,14 @@ func templatePath(apiPath string, name string) (templatePath string) {
 		return apiPath
 	}
 }
+
+// Return the keys of a map with string keys, such as the live paths of a handler, in order, so
+// that changes are always reported in the same order
+func sortedNames(m interface{}) []string {
+	names := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		names = append(names, key.String())
+	}
+	sort.Strings(names)
+	return names
+}
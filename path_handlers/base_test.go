@@ -2,6 +2,9 @@ package path_handlers
 
 import (
 	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/safety"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -25,3 +28,34 @@ func TestReadFile(t *testing.T) {
 		t.Errorf("Got %s, expected %s", data, expectStr)
 	}
 }
+
+// Changes refused by the safety rules are reported as skipped, rather than recorded
+func TestBaseHandler_recordChange_safety(t *testing.T) {
+	changes := plan.NewChangeSet()
+	runReport := report.New(false)
+	runReport.StartHandler("Generic", "secret", "team-a")
+	h := &BaseHandler{
+		name: "Generic",
+		config: PathHandlerConfig{
+			Changes:   changes,
+			Report:    runReport,
+			Namespace: "team-a",
+			Safety:    &safety.Rules{Protected: []string{"team-a/secret/prod"}},
+		},
+		log: log.WithField("handler", "Generic"),
+	}
+
+	if h.recordChange(plan.Change{Path: "secret/prod/db", Action: plan.Update}) {
+		t.Errorf("Expected update of protected path to be refused")
+	}
+	if !h.recordChange(plan.Change{Path: "secret/prod/new", Action: plan.Create}) {
+		t.Errorf("Expected creation of protected path to be allowed")
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Path != "secret/prod/new" {
+		t.Errorf("Expected only secret/prod/new to be recorded, got %+v", changes.Changes)
+	}
+	paths := runReport.Handlers[0].Paths
+	if len(paths) != 2 || paths[0].Action != report.SkippedProtected {
+		t.Errorf("Expected secret/prod/db to be skipped, got %+v", paths)
+	}
+}
@@ -0,0 +1,265 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pmezard/go-difflib/difflib"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+	Rendering of the differences between configured and live values, for reviewing changes.
+
+	Differences that Vault considers equivalent (see isValueEquivalent) are never shown, so a
+	diff is only empty when the handler would not make a change.
+*/
+
+// Prefixes for each line of a key by key diff
+const (
+	diffAdded   = "+"
+	diffRemoved = "-"
+	diffChanged = "~"
+)
+
+// Return a key by key listing of the keys in a configured document which are missing or differ
+// in the live document. As with areKeysApplied, keys only present in the live document are not
+// listed, as Vault fills in defaults for fields that were not written.
+func documentDiff(configured map[string]interface{}, live map[string]interface{}) (diff []string) {
+	for _, key := range sortedKeys(configured) {
+		liveValue, ok := live[key]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("%s %s: %s", diffAdded, key, formatValue(configured[key])))
+			continue
+		}
+		if !isValueEquivalent(key, configured[key], liveValue) {
+			diff = append(diff, fmt.Sprintf("%s %s: %s => %s", diffChanged, key,
+				formatValue(liveValue), formatValue(configured[key])))
+		}
+	}
+	return diff
+}
+
+// List every key in a document with the given prefix, e.g. diffAdded for a document which is
+// being created
+func documentListing(prefix string, doc map[string]interface{}) (diff []string) {
+	for _, key := range sortedKeys(doc) {
+		diff = append(diff, fmt.Sprintf("%s %s: %s", prefix, key, formatValue(doc[key])))
+	}
+	return diff
+}
+
+// Return a field by field listing of the differences between a configured auth mount and the live
+// one. As with mounts, only configured options are compared, as Vault may add its own.
+func authMountDiff(configured *vaultApi.AuthMount, live *vaultApi.AuthMount) (diff []string) {
+	for _, field := range []struct {
+		key        string
+		configured interface{}
+		live       interface{}
+	}{
+		{"type", configured.Type, live.Type},
+		{"description", configured.Description, live.Description},
+		{"local", configured.Local, live.Local},
+		{"seal_wrap", configured.SealWrap, live.SealWrap},
+	} {
+		if field.configured != field.live {
+			diff = append(diff, fmt.Sprintf("%s %s: %s => %s", diffChanged, field.key,
+				formatValue(field.live), formatValue(field.configured)))
+		}
+	}
+
+	configuredFields := structFields(configured.Config)
+	liveFields := structFields(live.Config)
+	for _, key := range sortedKeys(configuredFields) {
+		if !isValueEquivalent(key, configuredFields[key], liveFields[key]) {
+			diff = append(diff, fmt.Sprintf("%s config.%s: %s => %s", diffChanged, key,
+				formatValue(liveFields[key]), formatValue(configuredFields[key])))
+		}
+	}
+
+	return append(diff, optionsDiff(configured.Options, live.Options)...)
+}
+
+// Return a field by field listing of the differences between a configured secret engine mount and
+// the live one. The mount is applied if there are none. Only configured options are compared, as
+// Vault adds its own (e.g. the kv version).
+func mountDiff(configured *vaultApi.MountOutput, live *vaultApi.MountOutput) (diff []string) {
+	if configured.Type != live.Type {
+		diff = append(diff, fmt.Sprintf("%s type: %s => %s", diffChanged,
+			formatValue(live.Type), formatValue(configured.Type)))
+	}
+	if configured.Description != live.Description {
+		diff = append(diff, fmt.Sprintf("%s description: %s => %s", diffChanged,
+			formatValue(live.Description), formatValue(configured.Description)))
+	}
+
+	configuredFields := structFields(configured.Config)
+	liveFields := structFields(live.Config)
+	for _, key := range sortedKeys(configuredFields) {
+		if !isValueEquivalent(key, configuredFields[key], liveFields[key]) {
+			diff = append(diff, fmt.Sprintf("%s config.%s: %s => %s", diffChanged, key,
+				formatValue(liveFields[key]), formatValue(configuredFields[key])))
+		}
+	}
+
+	return append(diff, optionsDiff(configured.Options, live.Options)...)
+}
+
+// Return a listing of the configured mount options which are missing or differ in the live ones
+func optionsDiff(configured map[string]string, live map[string]string) (diff []string) {
+	var keys []string
+	for k := range configured {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		liveValue, ok := live[key]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("%s options.%s: %s", diffAdded, key,
+				formatValue(configured[key])))
+		} else if liveValue != configured[key] {
+			diff = append(diff, fmt.Sprintf("%s options.%s: %s => %s", diffChanged, key,
+				formatValue(liveValue), formatValue(configured[key])))
+		}
+	}
+	return diff
+}
+
+// Return a listing of the differences between a configured audit device and the live one. Unlike
+// mounts, every option is compared, as the device is re-created with only the configured options.
+func auditDiff(configured *vaultApi.Audit, live *vaultApi.Audit) (diff []string) {
+	if configured.Type != live.Type {
+		diff = append(diff, fmt.Sprintf("%s type: %s => %s", diffChanged,
+			formatValue(live.Type), formatValue(configured.Type)))
+	}
+
+	keys := map[string]interface{}{}
+	for k := range configured.Options {
+		keys[k] = nil
+	}
+	for k := range live.Options {
+		keys[k] = nil
+	}
+	for _, key := range sortedKeys(keys) {
+		configuredValue, inConfigured := configured.Options[key]
+		liveValue, inLive := live.Options[key]
+		switch {
+		case !inLive:
+			diff = append(diff, fmt.Sprintf("%s options.%s: %s", diffAdded, key,
+				formatValue(configuredValue)))
+		case !inConfigured:
+			diff = append(diff, fmt.Sprintf("%s options.%s: %s", diffRemoved, key,
+				formatValue(liveValue)))
+		case configuredValue != liveValue:
+			diff = append(diff, fmt.Sprintf("%s options.%s: %s => %s", diffChanged, key,
+				formatValue(liveValue), formatValue(configuredValue)))
+		}
+	}
+	return diff
+}
+
+// Return a line based unified diff from the live policy to the configured one
+func policyDiff(name string, configured string, live string) []string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(live),
+		B:        difflib.SplitLines(configured),
+		FromFile: "vault/" + name,
+		ToFile:   "configured/" + name,
+		Context:  3,
+	})
+	if err != nil {
+		// only happens if writing to the internal buffer fails
+		return []string{fmt.Sprintf("could not render diff: %s", err)}
+	}
+	return strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+}
+
+// Determine whether two values for a key are the same, as far as Vault is concerned
+func isValueEquivalent(key string, a interface{}, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true // value the same, skip further checks for this key
+	}
+	if isEmptyCollection(a) && isEmptyCollection(b) {
+		return true // e.g. a list that was not configured, and is returned empty by Vault
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	// numbers are float64 when parsed from a document, but json.Number when read from Vault
+	if isNumberEquivalent(a, b) {
+		return true
+	}
+
+	// this is a bit more complicated, thanks to ttls and bundling into arrays :(
+	if strings.Contains(key, "ttl") {
+		// check if the ttls are equivalent
+		if isTtlEquivalent(a, b) {
+			return true
+		}
+	}
+	// covers cases such as "policy" == ["policy]
+	// logic is a bit scary, see function documentation
+	return isSliceEquivalent(a, b)
+}
+
+// Determine whether two values are both numbers with the same value, regardless of type
+func isNumberEquivalent(a interface{}, b interface{}) bool {
+	numA, okA := toFloat(a)
+	numB, okB := toFloat(b)
+	return okA && okB && numA == numB
+}
+
+func toFloat(x interface{}) (float64, bool) {
+	switch n := x.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// Determine whether a value is a slice or map with no elements, including a nil one
+func isEmptyCollection(x interface{}) bool {
+	v := reflect.ValueOf(x)
+	return (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0
+}
+
+// Map the json field names of a struct, or a pointer to one, to their values, including empty ones
+func structFields(s interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	v := reflect.Indirect(reflect.ValueOf(s))
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = v.Type().Field(i).Name
+		}
+		fields[name] = v.Field(i).Interface()
+	}
+	return fields
+}
+
+func sortedKeys(m map[string]interface{}) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Format a value for display, as json where possible to make types clear (e.g. "60" vs 60)
+func formatValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
@@ -0,0 +1,153 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	vaultApi "github.com/hashicorp/vault/api"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDocumentDiff(t *testing.T) {
+	configured := map[string]interface{}{
+		"policies": "foo",
+		"ttl":      "1m",
+		"max_ttl":  "1h",
+		"new_key":  "bar",
+	}
+	live := map[string]interface{}{
+		"policies":    []interface{}{"foo"}, // equivalent to "foo"
+		"ttl":         60,                   // equivalent to "1m"
+		"max_ttl":     60,
+		"default_key": "baz", // only live, ignored
+	}
+
+	expected := []string{
+		`~ max_ttl: 60 => "1h"`,
+		`+ new_key: "bar"`,
+	}
+	diff := documentDiff(configured, live)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
+
+func TestDocumentDiff_equivalent(t *testing.T) {
+	configured := map[string]interface{}{"policies": []interface{}{"a", "b"}}
+	live := map[string]interface{}{"policies": []interface{}{"b", "a"}}
+	if diff := documentDiff(configured, live); len(diff) != 0 {
+		t.Errorf("Expected no diff for reordered slice, got %q", diff)
+	}
+}
+
+// Numbers read from Vault are only shown as changed if their value differs
+func TestDocumentDiff_numbers(t *testing.T) {
+	configured := map[string]interface{}{"token_num_uses": float64(10), "period": float64(60)}
+	live := map[string]interface{}{"token_num_uses": json.Number("10"), "period": json.Number("30")}
+	expected := []string{"~ period: 30 => 60"}
+	if diff := documentDiff(configured, live); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
+
+func TestPolicyDiff(t *testing.T) {
+	live := "path \"secret/*\" {\n  capabilities = [\"read\"]\n}\n"
+	configured := "path \"secret/*\" {\n  capabilities = [\"read\", \"list\"]\n}\n"
+
+	diff := strings.Join(policyDiff("foo", configured, live), "\n")
+	for _, e := range []string{
+		"--- vault/foo",
+		"+++ configured/foo",
+		"-  capabilities = [\"read\"]",
+		"+  capabilities = [\"read\", \"list\"]",
+	} {
+		if !strings.Contains(diff, e) {
+			t.Errorf("Diff does not contain %q:\n%s", e, diff)
+		}
+	}
+}
+
+func TestAuthMountDiff(t *testing.T) {
+	configured := &vaultApi.AuthMount{
+		Type:   "approle",
+		Config: vaultApi.AuthConfigOutput{DefaultLeaseTTL: 120},
+	}
+	live := &vaultApi.AuthMount{
+		Type:   "approle",
+		Config: vaultApi.AuthConfigOutput{DefaultLeaseTTL: 60},
+	}
+
+	expected := []string{"~ config.default_lease_ttl: 60 => 120"}
+	diff := authMountDiff(configured, live)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
+
+func TestMountDiff(t *testing.T) {
+	configured := &vaultApi.MountOutput{
+		Type:    "kv",
+		Config:  vaultApi.MountConfigOutput{MaxLeaseTTL: 3600},
+		Options: map[string]string{"version": "2"},
+	}
+	live := &vaultApi.MountOutput{
+		Type:    "kv",
+		Options: map[string]string{"version": "1"},
+	}
+
+	expected := []string{
+		`~ config.max_lease_ttl: 0 => 3600`,
+		`~ options.version: "1" => "2"`,
+	}
+	diff := mountDiff(configured, live)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	configured := &vaultApi.Audit{
+		Type:    "file",
+		Options: map[string]string{"file_path": "/var/log/audit.log", "mode": "0600"},
+	}
+	live := &vaultApi.Audit{
+		Type:    "file",
+		Options: map[string]string{"file_path": "/tmp/audit.log", "format": "json"},
+	}
+
+	expected := []string{
+		`~ options.file_path: "/tmp/audit.log" => "/var/log/audit.log"`,
+		`- options.format: "json"`,
+		`+ options.mode: "0600"`,
+	}
+	diff := auditDiff(configured, live)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
+
+func TestAuthMountDiff_fields(t *testing.T) {
+	configured := &vaultApi.AuthMount{
+		Type:        "approle",
+		Description: "new",
+		SealWrap:    true,
+		Options:     map[string]string{"version": "1"},
+	}
+	live := &vaultApi.AuthMount{
+		Type:        "approle",
+		Description: "old",
+		Config: vaultApi.AuthConfigOutput{
+			AuditNonHMACRequestKeys: []string{}, // equivalent to not configured
+		},
+	}
+
+	expected := []string{
+		`~ description: "old" => "new"`,
+		`~ seal_wrap: false => true`,
+		`+ options.version: "1"`,
+	}
+	diff := authMountDiff(configured, live)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff.\nExpected: %q\nGot: %q", expected, diff)
+	}
+}
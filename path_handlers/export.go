@@ -0,0 +1,264 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Functions for exporting the current configuration of Vault as a document tree, in the layout
+	that the handlers read. Applying an exported tree straight away should make no changes.
+*/
+
+// Write each auth mount to exportDir/sys/auth/<path>.json
+func ExportAuth(client vault.Vault, exportDir string) error {
+	authMounts, err := client.ListAuth()
+	if err != nil {
+		return fmt.Errorf("error listing auth mounts: %s", err)
+	}
+
+	for path, authMount := range authMounts {
+		if authMount.Type == "token" {
+			// always present and cannot be configured, so SysAuth leaves it alone
+			continue
+		}
+		file := filepath.Join(exportDir, "sys", "auth", strings.TrimSuffix(path, "/")+".json")
+		err = writeDocument(file, authInput(*authMount))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write each secret engine to exportDir/sys/mounts/<path>.json, except those built in to Vault
+func ExportMounts(client vault.Vault, exportDir string) error {
+	mounts, err := client.ListMounts()
+	if err != nil {
+		return fmt.Errorf("error listing mounts: %s", err)
+	}
+
+	for path, mount := range mounts {
+		if systemMountTypes[mount.Type] {
+			// always present and cannot be configured, so SysMounts leaves them alone
+			continue
+		}
+		file := filepath.Join(exportDir, "sys", "mounts", strings.TrimSuffix(path, "/")+".json")
+		err = writeDocument(file, mountInput(*mount))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write each audit device to exportDir/sys/audit/<path>.json
+func ExportAudit(client vault.Vault, exportDir string) error {
+	audits, err := client.ListAudit()
+	if err != nil {
+		return fmt.Errorf("error listing audit devices: %s", err)
+	}
+
+	for path, audit := range audits {
+		file := filepath.Join(exportDir, "sys", "audit", strings.TrimSuffix(path, "/")+".json")
+		err = writeDocument(file, auditInput(*audit))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write each entity, group and group alias under exportDir/identity, in the layout the Identity
+// handler reads, with the IDs in them resolved to names
+func ExportIdentity(client vault.Vault, exportDir string) error {
+	listing := newIdentityListing(client)
+	var paths []string
+	for _, kind := range []string{entityKind, groupKind} {
+		names, err := listing.identityNames(kind)
+		if err != nil {
+			return fmt.Errorf("error listing %s: %s", kind, err)
+		}
+		for _, name := range names {
+			paths = append(paths, identityPath(kind, "", name))
+		}
+	}
+	aliases, err := listing.groupAliases()
+	if err != nil {
+		return fmt.Errorf("error listing %s: %s", groupAliasKind, err)
+	}
+	paths = append(paths, sortedNames(aliases)...)
+
+	for _, path := range paths {
+		kind, mount, name, err := parseIdentityPath(path)
+		if err != nil {
+			return err
+		}
+		value, err := readIdentity(client, listing, kind, mount, name)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %s", path, err)
+		}
+		if value == nil {
+			continue
+		}
+		err = writeDocument(filepath.Join(exportDir, filepath.FromSlash(path)+".json"), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write each policy to exportDir/sys/policy/<name>.json
+func ExportPolicies(client vault.Vault, exportDir string) error {
+	policies, err := client.ListPolicies()
+	if err != nil {
+		return fmt.Errorf("error listing policies: %s", err)
+	}
+
+	for _, name := range policies {
+		if name == "root" {
+			// cannot be read or modified
+			continue
+		}
+		rules, err := client.GetPolicy(name)
+		if err != nil {
+			return fmt.Errorf("error reading policy %s: %s", name, err)
+		}
+		file := filepath.Join(exportDir, "sys", "policy", name+".json")
+		err = writeDocument(file, map[string]string{"policy": rules})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write each document under path in Vault to exportDir/<path>/<key>.json, recursing into
+// sub-directories. Secrets in KV v2 mounts are exported with their metadata settings.
+func ExportGeneric(client vault.Vault, exportDir string, path string) error {
+	return exportDocuments(client, newKvMounts(client), exportDir, path)
+}
+
+func exportDocuments(client vault.Vault, mounts *kvMounts, exportDir string, path string) error {
+	path = strings.Trim(path, "/")
+	logger := log.WithFields(log.Fields{"path": path})
+
+	secret, err := listDocuments(client, mounts, path)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %s", path, err)
+	}
+	if secret == nil {
+		logger.Warn("Nothing to export")
+		return nil
+	}
+	keys, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return fmt.Errorf("could not read keys of %s from %+v", path, secret.Data)
+	}
+
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("key %+v in %s is not a string", k, path)
+		}
+		docPath := path + "/" + key
+		if strings.HasSuffix(key, "/") {
+			err = exportDocuments(client, mounts, exportDir, docPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		doc, err := readDocument(client, mounts, docPath)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %s", docPath, err)
+		}
+		if doc == nil {
+			logger.WithFields(log.Fields{"docPath": docPath}).Warn("Document is empty, skipping")
+			continue
+		}
+		err = writeDocument(filepath.Join(exportDir, filepath.FromSlash(docPath)+".json"), doc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The reverse of ConvertAuthConfig
+func convertAuthConfigOutput(output vaultApi.AuthConfigOutput) vaultApi.AuthConfigInput {
+	input := vaultApi.AuthConfigInput{
+		PluginName:                output.PluginName,
+		AuditNonHMACRequestKeys:   output.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys:  output.AuditNonHMACResponseKeys,
+		ListingVisibility:         output.ListingVisibility,
+		PassthroughRequestHeaders: output.PassthroughRequestHeaders,
+	}
+	// zero means the system default, which is represented by an empty string on input
+	if output.DefaultLeaseTTL != 0 {
+		input.DefaultLeaseTTL = fmt.Sprintf("%ds", output.DefaultLeaseTTL)
+	}
+	if output.MaxLeaseTTL != 0 {
+		input.MaxLeaseTTL = fmt.Sprintf("%ds", output.MaxLeaseTTL)
+	}
+	return input
+}
+
+// Return the options which enable an auth mount as it is in Vault
+func authInput(authMount vaultApi.AuthMount) vaultApi.EnableAuthOptions {
+	return vaultApi.EnableAuthOptions{
+		Type:        authMount.Type,
+		Description: authMount.Description,
+		Config:      convertAuthConfigOutput(authMount.Config),
+		Local:       authMount.Local,
+		SealWrap:    authMount.SealWrap,
+		Options:     authMount.Options,
+	}
+}
+
+// Return the input which mounts a secret engine as it is in Vault
+func mountInput(mount vaultApi.MountOutput) vaultApi.MountInput {
+	return vaultApi.MountInput{
+		Type:        mount.Type,
+		Description: mount.Description,
+		Config:      convertMountConfigOutput(mount.Config),
+		Options:     mount.Options,
+		Local:       mount.Local,
+		SealWrap:    mount.SealWrap,
+	}
+}
+
+// Return the options which enable an audit device as it is in Vault
+func auditInput(audit vaultApi.Audit) vaultApi.EnableAuditOptions {
+	return vaultApi.EnableAuditOptions{
+		Type:        audit.Type,
+		Description: audit.Description,
+		Options:     audit.Options,
+		Local:       audit.Local,
+	}
+}
+
+// Write data to file as indented json, creating any parent directories
+func writeDocument(file string, data interface{}) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode %s: %s", file, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory for %s: %s", file, err)
+	}
+
+	log.WithFields(log.Fields{"file": file}).Info("Exporting document")
+	return ioutil.WriteFile(file, append(content, '\n'), 0644)
+}
@@ -0,0 +1,263 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConvertAuthConfigOutput(t *testing.T) {
+	output := vaultApi.AuthConfigOutput{
+		DefaultLeaseTTL:   3600,
+		ListingVisibility: "unauth",
+	}
+	input := convertAuthConfigOutput(output)
+	if input.DefaultLeaseTTL != "3600s" || input.MaxLeaseTTL != "" {
+		t.Errorf("TTLs not converted correctly: %+v", input)
+	}
+
+	// converting back should give the original, so exported auth mounts are already applied
+	converted, err := ConvertAuthConfig(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(converted, output) {
+		t.Errorf("Round trip does not match: %+v != %+v", converted, output)
+	}
+}
+
+// Returns a configured auth mount, secret engine and audit device, alongside built-in ones
+type exportClient struct {
+	vault.MockClient
+}
+
+func (c *exportClient) ListAuth() (map[string]*vaultApi.AuthMount, error) {
+	return map[string]*vaultApi.AuthMount{
+		"token/": {Type: "token"},
+		"github/": {
+			Type:        "github",
+			Description: "GitHub logins",
+			Options:     map[string]string{"version": "1"},
+		},
+	}, nil
+}
+
+func TestExportAuth(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ExportAuth(&exportClient{}, dir)
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sys", "auth", "github.json"))
+	if err != nil {
+		t.Fatalf("Auth mount was not exported: %s", err)
+	}
+	var enableOpts vaultApi.EnableAuthOptions
+	if err = json.Unmarshal(content, &enableOpts); err != nil {
+		t.Fatalf("Exported document is not valid json: %s", err)
+	}
+	expected := map[string]string{"version": "1"}
+	if enableOpts.Type != "github" || !reflect.DeepEqual(enableOpts.Options, expected) {
+		t.Errorf("Exported auth mount does not match the live one: %+v", enableOpts)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sys", "auth", "token.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected token auth mount not to be exported")
+	}
+}
+
+func (c *exportClient) ListMounts() (map[string]*vaultApi.MountOutput, error) {
+	return map[string]*vaultApi.MountOutput{
+		"cubbyhole/": {Type: "cubbyhole"},
+		"secret/": {
+			Type:    "kv",
+			Config:  vaultApi.MountConfigOutput{MaxLeaseTTL: 3600},
+			Options: map[string]string{"version": "2"},
+		},
+	}, nil
+}
+
+func (c *exportClient) ListAudit() (map[string]*vaultApi.Audit, error) {
+	return map[string]*vaultApi.Audit{
+		"file/": {Type: "file", Options: map[string]string{"file_path": "/var/log/vault.log"}},
+	}, nil
+}
+
+// Exported secret engines should be applied already
+func TestExportMounts(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &exportClient{}
+	err = ExportMounts(client, dir)
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sys", "mounts", "cubbyhole.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected built-in cubbyhole mount not to be exported")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sys", "mounts", "secret.json"))
+	if err != nil {
+		t.Fatalf("Mount was not exported: %s", err)
+	}
+	var input vaultApi.MountInput
+	if err = json.Unmarshal(content, &input); err != nil {
+		t.Fatalf("Exported document is not valid json: %s", err)
+	}
+	config, err := ConvertMountConfig(input.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := &vaultApi.MountOutput{
+		Type:        input.Type,
+		Description: input.Description,
+		Config:      config,
+		Options:     mountOptions(input),
+	}
+	live, _ := client.ListMounts()
+	if diff := mountDiff(configured, live["secret/"]); len(diff) != 0 {
+		t.Errorf("Exported mount differs from the live one: %v", diff)
+	}
+}
+
+func TestExportAudit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ExportAudit(&exportClient{}, dir)
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sys", "audit", "file.json"))
+	if err != nil {
+		t.Fatalf("Audit device was not exported: %s", err)
+	}
+	var auditOpts vaultApi.EnableAuditOptions
+	if err = json.Unmarshal(content, &auditOpts); err != nil {
+		t.Fatalf("Exported document is not valid json: %s", err)
+	}
+	expected := vaultApi.EnableAuditOptions{
+		Type:    "file",
+		Options: map[string]string{"file_path": "/var/log/vault.log"},
+	}
+	if !reflect.DeepEqual(auditOpts, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, auditOpts)
+	}
+}
+
+// Applying exported identities to the same Vault should make no changes
+func TestExportIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := newIdentityClient()
+	client.identities["identity/entity/name/alice"] = map[string]interface{}{
+		"id":       "entity-alice",
+		"name":     "alice",
+		"policies": []interface{}{"reader"},
+	}
+	client.identities["identity/group/name/admins"] = map[string]interface{}{
+		"id":                "group-admins",
+		"name":              "admins",
+		"type":              "internal",
+		"policies":          []interface{}{"admin"},
+		"member_entity_ids": []interface{}{"entity-alice"},
+	}
+	err = ExportIdentity(client, dir)
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "identity", "group", "admins.json"))
+	if err != nil {
+		t.Fatalf("Group was not exported: %s", err)
+	}
+	var group identityGroup
+	if err = json.Unmarshal(content, &group); err != nil {
+		t.Fatalf("Exported document is not valid json: %s", err)
+	}
+	if !reflect.DeepEqual(group.MemberEntities, []string{"alice"}) {
+		t.Errorf("Expected members to be exported by name, got %+v", group)
+	}
+
+	changes := plan.NewChangeSet()
+	ih, err := NewIdentityHandler(client, PathHandlerConfig{DocumentPath: dir, Changes: changes})
+	if err != nil {
+		t.Fatalf("Failed to create Identity: %s", err)
+	}
+	err = ih.PutPoliciesFromDir(filepath.Join(dir, "identity"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	if len(changes.Changes) != 0 {
+		t.Errorf("Expected no changes applying exported identities, got %+v", changes.Changes)
+	}
+}
+
+func TestExportGeneric(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The mock returns the same secret for List and Read
+	client := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{
+			Data: map[string]interface{}{"keys": []interface{}{"foo"}},
+		},
+	}
+	err = ExportGeneric(client, dir, "auth/approle/role/")
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "auth", "approle", "role", "foo.json"))
+	if err != nil {
+		t.Fatalf("Document was not exported: %s", err)
+	}
+	var data map[string]interface{}
+	if err = json.Unmarshal(content, &data); err != nil {
+		t.Fatalf("Exported document is not valid json: %s", err)
+	}
+
+	// applying it should be a no-op
+	gh, err := NewGeneric(client, PathHandlerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gh.areKeysApplied(data, client.ReturnSecret.Data) {
+		t.Errorf("Exported document is not equivalent to the live one")
+	}
+}
+
+func TestIsNumberEquivalent(t *testing.T) {
+	if !isValueEquivalent("token_num_uses", float64(10), json.Number("10")) {
+		t.Errorf("Expected float64 and json.Number of the same value to be equivalent")
+	}
+	if isValueEquivalent("token_num_uses", float64(10), json.Number("11")) {
+		t.Errorf("Expected different numbers not to be equivalent")
+	}
+}
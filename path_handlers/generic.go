@@ -6,6 +6,8 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,13 +29,22 @@ type vaultDocument struct {
 // The generic handler simply writes the files to the path they are stored in
 type Generic struct {
 	BaseHandler
+	kv       *kvMounts
+	owned    map[string]bool        // paths in the state document, when tracking ownership
+	stateDoc map[string]interface{} // the state document as it was read
+	docs     []vaultDocument        // documents found by walkFile, ensured once the walk is done
+
+	// updated by the workers which ensure and remove documents
+	mutex            sync.Mutex
 	configuredDocMap map[string]vaultDocument
+	appliedDocMap    map[string]bool // declared documents written, or found already applied
 	removedDocMap    map[string]interface{}
 }
 
 func NewGeneric(client vault.Vault, config PathHandlerConfig) (*Generic, error) {
 	return &Generic{
 		BaseHandler: BaseHandler{
+			name:   "Generic",
 			client: client,
 			config: config,
 			log: log.WithFields(log.Fields{
@@ -40,7 +52,9 @@ func NewGeneric(client vault.Vault, config PathHandlerConfig) (*Generic, error)
 			}),
 		},
 		configuredDocMap: map[string]vaultDocument{},
+		appliedDocMap:    map[string]bool{},
 		removedDocMap:    map[string]interface{}{},
+		kv:               newKvMounts(client),
 	}, nil
 }
 
@@ -89,12 +103,12 @@ func (gh *Generic) walkFile(path string, f os.FileInfo, err error) error {
 	}
 
 	for _, td := range templatedDocs {
-		// parse our document data as json
+		// parse our document data according to its format
 		var data map[string]interface{}
-		err = json.Unmarshal([]byte(td.Content), &data)
+		err = document.Decode(f.Name(), td.Content, &data)
 		if err != nil {
-			log.Debugf("Content:\n%s", data)
-			return fmt.Errorf("failed to parse json from file %q: %s", path, err)
+			log.Debugf("Content:\n%s", td.Content)
+			return fmt.Errorf("failed to parse document from file %q: %s", path, err)
 		}
 
 		doc := vaultDocument{
@@ -102,18 +116,25 @@ func (gh *Generic) walkFile(path string, f os.FileInfo, err error) error {
 			data:       data,
 			sourceFile: f.Name(),
 		}
-		err := gh.ensureDoc(doc)
-		if err != nil {
-			return err
-		}
+		gh.docs = append(gh.docs, doc)
 	}
 
 	return nil
 }
 
 func (gh *Generic) PutPoliciesFromDir(path string) error {
+	err := gh.loadState()
+	if err != nil {
+		return err
+	}
+
 	// path must be a real file system path here, not the relative path to the document root
-	err := filepath.Walk(path, gh.walkFile)
+	gh.docs = nil
+	err = filepath.Walk(path, gh.walkFile)
+	if err != nil {
+		return err
+	}
+	err = gh.ensureDocs(gh.docs)
 	if err != nil {
 		return err
 	}
@@ -121,51 +142,103 @@ func (gh *Generic) PutPoliciesFromDir(path string) error {
 	return gh.removeUndeclaredDocuments(path)
 }
 
-// Ensure the document is present and consistent
-func (gh *Generic) ensureDoc(doc vaultDocument) error {
+// Ensure the documents are present and consistent, with up to config.Workers requests to Vault at
+// once. The outcomes are recorded in the order of docs, so that they do not depend on timing.
+func (gh *Generic) ensureDocs(docs []vaultDocument) error {
+	changes := make([]*plan.Change, len(docs))
+	results := make([]report.Action, len(docs))
+	err := forEach(gh.config.Workers, len(docs), func(i int) (err error) {
+		changes[i], results[i], err = gh.planDoc(docs[i])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var writes []vaultDocument
+	for i, doc := range docs {
+		if changes[i] == nil {
+			gh.recordResult(doc.path, results[i], doc.sourceFile)
+			if results[i] == report.Unchanged {
+				gh.appliedDocMap[doc.path] = true
+			}
+		} else if gh.recordChange(*changes[i]) {
+			writes = append(writes, doc)
+		}
+	}
+
+	return forEach(gh.config.Workers, len(writes), func(i int) error {
+		gh.log.WithFields(log.Fields{
+			"path":       writes[i].path,
+			"sourceFile": writes[i].sourceFile,
+		}).Info("Applying document")
+		err := putDocument(gh.client, gh.kv, writes[i].path, writes[i].data)
+		if err != nil {
+			return err
+		}
+		gh.mutex.Lock()
+		gh.appliedDocMap[writes[i].path] = true
+		gh.mutex.Unlock()
+		return nil
+	})
+}
+
+// Compare the document with the one in Vault, and return the change which applies it, or if none
+// is needed, the result to report for it
+func (gh *Generic) planDoc(doc vaultDocument) (*plan.Change, report.Action, error) {
 	logger := gh.log.WithFields(log.Fields{
 		"path":       doc.path,
 		"sourceFile": doc.sourceFile,
 	})
+	gh.mutex.Lock()
 	gh.configuredDocMap[doc.path] = doc
+	gh.mutex.Unlock()
 
-	if applied, err := gh.isDocApplied(doc); err != nil {
+	liveData, err := gh.readDoc(doc.path)
+	if err != nil {
 		if strings.Contains(err.Error(), "permission denied") {
 			// Continue with a warning on 403. The user might not have permission to read all
 			// documents, and in this case we want to continue updating others, without attempting
 			// to write this particular one.
 			logger.Warnf("Skipping path: %s", err.Error())
-			return nil
+			return nil, report.SkippedPermissionDenied, nil
 		}
-		return fmt.Errorf("could not determine if %q is applied: %s", doc.path, err)
-	} else if applied {
+		return nil, "", fmt.Errorf("could not determine if %q is applied: %s", doc.path, err)
+	}
+	if liveData != nil && gh.areKeysApplied(doc.data, liveData) {
 		logger.Debugf("Document already applied")
-		return nil
+		return nil, report.Unchanged, nil
 	}
 
-	logger.Infof("Applying document")
-	_, err := gh.client.Write(doc.path, doc.data)
-	return err
+	change := plan.Change{
+		Path:       doc.path,
+		Action:     plan.Create,
+		SourceFile: doc.sourceFile,
+		After:      doc.data,
+		Diff:       documentListing(diffAdded, doc.data),
+	}
+	if liveData != nil {
+		change.Action = plan.Update
+		change.Before = liveData
+		change.Diff = documentDiff(doc.data, liveData)
+	}
+	return &change, "", nil
 }
 
-// true if the document is on the server and matches the one configured
-func (gh *Generic) isDocApplied(doc vaultDocument) (bool, error) {
-	secret, err := gh.client.Read(doc.path)
+// Return the data of the document at path on the server, or nil if it is not present
+func (gh *Generic) readDoc(path string) (map[string]interface{}, error) {
+	data, err := readDocument(gh.client, gh.kv, path)
 	if err != nil {
 		if strings.Contains(err.Error(), "Code: 403") {
 			gh.log.Debug(err.Error())
-			return false, errors.New("permission denied (code 403)")
+			return nil, errors.New("permission denied (code 403)")
 		}
 		gh.log.Errorf("error on client.Read: %s: %v, please raise a "+
-			"bug as this should be handled cleanly!", doc.path, err)
-		return false, nil
+			"bug as this should be handled cleanly!", path, err)
+		return nil, nil
 	}
 
-	if secret == nil || secret.Data == nil {
-		return false, nil
-	}
-
-	return gh.areKeysApplied(doc.data, secret.Data), nil
+	return data, nil
 }
 
 // Ensure all key/value pairs in mapA are present and consistent in mapB
@@ -175,20 +248,16 @@ func (gh *Generic) areKeysApplied(mapA map[string]interface{}, mapB map[string]i
 		if _, ok := mapB[key]; !ok {
 			return false // not present at all
 		}
-		if reflect.DeepEqual(mapA[key], mapB[key]) {
-			continue // value the same, skip further checks for this key
-		}
-
-		// this is a bit more complicated, thanks to ttls and bundling into arrays :(
-		if strings.Contains(key, "ttl") {
-			// check if the ttls are equivalent
-			if isTtlEquivalent(mapA[key], mapB[key]) {
+		if key == kvMetadataKey {
+			// Vault returns all metadata settings, so only compare those configured
+			configured, okA := mapA[key].(map[string]interface{})
+			live, okB := mapB[key].(map[string]interface{})
+			if okA && okB && gh.areKeysApplied(configured, live) {
 				continue
 			}
+			return false
 		}
-		// covers cases such as "policy" == ["policy]
-		// logic is a bit scary, see function documentation
-		if isSliceEquivalent(mapA[key], mapB[key]) {
+		if isValueEquivalent(key, mapA[key], mapB[key]) {
 			continue
 		}
 		gh.log.Debugf("Field %q not equal; %+v (type %T) != %+v (type %T)", key, mapA[key], mapA[key], mapB[key], mapB[key])
@@ -213,7 +282,7 @@ func (gh *Generic) removalWalk(path string, f os.FileInfo, err error) error {
 		return err
 	}
 
-	secret, err := gh.client.List(apiPath)
+	secret, err := listDocuments(gh.client, gh.kv, apiPath)
 	if err != nil {
 		return err
 	}
@@ -233,23 +302,67 @@ func (gh *Generic) removalWalk(path string, f os.FileInfo, err error) error {
 		return fmt.Errorf("could not cask keys value '%+v' as an array", v)
 	}
 
+	var undeclared []string
 	for k := range keys {
+		if strings.HasSuffix(keys[k].(string), "/") {
+			// a sub-directory, which is handled when the walk reaches it (if it is declared)
+			continue
+		}
 		docPath := strings.Join([]string{apiPath, keys[k].(string)}, "/")
 		if _, ok := gh.configuredDocMap[docPath]; ok {
 			// configured, leave it alone
 			continue
 		}
-		logger := gh.log.WithFields(log.Fields{"docPath": docPath})
+		if !gh.mayRemove(docPath) {
+			gh.log.WithFields(log.Fields{"docPath": docPath}).Debug(
+				"Not removing document, as vaultsmith did not write it")
+			continue
+		}
+		undeclared = append(undeclared, docPath)
+	}
+
+	return gh.removeDocs(undeclared)
+}
 
-		logger.Info("Removing document")
-		_, err := gh.client.Delete(docPath)
+// Delete the documents at paths, with up to config.Workers requests to Vault at once
+func (gh *Generic) removeDocs(paths []string) error {
+	liveData := make([]map[string]interface{}, len(paths))
+	err := forEach(gh.config.Workers, len(paths), func(i int) (err error) {
+		// the current value is only for reporting, so failing to read it is not fatal
+		liveData[i], err = gh.readDoc(paths[i])
 		if err != nil {
-			return err
+			gh.log.WithFields(log.Fields{"docPath": paths[i]}).Debugf(
+				"Could not read document before removal: %s", err)
 		}
-		gh.removedDocMap[docPath] = true
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil
+	var deletes []string
+	for i, docPath := range paths {
+		if gh.recordChange(plan.Change{
+			Path:   docPath,
+			Action: plan.Delete,
+			Before: liveData[i],
+			Diff:   documentListing(diffRemoved, liveData[i]),
+		}) {
+			deletes = append(deletes, docPath)
+		}
+	}
+
+	return forEach(gh.config.Workers, len(deletes), func(i int) error {
+		gh.log.WithFields(log.Fields{"docPath": deletes[i]}).Info("Removing document")
+		err := deleteDocument(gh.client, gh.kv, deletes[i])
+		if err != nil {
+			return err
+		}
+		gh.mutex.Lock()
+		gh.removedDocMap[deletes[i]] = true
+		gh.mutex.Unlock()
+		return nil
+	})
 }
 
 func (gh *Generic) Order() int {
@@ -437,6 +550,9 @@ func convertToDuration(x interface{}) (time.Duration, error) {
 		duration = time.Duration(x.(int64)) * time.Second
 	case int:
 		duration = time.Duration(int64(x.(int))) * time.Second
+	case float64:
+		// numbers parsed from json documents
+		duration = time.Duration(x.(float64)) * time.Second
 	case json.Number:
 		i, err := x.(json.Number).Int64()
 		if err != nil {
@@ -2,67 +2,18 @@ package path_handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	vaultApi "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
 	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
-func TestGeneric_isDocApplied_true(t *testing.T) {
-	testData := make(map[string]interface{})
-	testData["testKey"] = "testValue"
-	testDoc := vaultDocument{path: "test/path", data: testData}
-
-	returnSecret := vaultApi.Secret{
-		Data: testData,
-	}
-	client := &vault.MockClient{
-		ReturnSecret: &returnSecret,
-	}
-
-	gh, err := NewGeneric(client, PathHandlerConfig{})
-	if err != nil {
-		log.Fatal("Failed to create generic handler")
-	}
-
-	result, err := gh.isDocApplied(testDoc)
-	if err != nil {
-		t.Errorf("Error calling isDocApplied: %s", err)
-	}
-	if !result {
-		t.Errorf("Got false result, expected true")
-	}
-}
-
-func TestGeneric_isDocApplied_falseValue(t *testing.T) {
-	testDataA := make(map[string]interface{})
-	testDataB := make(map[string]interface{})
-
-	testDataA["testKey"] = "testValue"
-	testDoc := vaultDocument{path: "test/path", data: testDataA}
-
-	testDataB["testKey"] = "otherValue"
-	returnSecret := vaultApi.Secret{
-		Data: testDataB,
-	}
-	client := &vault.MockClient{
-		ReturnSecret: &returnSecret,
-	}
-
-	gh, err := NewGeneric(client, PathHandlerConfig{})
-	if err != nil {
-		log.Fatal("Failed to create generic handler")
-	}
-
-	result, err := gh.isDocApplied(testDoc)
-	if err != nil {
-		t.Errorf("Error calling isDocApplied: %s", err)
-	}
-	if result {
-		t.Errorf("Got true result, expected false")
-	}
-}
-
 func TestGeneric_areKeysApplied_true(t *testing.T) {
 	client := &vault.MockClient{}
 
@@ -109,6 +60,84 @@ func TestGeneric_areKeysApplied_false(t *testing.T) {
 
 }
 
+// Numbers are float64 in json documents and int in yaml ones, but json.Number when read from Vault
+func TestGeneric_areKeysApplied_numbers(t *testing.T) {
+	gh, err := NewGeneric(&vault.MockClient{}, PathHandlerConfig{})
+	if err != nil {
+		t.Fatal("Failed to create generic handler")
+	}
+
+	tests := []struct {
+		configured interface{}
+		live       interface{}
+		expected   bool
+	}{
+		{float64(10), json.Number("10"), true},
+		{10, json.Number("10"), true},
+		{float64(0.5), json.Number("0.5"), true},
+		{float64(10), json.Number("11"), false},
+		{10, json.Number("11"), false},
+		{true, json.Number("1"), false},
+		{"10", json.Number("10"), false},
+	}
+	for _, test := range tests {
+		configured := map[string]interface{}{"token_num_uses": test.configured}
+		live := map[string]interface{}{"token_num_uses": test.live}
+		if gh.areKeysApplied(configured, live) != test.expected {
+			t.Errorf("%#v applied as %#v: expected %t", test.configured, test.live, test.expected)
+		}
+	}
+}
+
+// Documents with numbers should only be changed if the numbers differ
+func TestGeneric_PutPoliciesFromDir_numbers(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	roleDir := filepath.Join(dir, "auth", "approle", "role")
+	err = os.MkdirAll(roleDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := map[string]string{
+		"same.json":    `{"token_num_uses": 10, "token_ttl": 3600}`,
+		"yaml.yaml":    "token_num_uses: 5\n",
+		"changed.json": `{"token_num_uses": 10}`,
+	}
+	for file, content := range docs {
+		err = ioutil.WriteFile(filepath.Join(roleDir, file), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := &docClient{docs: map[string]map[string]interface{}{
+		"auth/approle/role/same": {
+			"token_num_uses": json.Number("10"),
+			"token_ttl":      json.Number("3600"),
+		},
+		"auth/approle/role/yaml":    {"token_num_uses": json.Number("5")},
+		"auth/approle/role/changed": {"token_num_uses": json.Number("11")},
+	}}
+
+	changes := plan.NewChangeSet()
+	gh, _ := NewGeneric(client, PathHandlerConfig{DocumentPath: dir, Changes: changes})
+	err = gh.PutPoliciesFromDir(roleDir)
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+
+	var paths []string
+	for _, change := range changes.Changes {
+		paths = append(paths, change.Path)
+	}
+	expected := []string{"auth/approle/role/changed"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected changes to %v, got %v", expected, paths)
+	}
+}
+
 func TestConvertAuthConfig(t *testing.T) {
 	in := vaultApi.AuthConfigInput{}
 	_, err := ConvertAuthConfig(in)
@@ -223,3 +252,52 @@ func TestIsSliceEquivalent(t *testing.T) {
 		})
 	}
 }
+
+// Documents handled by several workers are recorded in the order they were found
+func TestGeneric_PutPoliciesFromDir_workers(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "secret"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &docClient{docs: map[string]map[string]interface{}{
+		"secret/doc-03":     {"key": "3"},
+		"secret/doc-05":     {"key": "old"},
+		"secret/undeclared": {"key": "x"},
+	}}
+	var expected []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("doc-%02d", i)
+		err = ioutil.WriteFile(filepath.Join(dir, "secret", name+".json"),
+			[]byte(fmt.Sprintf(`{"key": "%d"}`, i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 3 {
+			expected = append(expected, "secret/"+name)
+		}
+	}
+	expected = append(expected, "secret/undeclared")
+
+	changes := plan.NewChangeSet()
+	gh, _ := NewGeneric(client, PathHandlerConfig{DocumentPath: dir, Changes: changes, Workers: 8})
+	err = gh.PutPoliciesFromDir(filepath.Join(dir, "secret"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+
+	var paths []string
+	for _, change := range changes.Changes {
+		paths = append(paths, change.Path)
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected changes in order %v, got %v", expected, paths)
+	}
+	if len(client.docs) != 30 || client.docs["secret/doc-05"]["key"] != "5" {
+		t.Errorf("Expected all documents to be written, got %+v", client.docs)
+	}
+}
@@ -0,0 +1,663 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/vault"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Identity handles entities, groups and group aliases of the identity secret engine. Vault
+	addresses these by IDs it generates, so they are declared by name instead:
+
+		identity/entity/<name>               an identityEntity
+		identity/group/<name>                an identityGroup
+		identity/group-alias/<mount>/<name>  an identityGroupAlias for the auth mount at <mount>
+
+	Names are resolved to IDs when writing, so group members and the groups of aliases are also
+	declared by name, and the auth mount of an alias by its path rather than its accessor.
+
+	Groups and group aliases which are not declared are deleted, provided their directory is
+	present. Entities are never deleted, as Vault creates them itself when clients log in.
+*/
+type Identity struct {
+	BaseHandler
+	entities     []identityDocument
+	groups       []identityDocument
+	groupAliases []identityDocument
+	kinds        map[string]bool // kinds of identity whose directory is present
+}
+
+// Kinds of identity, as they appear in paths of the identity secret engine
+const (
+	entityKind     = "entity"
+	groupKind      = "group"
+	groupAliasKind = "group-alias"
+)
+
+// An entity, as declared in identity/entity/<name>
+type identityEntity struct {
+	Policies []string          `json:"policies"`
+	Metadata map[string]string `json:"metadata"`
+	Disabled bool              `json:"disabled"`
+}
+
+// A group, as declared in identity/group/<name>
+type identityGroup struct {
+	Type           string            `json:"type"` // internal (the default) or external
+	Policies       []string          `json:"policies"`
+	Metadata       map[string]string `json:"metadata"`
+	MemberEntities []string          `json:"member_entities"` // names of entities
+	MemberGroups   []string          `json:"member_groups"`   // names of groups
+}
+
+// A group alias, as declared in identity/group-alias/<mount>/<name>. It makes members of the group
+// <name> in the auth method at <mount> (e.g. an LDAP group) members of an external group.
+type identityGroupAlias struct {
+	Group string `json:"group"` // name of the external group
+}
+
+// A declared identity and where it was declared
+type identityDocument struct {
+	path       string // e.g. identity/group/admins
+	kind       string
+	mount      string // auth mount of a group alias, e.g. ldap/
+	name       string
+	value      interface{} // *identityEntity, *identityGroup or *identityGroupAlias
+	sourceFile string
+}
+
+// Identities declared in this run, which may not exist yet in a dry run. A name which cannot be
+// resolved is left out with a warning if it is pending, and is an error otherwise.
+type pendingIdentities struct {
+	entities map[string]bool
+	groups   map[string]bool
+	mounts   map[string]bool
+}
+
+func NewIdentityHandler(client vault.Vault, config PathHandlerConfig) (*Identity, error) {
+	return &Identity{
+		BaseHandler: BaseHandler{
+			name:   "Identity",
+			client: client,
+			config: config,
+			order:  config.Order,
+			log: log.WithFields(log.Fields{
+				"handler": "Identity",
+			}),
+		},
+		kinds: map[string]bool{},
+	}, nil
+}
+
+func (ih *Identity) walkFile(path string, f os.FileInfo, err error) error {
+	if f == nil {
+		logger := ih.log.WithFields(log.Fields{"path": path, "error": err})
+		logger.Debug("Path does not exist, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	identityPath, err := apiPath(ih.config.DocumentPath, path)
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		// record which kinds are declared, so that undeclared ones are not deleted
+		ih.kinds[strings.TrimPrefix(identityPath, "identity/")] = true
+		return nil
+	}
+
+	kind, mount, name, err := parseIdentityPath(identityPath)
+	if err != nil {
+		return err
+	}
+
+	fileContents, err := ih.readFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc := identityDocument{
+		path:       identityPath,
+		kind:       kind,
+		mount:      mount,
+		name:       name,
+		sourceFile: f.Name(),
+	}
+	switch kind {
+	case entityKind:
+		var entity identityEntity
+		err = document.Decode(f.Name(), fileContents, &entity)
+		doc.value = entity.normalise()
+		ih.entities = append(ih.entities, doc)
+	case groupKind:
+		var group identityGroup
+		err = document.Decode(f.Name(), fileContents, &group)
+		doc.value = group.normalise()
+		ih.groups = append(ih.groups, doc)
+	case groupAliasKind:
+		var alias identityGroupAlias
+		err = document.Decode(f.Name(), fileContents, &alias)
+		doc.value = &alias
+		ih.groupAliases = append(ih.groupAliases, doc)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse document from file %s: %s", path, err)
+	}
+	return nil
+}
+
+// All documents are read before any are applied, as groups refer to entities and other groups,
+// and aliases to groups
+func (ih *Identity) PutPoliciesFromDir(path string) error {
+	err := filepath.Walk(path, ih.walkFile)
+	if err != nil {
+		return err
+	}
+
+	pending := pendingIdentities{
+		entities: map[string]bool{},
+		groups:   map[string]bool{},
+		mounts:   declaredAuthMounts(ih.config.DocumentPath),
+	}
+	for _, doc := range ih.entities {
+		pending.entities[doc.name] = true
+	}
+	for _, doc := range ih.groups {
+		pending.groups[doc.name] = true
+	}
+
+	// identities created by this run are not yet members of live groups, nor groups of live
+	// aliases, so they need not be listed again after they are written
+	listing := newIdentityListing(ih.client)
+	for _, docs := range [][]identityDocument{ih.entities, ih.groups, ih.groupAliases} {
+		for _, doc := range docs {
+			err = ih.ensureIdentity(doc, listing, pending)
+			if err != nil {
+				return fmt.Errorf("error while ensuring %s: %s", doc.path, err)
+			}
+		}
+	}
+	return ih.DeleteUndeclared()
+}
+
+// Ensure that this identity exists and matches its declaration
+func (ih *Identity) ensureIdentity(doc identityDocument, listing *identityListing, pending pendingIdentities) error {
+	logger := ih.log.WithFields(log.Fields{"path": doc.path})
+
+	live, err := readIdentity(ih.client, listing, doc.kind, doc.mount, doc.name)
+	if err != nil {
+		return err
+	}
+
+	change := plan.Change{
+		Path:       doc.path,
+		Action:     plan.Create,
+		SourceFile: doc.sourceFile,
+		After:      doc.value,
+		Diff:       documentListing(diffAdded, structFields(doc.value)),
+	}
+	if live != nil {
+		diff := documentDiff(structFields(doc.value), structFields(live))
+		if len(diff) == 0 {
+			logger.Debug("Identity already applied")
+			ih.recordResult(doc.path, report.Unchanged, doc.sourceFile)
+			return nil
+		}
+		change.Action = plan.Update
+		change.Before = live
+		change.Diff = diff
+	}
+	if !ih.recordChange(change) {
+		return nil
+	}
+
+	logger.Infof("Writing %s", doc.kind)
+	return writeIdentity(ih.client, listing, doc.kind, doc.mount, doc.name, doc.value, pending)
+}
+
+// Delete the group aliases and groups which are not declared, if their directory is present.
+// Aliases are deleted first, as deleting a group deletes its aliases too.
+func (ih *Identity) DeleteUndeclared() error {
+	declared := map[string]bool{}
+	for _, docs := range [][]identityDocument{ih.groups, ih.groupAliases} {
+		for _, doc := range docs {
+			declared[doc.path] = true
+		}
+	}
+
+	listing := newIdentityListing(ih.client)
+	var livePaths []string
+	if ih.kinds[groupAliasKind] {
+		aliases, err := listing.groupAliases()
+		if err != nil {
+			return err
+		}
+		livePaths = sortedNames(aliases)
+	}
+	if ih.kinds[groupKind] {
+		groupNames, err := listing.identityNames(groupKind)
+		if err != nil {
+			return err
+		}
+		groupPaths := map[string]bool{}
+		for _, name := range groupNames {
+			groupPaths[identityPath(groupKind, "", name)] = true
+		}
+		livePaths = append(livePaths, sortedNames(groupPaths)...)
+	}
+
+	for _, p := range livePaths {
+		if declared[p] {
+			continue // present, do nothing
+		}
+		kind, mount, name, err := parseIdentityPath(p)
+		if err != nil {
+			return err
+		}
+		live, err := readIdentity(ih.client, listing, kind, mount, name)
+		if err != nil {
+			return err
+		}
+
+		if !ih.recordChange(plan.Change{
+			Path:   p,
+			Action: plan.Delete,
+			Before: live,
+		}) {
+			continue
+		}
+		ih.log.WithField("path", p).Infof("Deleting %s", kind)
+		err = deleteIdentity(ih.client, listing, kind, mount, name)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+func (e identityEntity) normalise() *identityEntity {
+	e.Policies = sortedUnique(e.Policies)
+	if len(e.Metadata) == 0 {
+		e.Metadata = nil
+	}
+	return &e
+}
+
+func (g identityGroup) normalise() *identityGroup {
+	if g.Type == "" {
+		g.Type = "internal"
+	}
+	g.Policies = sortedUnique(g.Policies)
+	g.MemberEntities = sortedUnique(g.MemberEntities)
+	g.MemberGroups = sortedUnique(g.MemberGroups)
+	if len(g.Metadata) == 0 {
+		g.Metadata = nil
+	}
+	return &g
+}
+
+// Return an empty declaration for a kind of identity
+func newIdentityValue(kind string) interface{} {
+	switch kind {
+	case entityKind:
+		return &identityEntity{}
+	case groupKind:
+		return &identityGroup{}
+	default:
+		return &identityGroupAlias{}
+	}
+}
+
+// Return the path for an identity, as used for changes
+func identityPath(kind string, mount string, name string) string {
+	return "identity/" + kind + "/" + mount + name
+}
+
+// Split the path of an identity document, e.g. identity/group-alias/ldap/admins
+func parseIdentityPath(path string) (kind string, mount string, name string, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, "identity/"), "/")
+	kind = parts[0]
+	switch {
+	case (kind == entityKind || kind == groupKind) && len(parts) == 2:
+		return kind, "", parts[1], nil
+	case kind == groupAliasKind && len(parts) >= 3:
+		mount = strings.Join(parts[1:len(parts)-1], "/") + "/"
+		return kind, mount, parts[len(parts)-1], nil
+	default:
+		return "", "", "", fmt.Errorf("unsupported identity path %s, expected identity/entity/<name>, "+
+			"identity/group/<name> or identity/group-alias/<mount>/<name>", path)
+	}
+}
+
+// Return the auth mounts declared in docPath, which may not be enabled yet in a dry run
+func declaredAuthMounts(docPath string) map[string]bool {
+	mounts := map[string]bool{}
+	filepath.Walk(filepath.Join(docPath, "sys", "auth"), func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return nil
+		}
+		if p, err := apiPath(docPath, path); err == nil {
+			mounts[strings.TrimPrefix(p, "sys/auth/")+"/"] = true
+		}
+		return nil
+	})
+	return mounts
+}
+
+/*
+	Reading and writing identities by name. These are also used to apply changes from a plan, so
+	they take the client rather than being methods of the handler.
+*/
+
+// The listings of identities and auth mounts in Vault, fetched when first needed and then kept, so
+// that reading many identities does not list them all again for each one
+type identityListing struct {
+	client     vault.Vault
+	names      map[string]map[string]string // names of identities by ID, by kind
+	aliases    map[string]liveGroupAlias
+	authMounts map[string]*vaultApi.AuthMount
+}
+
+func newIdentityListing(client vault.Vault) *identityListing {
+	return &identityListing{
+		client: client,
+		names:  map[string]map[string]string{},
+	}
+}
+
+// Return the live identity in its declared form, or nil if it does not exist
+func readIdentity(client vault.Vault, listing *identityListing, kind string, mount string, name string) (interface{}, error) {
+	switch kind {
+	case entityKind:
+		secret, err := client.Read("identity/entity/name/" + name)
+		if err != nil || secret == nil || secret.Data == nil {
+			return nil, err
+		}
+		var entity identityEntity
+		err = convertType(secret.Data, &entity)
+		if err != nil {
+			return nil, fmt.Errorf("could not read entity %s: %s", name, err)
+		}
+		return entity.normalise(), nil
+	case groupKind:
+		secret, err := client.Read("identity/group/name/" + name)
+		if err != nil || secret == nil || secret.Data == nil {
+			return nil, err
+		}
+		var live struct {
+			identityGroup
+			MemberEntityIDs []string `json:"member_entity_ids"`
+			MemberGroupIDs  []string `json:"member_group_ids"`
+		}
+		err = convertType(secret.Data, &live)
+		if err != nil {
+			return nil, fmt.Errorf("could not read group %s: %s", name, err)
+		}
+		group := live.identityGroup
+		group.MemberEntities, err = namesOf(listing, entityKind, live.MemberEntityIDs)
+		if err != nil {
+			return nil, err
+		}
+		group.MemberGroups, err = namesOf(listing, groupKind, live.MemberGroupIDs)
+		if err != nil {
+			return nil, err
+		}
+		return group.normalise(), nil
+	case groupAliasKind:
+		aliases, err := listing.groupAliases()
+		if err != nil {
+			return nil, err
+		}
+		alias, ok := aliases[identityPath(kind, mount, name)]
+		if !ok {
+			return nil, nil
+		}
+		groupNames, err := listing.identityNames(groupKind)
+		if err != nil {
+			return nil, err
+		}
+		group, ok := groupNames[alias.canonicalID]
+		if !ok {
+			group = alias.canonicalID
+		}
+		return &identityGroupAlias{Group: group}, nil
+	default:
+		return nil, fmt.Errorf("unknown identity kind %s", kind)
+	}
+}
+
+// Create or update an identity, resolving the names in it to IDs
+func writeIdentity(client vault.Vault, listing *identityListing, kind string, mount string, name string, value interface{}, pending pendingIdentities) error {
+	logger := log.WithFields(log.Fields{"path": identityPath(kind, mount, name)})
+	switch v := value.(type) {
+	case *identityEntity:
+		_, err := client.Write("identity/entity/name/"+name, map[string]interface{}{
+			"policies": v.Policies,
+			"metadata": v.Metadata,
+			"disabled": v.Disabled,
+		})
+		return err
+	case *identityGroup:
+		data := map[string]interface{}{
+			"type":     v.Type,
+			"policies": v.Policies,
+			"metadata": v.Metadata,
+		}
+		// Vault refuses members for external groups, whose members come from their aliases
+		if v.Type != "external" {
+			entityIDs, err := resolveIDs(client, entityKind, v.MemberEntities, pending.entities, logger)
+			if err != nil {
+				return err
+			}
+			groupIDs, err := resolveIDs(client, groupKind, v.MemberGroups, pending.groups, logger)
+			if err != nil {
+				return err
+			}
+			data["member_entity_ids"] = entityIDs
+			data["member_group_ids"] = groupIDs
+		}
+		_, err := client.Write("identity/group/name/"+name, data)
+		return err
+	case *identityGroupAlias:
+		accessor, err := mountAccessor(listing, mount)
+		if err != nil {
+			return err
+		}
+		groupIDs, err := resolveIDs(client, groupKind, []string{v.Group}, pending.groups, logger)
+		if err != nil {
+			return err
+		}
+		if accessor == "" || len(groupIDs) == 0 {
+			if accessor == "" && !pending.mounts[mount] {
+				return fmt.Errorf("auth mount %s is not enabled", mount)
+			}
+			logger.Warn("Not writing group alias, as its auth mount or group has not been created yet")
+			return nil
+		}
+		data := map[string]interface{}{
+			"name":           name,
+			"mount_accessor": accessor,
+			"canonical_id":   groupIDs[0],
+		}
+
+		aliases, err := listing.groupAliases()
+		if err != nil {
+			return err
+		}
+		if live, ok := aliases[identityPath(groupAliasKind, mount, name)]; ok {
+			_, err = client.Write("identity/group-alias/id/"+live.id, data)
+		} else {
+			_, err = client.Write("identity/group-alias", data)
+		}
+		return err
+	default:
+		return fmt.Errorf("unexpected identity type %T", value)
+	}
+}
+
+// Delete an identity by name
+func deleteIdentity(client vault.Vault, listing *identityListing, kind string, mount string, name string) error {
+	var err error
+	switch kind {
+	case entityKind:
+		_, err = client.Delete("identity/entity/name/" + name)
+	case groupKind:
+		_, err = client.Delete("identity/group/name/" + name)
+	case groupAliasKind:
+		aliases, listErr := listing.groupAliases()
+		if listErr != nil {
+			return listErr
+		}
+		if live, ok := aliases[identityPath(kind, mount, name)]; ok {
+			_, err = client.Delete("identity/group-alias/id/" + live.id)
+		}
+	default:
+		err = fmt.Errorf("unknown identity kind %s", kind)
+	}
+	return err
+}
+
+// Return the names of identities of a kind, by ID
+func (l *identityListing) identityNames(kind string) (map[string]string, error) {
+	if names, ok := l.names[kind]; ok {
+		return names, nil
+	}
+	names := map[string]string{}
+	secret, err := l.client.List("identity/" + kind + "/id")
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		keyInfo, _ := secret.Data["key_info"].(map[string]interface{})
+		for id, info := range keyInfo {
+			if i, ok := info.(map[string]interface{}); ok {
+				names[id] = fmt.Sprintf("%v", i["name"])
+			}
+		}
+	}
+	l.names[kind] = names
+	return names, nil
+}
+
+// Return the enabled auth mounts by path
+func (l *identityListing) listAuth() (map[string]*vaultApi.AuthMount, error) {
+	if l.authMounts == nil {
+		authMounts, err := l.client.ListAuth()
+		if err != nil {
+			return nil, err
+		}
+		l.authMounts = authMounts
+	}
+	return l.authMounts, nil
+}
+
+// Convert IDs of identities to names. IDs without a name are kept, so that they are still shown
+// as differences.
+func namesOf(listing *identityListing, kind string, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	names, err := listing.identityNames(kind)
+	if err != nil {
+		return nil, err
+	}
+	var resolved []string
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			resolved = append(resolved, name)
+		} else {
+			resolved = append(resolved, id)
+		}
+	}
+	return resolved, nil
+}
+
+// Convert names of identities to IDs. Pending names which do not exist yet are left out.
+func resolveIDs(client vault.Vault, kind string, names []string, pending map[string]bool, logger *log.Entry) ([]string, error) {
+	ids := []string{}
+	for _, name := range names {
+		secret, err := client.Read("identity/" + kind + "/name/" + name)
+		if err != nil {
+			return nil, err
+		}
+		if secret != nil && secret.Data != nil && secret.Data["id"] != nil {
+			ids = append(ids, fmt.Sprintf("%v", secret.Data["id"]))
+			continue
+		}
+		if !pending[name] {
+			return nil, fmt.Errorf("%s %s does not exist and is not declared", kind, name)
+		}
+		logger.Warnf("Leaving out %s %s, as it has not been created yet", kind, name)
+	}
+	return ids, nil
+}
+
+// Return the accessor of the auth mount at path, or an empty string if it is not enabled
+func mountAccessor(listing *identityListing, path string) (string, error) {
+	authMounts, err := listing.listAuth()
+	if err != nil {
+		return "", err
+	}
+	if authMount, ok := authMounts[path]; ok {
+		return authMount.Accessor, nil
+	}
+	return "", nil
+}
+
+// A group alias as listed by Vault
+type liveGroupAlias struct {
+	id          string
+	canonicalID string
+}
+
+// Return the group aliases in Vault by their identity path, e.g. identity/group-alias/ldap/admins.
+// Aliases for auth mounts which are not enabled cannot be declared, so are left out.
+func (l *identityListing) groupAliases() (map[string]liveGroupAlias, error) {
+	if l.aliases != nil {
+		return l.aliases, nil
+	}
+	aliases := map[string]liveGroupAlias{}
+	secret, err := l.client.List("identity/group-alias/id")
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		l.aliases = aliases
+		return aliases, nil
+	}
+	authMounts, err := l.listAuth()
+	if err != nil {
+		return nil, err
+	}
+	mountPaths := map[string]string{}
+	for path, authMount := range authMounts {
+		mountPaths[authMount.Accessor] = path
+	}
+
+	keyInfo, _ := secret.Data["key_info"].(map[string]interface{})
+	for id, info := range keyInfo {
+		i, ok := info.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mount, ok := mountPaths[fmt.Sprintf("%v", i["mount_accessor"])]
+		if !ok {
+			continue
+		}
+		path := identityPath(groupAliasKind, mount, fmt.Sprintf("%v", i["name"]))
+		aliases[path] = liveGroupAlias{id: id, canonicalID: fmt.Sprintf("%v", i["canonical_id"])}
+	}
+	l.aliases = aliases
+	return aliases, nil
+}
@@ -0,0 +1,211 @@
+package path_handlers
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keeps entities and groups in memory, by name, as the identity secret engine would. IDs are the
+// kind followed by the name, e.g. group-admins.
+type identityClient struct {
+	vault.MockClient
+	identities map[string]map[string]interface{} // by path, e.g. identity/group/name/admins
+	writes     []string
+	deletes    []string
+	lists      []string
+}
+
+func newIdentityClient() *identityClient {
+	return &identityClient{identities: map[string]map[string]interface{}{}}
+}
+
+func (c *identityClient) Read(path string) (*vaultApi.Secret, error) {
+	if data, ok := c.identities[path]; ok {
+		return &vaultApi.Secret{Data: data}, nil
+	}
+	return nil, nil
+}
+
+func (c *identityClient) Write(path string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	c.writes = append(c.writes, path)
+	parts := strings.Split(path, "/")
+	data["id"] = parts[1] + "-" + parts[3]
+	data["name"] = parts[3]
+	c.identities[path] = data
+	return nil, nil
+}
+
+func (c *identityClient) Delete(path string) (*vaultApi.Secret, error) {
+	c.deletes = append(c.deletes, path)
+	delete(c.identities, path)
+	return nil, nil
+}
+
+func (c *identityClient) List(path string) (*vaultApi.Secret, error) {
+	c.lists = append(c.lists, path)
+	keyInfo := map[string]interface{}{}
+	kind := strings.Split(path, "/")[1]
+	for p, data := range c.identities {
+		if strings.HasPrefix(p, "identity/"+kind+"/name/") {
+			keyInfo[data["id"].(string)] = map[string]interface{}{"name": data["name"]}
+		}
+	}
+	return &vaultApi.Secret{Data: map[string]interface{}{"key_info": keyInfo}}, nil
+}
+
+func (c *identityClient) ListAuth() (map[string]*vaultApi.AuthMount, error) {
+	return map[string]*vaultApi.AuthMount{}, nil
+}
+
+func TestParseIdentityPath(t *testing.T) {
+	tests := []struct {
+		path              string
+		kind, mount, name string
+		expectError       bool
+	}{
+		{path: "identity/entity/alice", kind: "entity", name: "alice"},
+		{path: "identity/group/admins", kind: "group", name: "admins"},
+		{path: "identity/group-alias/ldap/corp/admins", kind: "group-alias", mount: "ldap/corp/", name: "admins"},
+		{path: "identity/group-alias/admins", expectError: true},
+		{path: "identity/entity-alias/alice", expectError: true},
+	}
+	for _, test := range tests {
+		kind, mount, name, err := parseIdentityPath(test.path)
+		if test.expectError != (err != nil) {
+			t.Errorf("%s: unexpected error result %v", test.path, err)
+			continue
+		}
+		if kind != test.kind || mount != test.mount || name != test.name {
+			t.Errorf("%s: expected %q %q %q, got %q %q %q", test.path, test.kind, test.mount,
+				test.name, kind, mount, name)
+		}
+	}
+}
+
+func TestIdentity_PutPoliciesFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	docs := map[string]string{
+		"identity/entity/alice.json": `{"policies": ["reader"]}`,
+		"identity/group/admins.json": `{"policies": ["admin"], "member_entities": ["alice"]}`,
+	}
+	for file, content := range docs {
+		p := filepath.Join(dir, file)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := newIdentityClient()
+	client.identities["identity/group/name/old"] = map[string]interface{}{"id": "group-old", "name": "old"}
+	changes := plan.NewChangeSet()
+	ih, err := NewIdentityHandler(client, PathHandlerConfig{DocumentPath: dir, Changes: changes})
+	if err != nil {
+		t.Fatalf("Failed to create Identity: %s", err)
+	}
+
+	err = ih.PutPoliciesFromDir(filepath.Join(dir, "identity"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+
+	expectedWrites := []string{"identity/entity/name/alice", "identity/group/name/admins"}
+	if !reflect.DeepEqual(client.writes, expectedWrites) {
+		t.Errorf("Expected writes %v, got %v", expectedWrites, client.writes)
+	}
+	expectedDeletes := []string{"identity/group/name/old"}
+	if !reflect.DeepEqual(client.deletes, expectedDeletes) {
+		t.Errorf("Expected deletes %v, got %v", expectedDeletes, client.deletes)
+	}
+	members := client.identities["identity/group/name/admins"]["member_entity_ids"]
+	if !reflect.DeepEqual(members, []string{"entity-alice"}) {
+		t.Errorf("Expected member entity ids [entity-alice], got %v", members)
+	}
+	if changes.Count(plan.Create) != 2 || changes.Count(plan.Delete) != 1 {
+		t.Errorf("Unexpected changes: %+v", changes.Changes)
+	}
+
+	// the same documents again should be unchanged, with members compared by name
+	client.writes = nil
+	changes = plan.NewChangeSet()
+	ih, _ = NewIdentityHandler(client, PathHandlerConfig{DocumentPath: dir, Changes: changes})
+	err = ih.PutPoliciesFromDir(filepath.Join(dir, "identity"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	if !changes.Empty() {
+		t.Errorf("Expected no changes on second run, got %+v", changes.Changes)
+	}
+}
+
+// Reading many groups should list the entities they refer to once, rather than once per group
+func TestIdentity_PutPoliciesFromDir_listsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newIdentityClient()
+	client.identities["identity/entity/name/alice"] = map[string]interface{}{
+		"id": "entity-alice", "name": "alice",
+	}
+	for _, name := range []string{"admins", "devs", "ops"} {
+		p := filepath.Join(dir, "identity", "group", name+".json")
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(`{"member_entities": ["alice"]}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.identities["identity/group/name/"+name] = map[string]interface{}{
+			"id":                "group-" + name,
+			"name":              name,
+			"type":              "internal",
+			"member_entity_ids": []string{"entity-alice"},
+		}
+	}
+
+	changes := plan.NewChangeSet()
+	ih, _ := NewIdentityHandler(client, PathHandlerConfig{DocumentPath: dir, Changes: changes})
+	err = ih.PutPoliciesFromDir(filepath.Join(dir, "identity"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	if !changes.Empty() {
+		t.Errorf("Expected no changes, got %+v", changes.Changes)
+	}
+	expectedLists := []string{"identity/entity/id", "identity/group/id"}
+	if !reflect.DeepEqual(client.lists, expectedLists) {
+		t.Errorf("Expected lists %v, got %v", expectedLists, client.lists)
+	}
+}
+
+// A member which is neither in Vault nor declared is most likely a typo
+func TestIdentity_unknownMember(t *testing.T) {
+	group := &identityGroup{Type: "internal", MemberEntities: []string{"nobody"}}
+	client := newIdentityClient()
+	err := writeIdentity(client, newIdentityListing(client), groupKind, "", "admins", group, pendingIdentities{})
+	if err == nil {
+		t.Errorf("Expected error for unknown member entity")
+	}
+
+	pending := pendingIdentities{entities: map[string]bool{"nobody": true}}
+	err = writeIdentity(client, newIdentityListing(client), groupKind, "", "admins", group, pending)
+	if err != nil {
+		t.Errorf("Expected pending member entity to be left out, got error %s", err)
+	}
+}
@@ -0,0 +1,242 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/vault"
+	"strings"
+	"sync"
+)
+
+/*
+	Support for version 2 of the KV secret engine, which keeps versions of each secret. Its data is
+	read and written under <mount>/data/, and listed and deleted under <mount>/metadata/, rather
+	than at the path of the secret as with version 1 and every other secret engine.
+
+	Documents always use the path of the secret, e.g. secret/foo, and are rewritten here. A
+	document in a KV v2 mount may also declare the metadata settings of its secret, such as
+	max_versions and cas_required, under the reserved key "_metadata".
+*/
+
+// The key of a document which holds the metadata settings of a KV v2 secret
+const kvMetadataKey = "_metadata"
+
+// Metadata of a KV v2 secret which can be declared, as opposed to that maintained by Vault
+var kvMetadataSettings = []string{"max_versions", "cas_required", "delete_version_after"}
+
+// The mounts found so far, by the directory they were looked up for (e.g. "secret/team/"), and
+// whether each is a KV v2 mount. Safe for concurrent use, as handlers read and write documents from
+// several workers.
+type kvMounts struct {
+	client      vault.Vault
+	mutex       sync.Mutex
+	dirs        map[string]kvMount
+	unsupported bool // Vault has no sys/internal/ui/mounts, so has no KV v2 mounts
+}
+
+type kvMount struct {
+	path string // e.g. "secret/"
+	v2   bool
+}
+
+func newKvMounts(client vault.Vault) *kvMounts {
+	return &kvMounts{
+		client: client,
+		dirs:   map[string]kvMount{},
+	}
+}
+
+// Return the mount containing path, and whether it is a KV v2 mount. The mount is looked up with
+// sys/internal/ui/mounts, as the Vault cli does; Vault before 0.10 does not have it, and only has
+// version 1.
+//
+// Mounts may be nested, e.g. secret/team/ in secret/, so the mount of one path does not tell which
+// mount another in it is in. Every path in the same directory is in the same mount though, so the
+// result is kept for the directory.
+func (k *kvMounts) find(path string) (mount string, v2 bool, err error) {
+	path = strings.Trim(path, "/") + "/"
+	dir := path[:strings.LastIndex(strings.TrimSuffix(path, "/"), "/")+1]
+	k.mutex.Lock()
+	cached, found := k.dirs[dir]
+	unsupported := k.unsupported
+	k.mutex.Unlock()
+	if unsupported {
+		return "", false, nil
+	}
+	if found {
+		return cached.path, cached.v2 && !isKvConfigPath(cached.path, path), nil
+	}
+
+	secret, err := k.client.Read("sys/internal/ui/mounts/" + path)
+	if err != nil && strings.Contains(err.Error(), "Code: 404") {
+		log.Debug("Vault does not support sys/internal/ui/mounts, so all KV mounts are version 1")
+		k.mutex.Lock()
+		k.unsupported = true
+		k.mutex.Unlock()
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("could not determine mount of %s: %s", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", false, nil
+	}
+	mount, _ = secret.Data["path"].(string)
+	mountType, _ := secret.Data["type"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	v2 = mountType == "kv" && options != nil && fmt.Sprintf("%v", options["version"]) == "2"
+
+	// auth mounts are given without their auth/ prefix, and path may itself be a mount, so only
+	// keep mounts which contain the whole directory
+	if dir != "" && mount != "" && strings.HasPrefix(dir, mount) {
+		k.mutex.Lock()
+		k.dirs[dir] = kvMount{path: mount, v2: v2}
+		k.mutex.Unlock()
+	}
+	return mount, v2 && !isKvConfigPath(mount, path), nil
+}
+
+// The config of a KV v2 mount, e.g. secret/config, is not a secret, so is used as it is
+func isKvConfigPath(mount string, path string) bool {
+	return path == mount+"config/"
+}
+
+// Rewrite the path of a secret in a KV v2 mount to the given sub-path, e.g. secret/foo to
+// secret/data/foo
+func kvPath(mount string, subPath string, path string) string {
+	rel := strings.TrimPrefix(strings.Trim(path, "/")+"/", mount)
+	return strings.TrimSuffix(mount+subPath+"/"+rel, "/")
+}
+
+// Return the data of the document at path, or nil if it is not present. For a KV v2 secret, its
+// declarable metadata settings are included under kvMetadataKey.
+func readDocument(client vault.Vault, mounts *kvMounts, path string) (map[string]interface{}, error) {
+	mount, v2, err := mounts.find(path)
+	if err != nil {
+		return nil, err
+	}
+	if !v2 {
+		secret, err := client.Read(path)
+		if err != nil || secret == nil {
+			return nil, err
+		}
+		return secret.Data, nil
+	}
+
+	secret, err := client.Read(kvPath(mount, "data", path))
+	if err != nil || secret == nil || secret.Data == nil {
+		return nil, err
+	}
+	// the data is nil when the latest version has been deleted
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	metadata, err := client.Read(kvPath(mount, "metadata", path))
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil && metadata.Data != nil {
+		settings := map[string]interface{}{}
+		for _, key := range kvMetadataSettings {
+			if v, ok := metadata.Data[key]; ok {
+				settings[key] = v
+			}
+		}
+		// copied so that the data read from Vault is left as it was
+		doc := map[string]interface{}{kvMetadataKey: settings}
+		for k, v := range data {
+			doc[k] = v
+		}
+		data = doc
+	}
+	return data, nil
+}
+
+// Write a document to path. For a KV v2 secret, its metadata settings are written first, and the
+// data is written with the current version as the check-and-set version, so that it can be written
+// whether or not cas_required is set.
+func putDocument(client vault.Vault, mounts *kvMounts, path string, doc map[string]interface{}) error {
+	mount, v2, err := mounts.find(path)
+	if err != nil {
+		return err
+	}
+	settings, hasSettings := doc[kvMetadataKey]
+	if !v2 {
+		if hasSettings {
+			return fmt.Errorf("%s is only supported in KV version 2 mounts", kvMetadataKey)
+		}
+		_, err = client.Write(path, doc)
+		return err
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range doc {
+		if k != kvMetadataKey {
+			data[k] = v
+		}
+	}
+
+	metadataPath := kvPath(mount, "metadata", path)
+	if hasSettings {
+		settingsMap, ok := settings.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s of %s is not an object: %+v", kvMetadataKey, path, settings)
+		}
+		_, err = client.Write(metadataPath, settingsMap)
+		if err != nil {
+			return fmt.Errorf("could not write metadata of %s: %s", path, err)
+		}
+	}
+
+	version, err := kvCurrentVersion(client, metadataPath)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"path": path, "cas": version}).Debug("Writing KV v2 secret")
+	_, err = client.Write(kvPath(mount, "data", path), map[string]interface{}{
+		"data":    data,
+		"options": map[string]interface{}{"cas": version},
+	})
+	return err
+}
+
+// Delete the document at path. A KV v2 secret is deleted along with all its versions.
+func deleteDocument(client vault.Vault, mounts *kvMounts, path string) error {
+	mount, v2, err := mounts.find(path)
+	if err != nil {
+		return err
+	}
+	if v2 {
+		path = kvPath(mount, "metadata", path)
+	}
+	_, err = client.Delete(path)
+	return err
+}
+
+// List the documents and sub-directories at path
+func listDocuments(client vault.Vault, mounts *kvMounts, path string) (*vaultApi.Secret, error) {
+	mount, v2, err := mounts.find(path)
+	if err != nil {
+		return nil, err
+	}
+	if v2 {
+		path = kvPath(mount, "metadata", path)
+	}
+	return client.List(path)
+}
+
+// Return the current version of a KV v2 secret from its metadata, or 0 if it has none
+func kvCurrentVersion(client vault.Vault, metadataPath string) (int, error) {
+	metadata, err := client.Read(metadataPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not read metadata at %s: %s", metadataPath, err)
+	}
+	if metadata == nil || metadata.Data == nil {
+		return 0, nil
+	}
+	version, _ := toFloat(metadata.Data["current_version"])
+	return int(version), nil
+}
@@ -0,0 +1,241 @@
+package path_handlers
+
+import (
+	"encoding/json"
+	"errors"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/vault"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Serves a KV v2 mount at secret/, with the data and metadata given by path
+type kvClient struct {
+	vault.MockClient
+	secrets map[string]map[string]interface{}
+	writes  map[string]map[string]interface{}
+	deletes []string
+	lists   []string
+}
+
+func newKvClient() *kvClient {
+	return &kvClient{
+		secrets: map[string]map[string]interface{}{},
+		writes:  map[string]map[string]interface{}{},
+	}
+}
+
+func (c *kvClient) Read(path string) (*vaultApi.Secret, error) {
+	if strings.HasPrefix(path, "sys/internal/ui/mounts/secret/") {
+		return &vaultApi.Secret{Data: map[string]interface{}{
+			"path":    "secret/",
+			"type":    "kv",
+			"options": map[string]interface{}{"version": "2"},
+		}}, nil
+	}
+	if data, ok := c.secrets[path]; ok {
+		return &vaultApi.Secret{Data: data}, nil
+	}
+	return nil, nil
+}
+
+func (c *kvClient) Write(path string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	c.writes[path] = data
+	return nil, nil
+}
+
+func (c *kvClient) Delete(path string) (*vaultApi.Secret, error) {
+	c.deletes = append(c.deletes, path)
+	return nil, nil
+}
+
+func (c *kvClient) List(path string) (*vaultApi.Secret, error) {
+	c.lists = append(c.lists, path)
+	return nil, nil
+}
+
+func TestKvPath(t *testing.T) {
+	tests := []struct{ path, expected string }{
+		{"secret/foo", "secret/data/foo"},
+		{"secret/foo/bar", "secret/data/foo/bar"},
+		{"secret", "secret/data"},
+	}
+	for _, test := range tests {
+		if p := kvPath("secret/", "data", test.path); p != test.expected {
+			t.Errorf("Expected %s for %s, got %s", test.expected, test.path, p)
+		}
+	}
+}
+
+// Serves a KV v1 mount at secret/team/ inside a KV v2 mount at secret/, counting mount lookups
+type nestedMountsClient struct {
+	vault.MockClient
+	lookups int
+}
+
+func (c *nestedMountsClient) Read(path string) (*vaultApi.Secret, error) {
+	c.lookups++
+	if strings.HasPrefix(path, "sys/internal/ui/mounts/secret/team/") {
+		return &vaultApi.Secret{Data: map[string]interface{}{"path": "secret/team/", "type": "kv"}}, nil
+	}
+	return &vaultApi.Secret{Data: map[string]interface{}{
+		"path":    "secret/",
+		"type":    "kv",
+		"options": map[string]interface{}{"version": "2"},
+	}}, nil
+}
+
+// A path in a mount nested in another should be found in the inner mount, whichever is found first
+func TestKvMounts_findNested(t *testing.T) {
+	client := &nestedMountsClient{}
+	mounts := newKvMounts(client)
+	tests := []struct {
+		path, mount string
+		v2          bool
+	}{
+		{"secret/foo", "secret/", true},
+		{"secret/team/foo", "secret/team/", false},
+		{"secret/bar", "secret/", true},
+		{"secret/team/bar", "secret/team/", false},
+	}
+	for _, test := range tests {
+		mount, v2, err := mounts.find(test.path)
+		if err != nil {
+			t.Fatalf("Error calling find: %s", err)
+		}
+		if mount != test.mount || v2 != test.v2 {
+			t.Errorf("Expected mount %s (v2 %t) for %s, got %s (v2 %t)", test.mount, test.v2,
+				test.path, mount, v2)
+		}
+	}
+	if client.lookups != 2 {
+		t.Errorf("Expected one lookup per directory, got %d", client.lookups)
+	}
+}
+
+// Vault before 0.10 has no sys/internal/ui/mounts, and only KV version 1
+func TestKvMounts_findUnsupported(t *testing.T) {
+	client := &vault.MockClient{ReturnError: errors.New("Error making API request.\n\n" +
+		"URL: GET /v1/sys/internal/ui/mounts/secret/foo\nCode: 404. Errors:\n\n")}
+	mounts := newKvMounts(client)
+	mount, v2, err := mounts.find("secret/foo")
+	if err != nil || mount != "" || v2 {
+		t.Errorf("Expected KV version 1, got %q (v2 %t, error %v)", mount, v2, err)
+	}
+	client.ReturnError = errors.New("unexpected lookup")
+	_, _, err = mounts.find("other/foo")
+	if err != nil {
+		t.Errorf("Expected no further lookups, got %s", err)
+	}
+}
+
+func TestReadDocument_kvV2(t *testing.T) {
+	client := newKvClient()
+	client.secrets["secret/data/foo"] = map[string]interface{}{
+		"data":     map[string]interface{}{"key": "value"},
+		"metadata": map[string]interface{}{"version": json.Number("3")},
+	}
+	client.secrets["secret/metadata/foo"] = map[string]interface{}{
+		"max_versions":    json.Number("5"),
+		"cas_required":    true,
+		"current_version": json.Number("3"),
+	}
+
+	doc, err := readDocument(client, newKvMounts(client), "secret/foo")
+	if err != nil {
+		t.Fatalf("Error calling readDocument: %s", err)
+	}
+	expected := map[string]interface{}{
+		"key": "value",
+		kvMetadataKey: map[string]interface{}{
+			"max_versions": json.Number("5"),
+			"cas_required": true,
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, doc)
+	}
+
+	// secrets whose latest version is deleted are not present
+	client.secrets["secret/data/foo"]["data"] = nil
+	doc, err = readDocument(client, newKvMounts(client), "secret/foo")
+	if err != nil || doc != nil {
+		t.Errorf("Expected no document for deleted secret, got %+v, %v", doc, err)
+	}
+}
+
+func TestPutDocument_kvV2(t *testing.T) {
+	client := newKvClient()
+	client.secrets["secret/metadata/foo"] = map[string]interface{}{"current_version": json.Number("3")}
+
+	doc := map[string]interface{}{
+		"key":         "value",
+		kvMetadataKey: map[string]interface{}{"cas_required": true},
+	}
+	err := putDocument(client, newKvMounts(client), "secret/foo", doc)
+	if err != nil {
+		t.Fatalf("Error calling putDocument: %s", err)
+	}
+
+	expectedData := map[string]interface{}{
+		"data":    map[string]interface{}{"key": "value"},
+		"options": map[string]interface{}{"cas": 3},
+	}
+	if !reflect.DeepEqual(client.writes["secret/data/foo"], expectedData) {
+		t.Errorf("Expected data write %+v, got %+v", expectedData, client.writes["secret/data/foo"])
+	}
+	expectedMetadata := map[string]interface{}{"cas_required": true}
+	if !reflect.DeepEqual(client.writes["secret/metadata/foo"], expectedMetadata) {
+		t.Errorf("Expected metadata write %+v, got %+v", expectedMetadata,
+			client.writes["secret/metadata/foo"])
+	}
+}
+
+// Metadata settings cannot be written to other secret engines
+func TestPutDocument_metadataNotKvV2(t *testing.T) {
+	doc := map[string]interface{}{kvMetadataKey: map[string]interface{}{"max_versions": 1}}
+	err := putDocument(&vault.MockClient{}, newKvMounts(&vault.MockClient{}), "auth/foo", doc)
+	if err == nil {
+		t.Errorf("Expected error writing %s outside a KV v2 mount", kvMetadataKey)
+	}
+}
+
+func TestDeleteAndListDocuments_kvV2(t *testing.T) {
+	client := newKvClient()
+	mounts := newKvMounts(client)
+
+	err := deleteDocument(client, mounts, "secret/foo")
+	if err != nil {
+		t.Fatalf("Error calling deleteDocument: %s", err)
+	}
+	if !reflect.DeepEqual(client.deletes, []string{"secret/metadata/foo"}) {
+		t.Errorf("Expected delete of secret/metadata/foo, got %v", client.deletes)
+	}
+
+	_, err = listDocuments(client, mounts, "secret")
+	if err != nil {
+		t.Fatalf("Error calling listDocuments: %s", err)
+	}
+	if !reflect.DeepEqual(client.lists, []string{"secret/metadata"}) {
+		t.Errorf("Expected list of secret/metadata, got %v", client.lists)
+	}
+}
+
+func TestGeneric_areKeysApplied_kvMetadata(t *testing.T) {
+	gh, _ := NewGeneric(&vault.MockClient{}, PathHandlerConfig{})
+	configured := map[string]interface{}{
+		"key":         "value",
+		kvMetadataKey: map[string]interface{}{"max_versions": float64(5)},
+	}
+	live := map[string]interface{}{
+		"key": "value",
+		kvMetadataKey: map[string]interface{}{
+			"max_versions": json.Number("5"),
+			"cas_required": false,
+		},
+	}
+	if !gh.areKeysApplied(configured, live) {
+		t.Errorf("Expected configured metadata settings to be applied")
+	}
+}
@@ -0,0 +1,117 @@
+package path_handlers
+
+import (
+	"fmt"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"reflect"
+	"strings"
+)
+
+/*
+	Ownership tracking for the Generic handler, so that it can share a mount with documents managed
+	by hand. When a state path is configured, the paths of the documents vaultsmith has written are
+	recorded in a state document at that path, e.g. {"paths": ["secret/app/db"]}, and undeclared
+	documents are only deleted if they are recorded there. In strict mode every undeclared document
+	is deleted, as it is without a state path, but the state is still recorded.
+*/
+
+// The key of the state document which lists the paths vaultsmith owns
+const statePathsKey = "paths"
+
+// Return the path of the state document, or an empty string if ownership is not tracked
+func (gh *Generic) statePath() string {
+	return strings.Trim(gh.config.StatePath, "/")
+}
+
+// Read the paths vaultsmith owns from the state document, if it has not been read already
+func (gh *Generic) loadState() error {
+	if gh.statePath() == "" || gh.owned != nil {
+		return nil
+	}
+	data, err := readDocument(gh.client, gh.kv, gh.statePath())
+	if err != nil {
+		return fmt.Errorf("could not read state document %s: %s", gh.statePath(), err)
+	}
+
+	owned := map[string]bool{}
+	if data != nil {
+		paths, ok := data[statePathsKey].([]interface{})
+		if data[statePathsKey] != nil && !ok {
+			return fmt.Errorf("%s of state document %s is not a list: %+v", statePathsKey,
+				gh.statePath(), data[statePathsKey])
+		}
+		for _, p := range paths {
+			owned[fmt.Sprintf("%v", p)] = true
+		}
+	}
+	gh.owned = owned
+	gh.stateDoc = data
+	return nil
+}
+
+// Return true if the undeclared document at path may be deleted
+func (gh *Generic) mayRemove(path string) bool {
+	if path == strings.Trim(gh.config.LockPath, "/") {
+		// the lock of this run, which is not a document either
+		return false
+	}
+	if gh.statePath() == "" {
+		return true
+	}
+	if path == gh.statePath() {
+		// the state document is not one of the documents it describes
+		return false
+	}
+	return gh.config.Strict || gh.owned[path]
+}
+
+// Record the paths vaultsmith owns in the state document, once every directory has been processed:
+// those it owned before and those it has written or found applied now, less those it has deleted.
+// Declared documents it could not read, or which the safety rules kept it from writing, are not
+// owned, so that they are not deleted once they are no longer declared.
+func (gh *Generic) SaveState() error {
+	if gh.statePath() == "" {
+		return nil
+	}
+	err := gh.loadState()
+	if err != nil {
+		return err
+	}
+	if _, ok := gh.configuredDocMap[gh.statePath()]; ok {
+		return fmt.Errorf("state document %s is also declared as a document", gh.statePath())
+	}
+
+	owned := map[string]bool{}
+	for p := range gh.owned {
+		if _, removed := gh.removedDocMap[p]; !removed {
+			owned[p] = true
+		}
+	}
+	for p := range gh.appliedDocMap {
+		owned[p] = true
+	}
+	if reflect.DeepEqual(owned, gh.owned) {
+		gh.recordResult(gh.statePath(), report.Unchanged, "")
+		return nil
+	}
+
+	state := map[string]interface{}{statePathsKey: sortedNames(owned)}
+	change := plan.Change{
+		Path:   gh.statePath(),
+		Action: plan.Create,
+		After:  state,
+		Diff:   documentListing(diffAdded, state),
+	}
+	if gh.stateDoc != nil {
+		change.Action = plan.Update
+		change.Before = gh.stateDoc
+		change.Diff = documentDiff(state, gh.stateDoc)
+	}
+	if !gh.recordChange(change) {
+		return nil
+	}
+
+	gh.log.WithField("path", gh.statePath()).Info("Writing state document")
+	return putDocument(gh.client, gh.kv, gh.statePath(), state)
+}
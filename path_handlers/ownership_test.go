@@ -0,0 +1,226 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/safety"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Serves documents from a map by path, as a KV version 1 mount would
+type docClient struct {
+	vault.MockClient
+	mutex   sync.Mutex // documents are handled by several workers at once
+	docs    map[string]map[string]interface{}
+	denied  map[string]bool // paths which may not be read
+	deletes []string
+}
+
+func (c *docClient) Read(path string) (*vaultApi.Secret, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.denied[path] {
+		return nil, fmt.Errorf("Error making API request.\n\nCode: 403. Errors:\n\n* permission denied")
+	}
+	if data, ok := c.docs[path]; ok {
+		return &vaultApi.Secret{Data: data}, nil
+	}
+	return nil, nil
+}
+
+func (c *docClient) List(path string) (*vaultApi.Secret, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	seen := map[string]bool{}
+	keys := []interface{}{}
+	for p := range c.docs {
+		if !strings.HasPrefix(p, path+"/") {
+			continue
+		}
+		key := strings.TrimPrefix(p, path+"/")
+		if i := strings.Index(key, "/"); i >= 0 {
+			key = key[:i+1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return &vaultApi.Secret{Data: map[string]interface{}{"keys": keys}}, nil
+}
+
+func (c *docClient) Write(path string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.docs[path] = data
+	return nil, nil
+}
+
+func (c *docClient) Delete(path string) (*vaultApi.Secret, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deletes = append(c.deletes, path)
+	delete(c.docs, path)
+	return nil, nil
+}
+
+// A document tree declaring secret/app/declared, and a Vault which also has a document written by
+// vaultsmith before and one written by hand
+func ownershipFixture(t *testing.T) (docPath string, client *docClient, cleanUp func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "secret", "app"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "secret", "app", "declared.json"), []byte(`{"a": "b"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = &docClient{docs: map[string]map[string]interface{}{
+		"secret/app/declared": {"a": "b"},
+		"secret/app/by-hand":  {"c": "d"},
+		"secret/app/old":      {"e": "f"},
+		"vaultsmith/state":    {"paths": []interface{}{"secret/app/old"}},
+	}}
+	return dir, client, func() { os.RemoveAll(dir) }
+}
+
+func TestGeneric_ownership(t *testing.T) {
+	docPath, client, cleanUp := ownershipFixture(t)
+	defer cleanUp()
+
+	changes := plan.NewChangeSet()
+	gh, _ := NewGeneric(client, PathHandlerConfig{
+		DocumentPath: docPath,
+		Changes:      changes,
+		StatePath:    "vaultsmith/state",
+	})
+	err := gh.PutPoliciesFromDir(filepath.Join(docPath, "secret"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	if !reflect.DeepEqual(client.deletes, []string{"secret/app/old"}) {
+		t.Errorf("Expected only secret/app/old to be deleted, got %v", client.deletes)
+	}
+
+	err = gh.SaveState()
+	if err != nil {
+		t.Fatalf("Error calling SaveState: %s", err)
+	}
+	expected := map[string]interface{}{"paths": []string{"secret/app/declared"}}
+	if !reflect.DeepEqual(client.docs["vaultsmith/state"], expected) {
+		t.Errorf("Expected state %+v, got %+v", expected, client.docs["vaultsmith/state"])
+	}
+	last := changes.Changes[len(changes.Changes)-1]
+	if last.Path != "vaultsmith/state" || last.Action != plan.Update {
+		t.Errorf("Expected update of state document to be recorded, got %+v", last)
+	}
+}
+
+func TestGeneric_ownershipStrict(t *testing.T) {
+	docPath, client, cleanUp := ownershipFixture(t)
+	defer cleanUp()
+
+	gh, _ := NewGeneric(client, PathHandlerConfig{
+		DocumentPath: docPath,
+		StatePath:    "vaultsmith/state",
+		Strict:       true,
+	})
+	err := gh.PutPoliciesFromDir(filepath.Join(docPath, "secret"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	sort.Strings(client.deletes)
+	if !reflect.DeepEqual(client.deletes, []string{"secret/app/by-hand", "secret/app/old"}) {
+		t.Errorf("Expected all undeclared documents to be deleted, got %v", client.deletes)
+	}
+}
+
+// The state document is not one of the documents it describes, even in a declared directory
+func TestGeneric_mayRemove_stateDocument(t *testing.T) {
+	gh, _ := NewGeneric(&vault.MockClient{}, PathHandlerConfig{
+		StatePath: "/secret/vaultsmith/",
+		Strict:    true,
+	})
+	if gh.mayRemove("secret/vaultsmith") {
+		t.Errorf("Expected state document not to be removed")
+	}
+	if !gh.mayRemove("secret/other") {
+		t.Errorf("Expected other documents to be removed in strict mode")
+	}
+}
+
+// The run lock may share a mount with documents, and is never deleted as undeclared
+func TestGeneric_mayRemove_lock(t *testing.T) {
+	gh, _ := NewGeneric(&vault.MockClient{}, PathHandlerConfig{LockPath: "secret/vaultsmith/lock"})
+	if gh.mayRemove("secret/vaultsmith/lock") {
+		t.Errorf("Expected lock not to be removed")
+	}
+}
+
+// Declared documents which vaultsmith could not read, or was not allowed to write, are not owned
+func TestGeneric_ownershipSkipped(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "secret", "app"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"applied", "written", "denied", "refused"} {
+		err = ioutil.WriteFile(filepath.Join(dir, "secret", "app", name+".json"),
+			[]byte(`{"a": "b"}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &docClient{
+		docs: map[string]map[string]interface{}{
+			"secret/app/applied": {"a": "b"},
+			"secret/app/denied":  {"c": "d"},
+			"secret/app/refused": {"c": "d"},
+		},
+		denied: map[string]bool{"secret/app/denied": true},
+	}
+	gh, _ := NewGeneric(client, PathHandlerConfig{
+		DocumentPath: dir,
+		StatePath:    "vaultsmith/state",
+		Safety: &safety.Rules{
+			Managed: []string{"secret/app/applied", "secret/app/written", "vaultsmith/*"},
+		},
+	})
+	err = gh.PutPoliciesFromDir(filepath.Join(dir, "secret"))
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+	err = gh.SaveState()
+	if err != nil {
+		t.Fatalf("Error calling SaveState: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"paths": []string{"secret/app/applied", "secret/app/written"},
+	}
+	if !reflect.DeepEqual(client.docs["vaultsmith/state"], expected) {
+		t.Errorf("Expected state %+v, got %+v", expected, client.docs["vaultsmith/state"])
+	}
+}
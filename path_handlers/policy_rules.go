@@ -0,0 +1,224 @@
+package path_handlers
+
+import (
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Parsing of policies into the permissions they grant, so that policies which differ only in
+	formatting, comments or the order of stanzas are treated as the same. Parsing follows the way
+	Vault itself reads policies, so both HCL and JSON policies are accepted.
+*/
+
+// The permissions granted by a policy, by path
+type policyRules map[string]*pathRules
+
+// The permissions for a single path, normalised so that equivalent rules are deeply equal
+type pathRules struct {
+	Capabilities       []string
+	AllowedParameters  map[string][]string
+	DeniedParameters   map[string][]string
+	RequiredParameters []string
+	MinWrappingTTL     int // seconds
+	MaxWrappingTTL     int // seconds
+}
+
+// A path stanza, as written in a policy
+type pathStanza struct {
+	Policy             string                   `hcl:"policy"`
+	Capabilities       []string                 `hcl:"capabilities"`
+	AllowedParameters  map[string][]interface{} `hcl:"allowed_parameters"`
+	DeniedParameters   map[string][]interface{} `hcl:"denied_parameters"`
+	RequiredParameters []string                 `hcl:"required_parameters"`
+	MinWrappingTTL     interface{}              `hcl:"min_wrapping_ttl"`
+	MaxWrappingTTL     interface{}              `hcl:"max_wrapping_ttl"`
+}
+
+// The capabilities granted by the older "policy" field of a path stanza
+var policyCapabilities = map[string][]string{
+	"deny":  {"deny"},
+	"read":  {"read", "list"},
+	"write": {"create", "read", "update", "delete", "list"},
+	"sudo":  {"create", "read", "update", "delete", "list", "sudo"},
+}
+
+// Determine whether a configured policy grants the same permissions as the live one. Only an
+// invalid configured policy is an error; a live policy that cannot be parsed is simply different.
+func isPolicyEquivalent(configured string, live string) (bool, error) {
+	configuredRules, err := parsePolicy(configured)
+	if err != nil {
+		return false, err
+	}
+	liveRules, err := parsePolicy(live)
+	if err != nil {
+		return false, nil
+	}
+	return reflect.DeepEqual(configuredRules, liveRules), nil
+}
+
+// Parse the text of a policy into its rules. As in Vault, stanzas for the same path are merged.
+func parsePolicy(text string) (policyRules, error) {
+	file, err := hcl.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse policy: %s", err)
+	}
+	root, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("could not parse policy: root should be an object")
+	}
+
+	rules := policyRules{}
+	for _, item := range root.Filter("path").Items {
+		if len(item.Keys) == 0 {
+			return nil, fmt.Errorf("path stanza without a path at %s", item.Pos())
+		}
+		path, ok := item.Keys[0].Token.Value().(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid path at %s", item.Pos())
+		}
+		path = strings.TrimPrefix(path, "/")
+
+		var stanza pathStanza
+		err = hcl.DecodeObject(&stanza, item.Val)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rules for path %q: %s", path, err)
+		}
+		pr, err := normalisePathRules(stanza)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rules for path %q: %s", path, err)
+		}
+
+		if existing, ok := rules[path]; ok {
+			pr = mergePathRules(existing, pr)
+		}
+		rules[path] = pr
+	}
+	return rules, nil
+}
+
+func normalisePathRules(stanza pathStanza) (*pathRules, error) {
+	capabilities := stanza.Capabilities
+	if stanza.Policy != "" {
+		granted, ok := policyCapabilities[stanza.Policy]
+		if !ok {
+			return nil, fmt.Errorf("invalid policy %q", stanza.Policy)
+		}
+		capabilities = append(capabilities, granted...)
+	}
+
+	minTTL, err := wrappingTtlSeconds(stanza.MinWrappingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid min_wrapping_ttl: %s", err)
+	}
+	maxTTL, err := wrappingTtlSeconds(stanza.MaxWrappingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_wrapping_ttl: %s", err)
+	}
+
+	return &pathRules{
+		Capabilities:       sortedUnique(capabilities),
+		AllowedParameters:  normaliseParameters(stanza.AllowedParameters),
+		DeniedParameters:   normaliseParameters(stanza.DeniedParameters),
+		RequiredParameters: sortedUnique(stanza.RequiredParameters),
+		MinWrappingTTL:     minTTL,
+		MaxWrappingTTL:     maxTTL,
+	}, nil
+}
+
+// Combine the rules of two stanzas for the same path
+func mergePathRules(a *pathRules, b *pathRules) *pathRules {
+	merged := &pathRules{
+		Capabilities:       sortedUnique(append(a.Capabilities, b.Capabilities...)),
+		AllowedParameters:  mergeParameters(a.AllowedParameters, b.AllowedParameters),
+		DeniedParameters:   mergeParameters(a.DeniedParameters, b.DeniedParameters),
+		RequiredParameters: sortedUnique(append(a.RequiredParameters, b.RequiredParameters...)),
+		MinWrappingTTL:     a.MinWrappingTTL,
+		MaxWrappingTTL:     a.MaxWrappingTTL,
+	}
+	if b.MinWrappingTTL != 0 {
+		merged.MinWrappingTTL = b.MinWrappingTTL
+	}
+	if b.MaxWrappingTTL != 0 {
+		merged.MaxWrappingTTL = b.MaxWrappingTTL
+	}
+	return merged
+}
+
+// Convert parameter constraints to sorted lists of strings, so the order of values is ignored
+func normaliseParameters(params map[string][]interface{}) map[string][]string {
+	if len(params) == 0 {
+		return nil
+	}
+	normalised := map[string][]string{}
+	for key, values := range params {
+		strValues := []string{}
+		for _, v := range values {
+			strValues = append(strValues, fmt.Sprintf("%v", v))
+		}
+		normalised[strings.ToLower(key)] = sortedUnique(strValues)
+	}
+	return normalised
+}
+
+func mergeParameters(a map[string][]string, b map[string][]string) map[string][]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := map[string][]string{}
+	for _, params := range []map[string][]string{a, b} {
+		for key, values := range params {
+			merged[key] = sortedUnique(append(merged[key], values...))
+		}
+	}
+	return merged
+}
+
+// Convert a wrapping ttl, which may be a number of seconds or a duration string, to seconds
+func wrappingTtlSeconds(ttl interface{}) (int, error) {
+	switch v := ttl.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	case string:
+		if v == "" {
+			return 0, nil
+		}
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return seconds, nil
+		}
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+		return int(dur.Seconds()), nil
+	default:
+		return 0, fmt.Errorf("unexpected type %T", ttl)
+	}
+}
+
+// Return the sorted, de-duplicated values of a slice, or nil if it is empty
+func sortedUnique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,103 @@
+package path_handlers
+
+import (
+	"testing"
+)
+
+func TestIsPolicyEquivalent(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		live       string
+		expected   bool
+	}{
+		{
+			name: "stanzas reordered",
+			configured: `
+path "secret/a" { capabilities = ["read"] }
+path "secret/b" { capabilities = ["list"] }`,
+			live: `
+path "secret/b" {
+  capabilities = ["list"]
+}
+
+path "secret/a" {
+  capabilities = ["read"]
+}`,
+			expected: true,
+		},
+		{
+			name:       "json policy",
+			configured: `{"path": {"secret/*": {"capabilities": ["read"]}}}`,
+			live:       `path "secret/*" { capabilities = ["read"] }`,
+			expected:   true,
+		},
+		{
+			name:       "old policy field",
+			configured: `path "secret/*" { policy = "read" }`,
+			live:       `path "secret/*" { capabilities = ["list", "read"] }`,
+			expected:   true,
+		},
+		{
+			name: "duplicate path stanzas merged",
+			configured: `
+path "secret/*" { capabilities = ["read"] }
+path "secret/*" { capabilities = ["list"] }`,
+			live:     `path "secret/*" { capabilities = ["read", "list"] }`,
+			expected: true,
+		},
+		{
+			name:       "wrapping ttl as duration or seconds",
+			configured: `path "secret/*" { capabilities = ["read"] max_wrapping_ttl = "1m" }`,
+			live:       `path "secret/*" { capabilities = ["read"] max_wrapping_ttl = 60 }`,
+			expected:   true,
+		},
+		{
+			name:       "parameter values reordered",
+			configured: `path "secret/*" { allowed_parameters = { "foo" = ["a", "b"] } }`,
+			live:       `path "secret/*" { allowed_parameters = { "foo" = ["b", "a"] } }`,
+			expected:   true,
+		},
+		{
+			name:       "capability added",
+			configured: `path "secret/*" { capabilities = ["read", "delete"] }`,
+			live:       `path "secret/*" { capabilities = ["read"] }`,
+			expected:   false,
+		},
+		{
+			name:       "denied parameter changed",
+			configured: `path "secret/*" { denied_parameters = { "foo" = [] } }`,
+			live:       `path "secret/*" { denied_parameters = { "bar" = [] } }`,
+			expected:   false,
+		},
+		{
+			name:       "path changed",
+			configured: `path "secret/a" { capabilities = ["read"] }`,
+			live:       `path "secret/b" { capabilities = ["read"] }`,
+			expected:   false,
+		},
+	}
+
+	for _, test := range tests {
+		equivalent, err := isPolicyEquivalent(test.configured, test.live)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if equivalent != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, equivalent)
+		}
+	}
+}
+
+func TestParsePolicy_invalid(t *testing.T) {
+	for _, p := range []string{
+		`path "secret/*" { capabilities = ["read"]`,
+		`path "secret/*" { policy = "admin" }`,
+		`path "secret/*" { max_wrapping_ttl = "forever" }`,
+	} {
+		_, err := parsePolicy(p)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", p)
+		}
+	}
+}
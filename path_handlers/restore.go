@@ -0,0 +1,106 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+)
+
+/*
+	Functions for putting paths back to a value captured from Vault with LiveValue, e.g. in the
+	snapshot taken before a run. The captured value is in the form it was read in, so is converted to
+	the form the handler writes in, and the restore is then made with ApplyChange.
+*/
+
+// Return the change which puts the path of captured back to captured.Before, or nil if it already
+// has that value. If captured.Before is nil the path was not present, so is deleted.
+func RestoreChange(client vault.Vault, captured plan.Change) (*plan.Change, error) {
+	live, err := LiveValue(client, captured)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", captured.FullPath(), err)
+	}
+	liveFingerprint, err := plan.Fingerprint(live)
+	if err != nil {
+		return nil, err
+	}
+	capturedFingerprint, err := plan.Fingerprint(captured.Before)
+	if err != nil {
+		return nil, err
+	}
+	if liveFingerprint == capturedFingerprint {
+		return nil, nil
+	}
+
+	change := &plan.Change{
+		Path:      captured.Path,
+		Handler:   captured.Handler,
+		Namespace: captured.Namespace,
+		Before:    live,
+	}
+	if captured.Before == nil {
+		change.Action = plan.Delete
+		return change, nil
+	}
+
+	change.After, err = writableValue(captured.Handler, captured.Before)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert captured value of %s: %s", captured.FullPath(), err)
+	}
+	change.Action = plan.Create
+	if live != nil {
+		change.Action = plan.Update
+	}
+	return change, nil
+}
+
+// Convert a value in the form LiveValue returns it for handler, which may have been through json,
+// to the form the handler's changes are made in
+func writableValue(handler string, value interface{}) (interface{}, error) {
+	switch handler {
+	case "SysAuth":
+		var authMount vaultApi.AuthMount
+		err := convertType(value, &authMount)
+		if err != nil {
+			return nil, err
+		}
+		return authInput(authMount), nil
+	case "SysAudit":
+		var audit vaultApi.Audit
+		err := convertType(value, &audit)
+		if err != nil {
+			return nil, err
+		}
+		return auditInput(audit), nil
+	case "SysMounts":
+		var mount vaultApi.MountOutput
+		err := convertType(value, &mount)
+		if err != nil {
+			return nil, err
+		}
+		return mountInput(mount), nil
+	default:
+		// documents, policies, namespaces and identities are read and written in the same form
+		return value, nil
+	}
+}
+
+// The reverse of ConvertMountConfig
+func convertMountConfigOutput(output vaultApi.MountConfigOutput) vaultApi.MountConfigInput {
+	input := vaultApi.MountConfigInput{
+		ForceNoCache:              output.ForceNoCache,
+		PluginName:                output.PluginName,
+		AuditNonHMACRequestKeys:   output.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys:  output.AuditNonHMACResponseKeys,
+		ListingVisibility:         output.ListingVisibility,
+		PassthroughRequestHeaders: output.PassthroughRequestHeaders,
+	}
+	// zero means the system default, which is represented by an empty string on input
+	if output.DefaultLeaseTTL != 0 {
+		input.DefaultLeaseTTL = fmt.Sprintf("%ds", output.DefaultLeaseTTL)
+	}
+	if output.MaxLeaseTTL != 0 {
+		input.MaxLeaseTTL = fmt.Sprintf("%ds", output.MaxLeaseTTL)
+	}
+	return input
+}
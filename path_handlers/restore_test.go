@@ -0,0 +1,72 @@
+package path_handlers
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"reflect"
+	"testing"
+)
+
+func TestRestoreChange(t *testing.T) {
+	client := &docClient{docs: map[string]map[string]interface{}{
+		"secret/changed":   {"key": "new"},
+		"secret/unchanged": {"key": "old"},
+		"secret/created":   {"key": "new"},
+	}}
+
+	change, err := RestoreChange(client, plan.Change{
+		Path:    "secret/changed",
+		Handler: "Generic",
+		Before:  map[string]interface{}{"key": "old"},
+	})
+	if err != nil {
+		t.Fatalf("Error calling RestoreChange: %s", err)
+	}
+	if change == nil || change.Action != plan.Update ||
+		!reflect.DeepEqual(change.After, map[string]interface{}{"key": "old"}) {
+		t.Errorf("Expected update back to saved value, got %+v", change)
+	}
+
+	change, err = RestoreChange(client, plan.Change{
+		Path:    "secret/unchanged",
+		Handler: "Generic",
+		Before:  map[string]interface{}{"key": "old"},
+	})
+	if err != nil {
+		t.Fatalf("Error calling RestoreChange: %s", err)
+	}
+	if change != nil {
+		t.Errorf("Expected no change for path which has its saved value, got %+v", change)
+	}
+
+	change, err = RestoreChange(client, plan.Change{Path: "secret/created", Handler: "Generic"})
+	if err != nil {
+		t.Fatalf("Error calling RestoreChange: %s", err)
+	}
+	if change == nil || change.Action != plan.Delete {
+		t.Errorf("Expected path which was not present to be deleted, got %+v", change)
+	}
+}
+
+// An auth method is saved as read, and should be restored in the form it is enabled in
+func TestWritableValue_auth(t *testing.T) {
+	saved := map[string]interface{}{
+		"type":        "approle",
+		"description": "apps",
+		"config":      map[string]interface{}{"default_lease_ttl": 3600, "max_lease_ttl": 0},
+	}
+	value, err := writableValue("SysAuth", saved)
+	if err != nil {
+		t.Fatalf("Error calling writableValue: %s", err)
+	}
+	options, ok := value.(vaultApi.EnableAuthOptions)
+	if !ok {
+		t.Fatalf("Expected EnableAuthOptions, got %T", value)
+	}
+	if options.Type != "approle" || options.Description != "apps" {
+		t.Errorf("Expected type and description to be kept, got %+v", options)
+	}
+	if options.Config.DefaultLeaseTTL != "3600s" || options.Config.MaxLeaseTTL != "" {
+		t.Errorf("Expected lease TTLs to be converted, got %+v", options.Config)
+	}
+}
@@ -0,0 +1,212 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/vault"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+/*
+	SysAudit handles the enabling of audit devices, described in the configuration under
+	sys/audit. Each file is an EnableAuditOptions, e.g. sys/audit/file.json enables at file/.
+
+	Audit devices cannot be modified once enabled, so one whose type or options differ is disabled
+	and enabled again. Unless AllowNoAudit is set, the last audit device is never disabled, even to
+	re-create it, as Vault would then stop recording requests without any warning.
+*/
+type SysAudit struct {
+	BaseHandler
+	liveAuditMap       map[string]*vaultApi.Audit
+	configuredAuditMap map[string]*vaultApi.Audit
+	created            int // devices enabled at new paths so far
+}
+
+func NewSysAuditHandler(client vault.Vault, config PathHandlerConfig) (*SysAudit, error) {
+	// Build a map of currently enabled audit devices, so walkFile() can reference it
+	liveAuditMap, err := client.ListAudit()
+	if err != nil {
+		return &SysAudit{}, err
+	}
+
+	return &SysAudit{
+		BaseHandler: BaseHandler{
+			name:   "SysAudit",
+			client: client,
+			config: config,
+			order:  config.Order,
+			log: log.WithFields(log.Fields{
+				"handler": "SysAudit",
+			}),
+		},
+		liveAuditMap:       liveAuditMap,
+		configuredAuditMap: make(map[string]*vaultApi.Audit),
+	}, nil
+}
+
+func (sh *SysAudit) walkFile(path string, f os.FileInfo, err error) error {
+	if f == nil {
+		logger := sh.log.WithFields(log.Fields{"path": path, "error": err})
+		logger.Debug("Path does not exist, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+	// not doing anything with dirs
+	if f.IsDir() {
+		return nil
+	}
+
+	auditPath, err := apiPath(sh.config.DocumentPath, path)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(auditPath, "sys/audit") {
+		return fmt.Errorf("found file without sys/audit prefix: %s", auditPath)
+	}
+
+	fileContents, err := sh.readFile(path)
+	if err != nil {
+		return err
+	}
+
+	var auditOpts vaultApi.EnableAuditOptions
+	err = document.Decode(f.Name(), fileContents, &auditOpts)
+	if err != nil {
+		return fmt.Errorf("could not parse document from file %s: %s", path, err)
+	}
+
+	sysAuditPath := strings.TrimPrefix(auditPath, "sys/audit/") + "/"
+	err = sh.ensureAudit(sysAuditPath, f.Name(), auditOpts)
+	if err != nil {
+		return fmt.Errorf("error while ensuring audit device for path %s: %s", path, err)
+	}
+
+	return nil
+}
+
+func (sh *SysAudit) PutPoliciesFromDir(path string) error {
+	err := filepath.Walk(path, sh.walkFile)
+	if err != nil {
+		return err
+	}
+	return sh.DisableUnconfiguredAudits()
+}
+
+// Ensure that this audit device is enabled with the correct type and options
+func (sh *SysAudit) ensureAudit(path string, sourceFile string, auditOpts vaultApi.EnableAuditOptions) error {
+	audit := vaultApi.Audit{
+		Type:        auditOpts.Type,
+		Description: auditOpts.Description,
+		Options:     auditOpts.Options,
+		Local:       auditOpts.Local,
+		Path:        path,
+	}
+	sh.configuredAuditMap[path] = &audit
+
+	logger := sh.log.WithFields(log.Fields{
+		"audit path": path,
+		"audit.Type": auditOpts.Type,
+	})
+
+	change := plan.Change{
+		Path:       "sys/audit/" + path,
+		Action:     plan.Create,
+		SourceFile: sourceFile,
+		After:      auditOpts,
+	}
+	if liveAudit, ok := sh.liveAuditMap[path]; ok {
+		if isAuditApplied(&audit, liveAudit) {
+			logger.Debugf("Audit device already enabled")
+			sh.recordResult(change.Path, report.Unchanged, sourceFile)
+			return nil
+		}
+		change.Action = plan.Update
+		change.Before = liveAudit
+		change.Diff = auditDiff(&audit, liveAudit)
+		if len(sh.liveAuditMap)-1+sh.created == 0 && !sh.config.AllowNoAudit {
+			logger.Warnf("Not re-creating audit device, as it is the last one enabled and would " +
+				"be disabled meanwhile. Declare another device, or use --allow-no-audit")
+			sh.recordResult(change.Path, report.SkippedProtected, sourceFile)
+			return nil
+		}
+		if !sh.recordChange(change) {
+			return nil
+		}
+
+		// audit devices cannot be tuned, so must be re-created
+		logger.Infof("Disabling audit device to re-create it")
+		err := sh.client.DisableAudit(path)
+		if err != nil {
+			return fmt.Errorf("could not disable audit device %s: %s", path, err)
+		}
+	} else if !sh.recordChange(change) {
+		return nil
+	}
+
+	logger.Infof("Enabling audit device")
+	err := sh.client.EnableAudit(path, &auditOpts)
+	if err != nil {
+		return fmt.Errorf("could not enable audit device %s: %s", path, err)
+	}
+	if change.Action == plan.Create {
+		sh.created++
+	}
+	return nil
+}
+
+func (sh *SysAudit) DisableUnconfiguredAudits() error {
+	// the live devices are still enabled, as are those this run has enabled at new paths. A
+	// configured device which was refused or skipped is not.
+	remaining := len(sh.liveAuditMap) + sh.created
+
+	// disable entries not in configured list
+	for _, path := range sortedNames(sh.liveAuditMap) {
+		audit := sh.liveAuditMap[path]
+		logger := log.WithFields(log.Fields{"audit.Type": audit.Type, "path": path})
+		if _, ok := sh.configuredAuditMap[path]; ok {
+			logger.Debugf("Not disabling audit device, is configured")
+			continue // present, do nothing
+		}
+		if remaining == 1 && !sh.config.AllowNoAudit {
+			logger.Warnf("Not disabling audit device, as it is the last one enabled")
+			sh.recordResult("sys/audit/"+path, report.SkippedProtected, "")
+			continue
+		}
+
+		if !sh.recordChange(plan.Change{
+			Path:   "sys/audit/" + path,
+			Action: plan.Delete,
+			Before: audit,
+		}) {
+			continue
+		}
+		logger.Infof("Disabling audit device")
+		err := sh.client.DisableAudit(path)
+		if err != nil {
+			return fmt.Errorf("failed to disable audit device at %s: %s", path, err)
+		}
+		remaining--
+	}
+	return nil
+}
+
+// return true if the configured audit device has the same type and options as the live one
+func isAuditApplied(configured *vaultApi.Audit, live *vaultApi.Audit) bool {
+	if configured.Type != live.Type {
+		return false
+	}
+	// no options and empty options are the same thing
+	if len(configured.Options) == 0 && len(live.Options) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(configured.Options, live.Options)
+}
@@ -0,0 +1,187 @@
+package path_handlers
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/safety"
+	"github.com/starlingbank/vaultsmith/vault"
+	"path/filepath"
+	"testing"
+)
+
+func TestSysAudit_PutPoliciesFromDir_Example(t *testing.T) {
+	client := &vault.MockClient{}
+	sh, err := NewSysAuditHandler(client, PathHandlerConfig{
+		DocumentPath: examplePath(),
+	})
+	if err != nil {
+		t.Errorf("Failed to create SysAudit: %s", err)
+	}
+
+	sysPath := filepath.Join(examplePath(), "sys/audit")
+	err = sh.PutPoliciesFromDir(sysPath)
+
+	if err != nil {
+		t.Errorf("Expected no error, got %q", err)
+	}
+}
+
+// A device with different options should be re-created, and undeclared ones disabled
+func TestSysAudit_PutPoliciesFromDir_Recreate(t *testing.T) {
+	changes := plan.NewChangeSet()
+	sh, err := NewSysAuditHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: examplePath(),
+		Changes:      changes,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysAudit: %s", err)
+	}
+	sh.liveAuditMap = map[string]*vaultApi.Audit{
+		"file/":   {Type: "file", Options: map[string]string{"file_path": "/tmp/audit.log"}},
+		"socket/": {Type: "socket"},
+	}
+
+	err = sh.PutPoliciesFromDir(filepath.Join(examplePath(), "sys/audit"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	expected := map[string]plan.Action{
+		"sys/audit/file/":   plan.Update,
+		"sys/audit/socket/": plan.Delete,
+	}
+	if len(changes.Changes) != len(expected) {
+		t.Errorf("Expected %d changes, got %+v", len(expected), changes.Changes)
+	}
+	for _, c := range changes.Changes {
+		if expected[c.Path] != c.Action {
+			t.Errorf("Unexpected change %s for %s", c.Action, c.Path)
+		}
+	}
+}
+
+// The only audit device should not be disabled to re-create it, leaving Vault without an audit log
+func TestSysAudit_PutPoliciesFromDir_RecreateLast(t *testing.T) {
+	changes := plan.NewChangeSet()
+	runReport := report.New(false)
+	runReport.StartHandler("SysAudit", "sys/audit", "")
+	sh, err := NewSysAuditHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: examplePath(),
+		Changes:      changes,
+		Report:       runReport,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysAudit: %s", err)
+	}
+	sh.liveAuditMap = map[string]*vaultApi.Audit{
+		"file/": {Type: "file", Options: map[string]string{"file_path": "/tmp/audit.log"}},
+	}
+
+	err = sh.PutPoliciesFromDir(filepath.Join(examplePath(), "sys/audit"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes.Changes)
+	}
+	paths := runReport.Handlers[0].Paths
+	if len(paths) != 1 || paths[0].Action != report.SkippedProtected {
+		t.Errorf("Expected sys/audit/file/ to be skipped, got %+v", paths)
+	}
+
+	// unless explicitly allowed
+	sh.config.AllowNoAudit = true
+	err = sh.PutPoliciesFromDir(filepath.Join(examplePath(), "sys/audit"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Action != plan.Update {
+		t.Errorf("Expected sys/audit/file/ to be re-created, got %+v", changes.Changes)
+	}
+}
+
+// With no audit devices declared, the last one should be left enabled
+func TestSysAudit_DisableUnconfiguredAudits_last(t *testing.T) {
+	changes := plan.NewChangeSet()
+	runReport := report.New(false)
+	runReport.StartHandler("SysAudit", "sys/audit", "")
+	sh, err := NewSysAuditHandler(&vault.MockClient{}, PathHandlerConfig{
+		Changes: changes,
+		Report:  runReport,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysAudit: %s", err)
+	}
+	sh.liveAuditMap = map[string]*vaultApi.Audit{
+		"file/":   {Type: "file"},
+		"socket/": {Type: "socket"},
+	}
+
+	err = sh.DisableUnconfiguredAudits()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Path != "sys/audit/file/" {
+		t.Errorf("Expected only sys/audit/file/ to be disabled, got %+v", changes.Changes)
+	}
+	paths := runReport.Handlers[0].Paths
+	if len(paths) != 2 || paths[1].Action != report.SkippedProtected {
+		t.Errorf("Expected sys/audit/socket/ to be skipped, got %+v", paths)
+	}
+
+	// unless explicitly allowed
+	changes = plan.NewChangeSet()
+	sh.config.Changes = changes
+	sh.config.AllowNoAudit = true
+	err = sh.DisableUnconfiguredAudits()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 2 {
+		t.Errorf("Expected both devices to be disabled, got %+v", changes.Changes)
+	}
+}
+
+// A declared device which was refused is not enabled, so cannot stand in for the last live one
+func TestSysAudit_PutPoliciesFromDir_refusedNotCounted(t *testing.T) {
+	changes := plan.NewChangeSet()
+	runReport := report.New(false)
+	runReport.StartHandler("SysAudit", "sys/audit", "")
+	sh, err := NewSysAuditHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: examplePath(),
+		Changes:      changes,
+		Report:       runReport,
+		Safety:       &safety.Rules{Managed: []string{"sys/audit/socket"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysAudit: %s", err)
+	}
+	sh.liveAuditMap = map[string]*vaultApi.Audit{"socket/": {Type: "socket"}}
+
+	err = sh.PutPoliciesFromDir(filepath.Join(examplePath(), "sys/audit"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes.Changes)
+	}
+	paths := runReport.Handlers[0].Paths
+	if len(paths) != 2 || paths[1].Path != "sys/audit/socket/" ||
+		paths[1].Action != report.SkippedProtected {
+		t.Errorf("Expected sys/audit/socket/ to be left enabled, got %+v", paths)
+	}
+}
+
+func TestIsAuditApplied(t *testing.T) {
+	configured := &vaultApi.Audit{Type: "socket"}
+	live := &vaultApi.Audit{Type: "socket", Options: map[string]string{}}
+	if !isAuditApplied(configured, live) {
+		t.Errorf("Expected nil and empty options to be equivalent")
+	}
+
+	live.Options["address"] = "127.0.0.1:9090"
+	if isAuditApplied(configured, live) {
+		t.Errorf("Expected device with different options not to be applied")
+	}
+}
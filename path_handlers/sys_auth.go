@@ -1,14 +1,15 @@
 package path_handlers
 
 import (
-	"encoding/json"
 	"fmt"
 	vaultApi "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strings"
 	"time"
 )
@@ -79,13 +80,13 @@ func (sh *SysAuth) walkFile(path string, f os.FileInfo, err error) error {
 	}
 
 	var enableOpts vaultApi.EnableAuthOptions
-	err = json.Unmarshal([]byte(fileContents), &enableOpts)
+	err = document.Decode(f.Name(), fileContents, &enableOpts)
 	if err != nil {
-		return fmt.Errorf("could not parse json from file %s: %s", path, err)
+		return fmt.Errorf("could not parse document from file %s: %s", path, err)
 	}
 
 	sysAuthPath := strings.TrimPrefix(policyPath, "sys/auth/") + "/"
-	err = sh.ensureAuth(sysAuthPath, enableOpts)
+	err = sh.ensureAuth(sysAuthPath, f.Name(), enableOpts)
 	if err != nil {
 		return fmt.Errorf("error while ensuring auth for path %s: %s", path, err)
 	}
@@ -102,18 +103,11 @@ func (sh *SysAuth) PutPoliciesFromDir(path string) error {
 }
 
 // Ensure that this auth type is enabled and has the correct configuration
-func (sh *SysAuth) ensureAuth(path string, enableOpts vaultApi.EnableAuthOptions) error {
-	// we need to convert to AuthConfigOutput in order to compare with existing config
-	var enableOptsAuthConfigOutput vaultApi.AuthConfigOutput
-	enableOptsAuthConfigOutput, err := ConvertAuthConfig(enableOpts.Config)
+func (sh *SysAuth) ensureAuth(path string, sourceFile string, enableOpts vaultApi.EnableAuthOptions) error {
+	authMount, err := configuredAuthMount(enableOpts)
 	if err != nil {
 		return err
 	}
-
-	authMount := vaultApi.AuthMount{
-		Type:   enableOpts.Type,
-		Config: enableOptsAuthConfigOutput,
-	}
 	sh.configuredAuthMap[path] = &authMount
 
 	logger := sh.log.WithFields(log.Fields{
@@ -121,20 +115,62 @@ func (sh *SysAuth) ensureAuth(path string, enableOpts vaultApi.EnableAuthOptions
 		"authMount.Type": enableOpts.Type,
 	})
 
-	if liveAuth, ok := sh.liveAuthMap[path]; ok {
-		// If this path is present in our live config, we may not need to enable
-		err, applied := sh.isConfigApplied(enableOpts.Config, liveAuth.Config)
+	change := plan.Change{
+		Path:       "sys/auth/" + path,
+		Action:     plan.Create,
+		SourceFile: sourceFile,
+		After:      enableOpts,
+	}
+	liveAuth, ok := sh.liveAuthMap[path]
+	if !ok {
+		if !sh.recordChange(change) {
+			return nil
+		}
+		logger.Infof("Enabling auth mount")
+		err = sh.client.EnableAuth(path, &enableOpts)
 		if err != nil {
-			return fmt.Errorf(
-				"could not determine whether configuration for auth mount %s was applied: %s",
-				enableOpts.Type, err)
+			return fmt.Errorf("could not enable auth %s: %s", path, err)
 		}
-		if applied {
-			logger.Debugf("Auth mount configuration already applied")
+		return nil
+	}
+
+	// If this path is present in our live config, we may not need to change anything
+	diff := authMountDiff(&authMount, liveAuth)
+	if len(diff) == 0 {
+		logger.Debugf("Auth mount configuration already applied")
+		sh.recordResult(change.Path, report.Unchanged, sourceFile)
+		return nil
+	}
+	change.Action = plan.Update
+	change.Before = liveAuth
+	change.Diff = diff
+
+	if !requiresRemount(&authMount, liveAuth) {
+		if !sh.recordChange(change) {
 			return nil
 		}
+		logger.Infof("Tuning auth mount")
+		err = sh.client.TuneAuth(path, authTuneData(enableOpts))
+		if err != nil {
+			return fmt.Errorf("could not tune auth %s: %s", path, err)
+		}
+		return nil
+	}
+
+	// type, local and seal_wrap can only be set when enabling
+	if !sh.config.AllowAuthRemount {
+		return fmt.Errorf("auth mount %s must be disabled and enabled again to apply its "+
+			"configuration, which would delete all of its roles and config; refusing to do so "+
+			"without --allow-auth-remount", path)
+	}
+	if !sh.recordChange(change) {
+		return nil
+	}
+	logger.Warnf("Disabling auth mount to enable it again")
+	err = sh.client.DisableAuth(path)
+	if err != nil {
+		return fmt.Errorf("could not disable auth %s: %s", path, err)
 	}
-	logger.Infof("Applying auth mount")
 	err = sh.client.EnableAuth(path, &enableOpts)
 	if err != nil {
 		return fmt.Errorf("could not enable auth %s: %s", path, err)
@@ -144,7 +180,8 @@ func (sh *SysAuth) ensureAuth(path string, enableOpts vaultApi.EnableAuthOptions
 
 func (sh *SysAuth) DisableUnconfiguredAuths() error {
 	// delete entries not in configured list
-	for path, authMount := range sh.liveAuthMap {
+	for _, path := range sortedNames(sh.liveAuthMap) {
+		authMount := sh.liveAuthMap[path]
 		logger := log.WithFields(log.Fields{"authMount.Type": authMount.Type, "path": path})
 		if _, ok := sh.configuredAuthMap[path]; ok {
 			logger.Debugf("Not disabling auth mount, is configured")
@@ -152,6 +189,13 @@ func (sh *SysAuth) DisableUnconfiguredAuths() error {
 		} else if authMount.Type == "token" {
 			continue // cannot be disabled, would give http 400 if attempted
 		} else {
+			if !sh.recordChange(plan.Change{
+				Path:   "sys/auth/" + path,
+				Action: plan.Delete,
+				Before: authMount,
+			}) {
+				continue
+			}
 			logger.Infof("Disabling auth mount")
 			err := sh.client.DisableAuth(path)
 			if err != nil {
@@ -162,19 +206,55 @@ func (sh *SysAuth) DisableUnconfiguredAuths() error {
 	return nil
 }
 
-// return true if the localConfig is reflected in remoteConfig, else false
-func (sh *SysAuth) isConfigApplied(localConfig vaultApi.AuthConfigInput, remoteConfig vaultApi.AuthConfigOutput) (error, bool) {
+// Return the auth mount that enableOpts should result in, for comparing with the live one
+func configuredAuthMount(enableOpts vaultApi.EnableAuthOptions) (vaultApi.AuthMount, error) {
 	// AuthConfigInput uses different types for TTL, which need to be converted
-	converted, err := ConvertAuthConfig(localConfig)
+	config, err := ConvertAuthConfig(enableOpts.Config)
 	if err != nil {
-		return err, false
+		return vaultApi.AuthMount{}, err
 	}
+	return vaultApi.AuthMount{
+		Type:        enableOpts.Type,
+		Description: enableOpts.Description,
+		Config:      config,
+		Local:       enableOpts.Local,
+		SealWrap:    enableOpts.SealWrap,
+		Options:     enableOpts.Options,
+	}, nil
+}
+
+// Determine whether the live auth mount must be disabled and enabled again to match the configured
+// one, as opposed to tuned
+func requiresRemount(configured *vaultApi.AuthMount, live *vaultApi.AuthMount) bool {
+	return configured.Type != live.Type ||
+		configured.Local != live.Local ||
+		configured.SealWrap != live.SealWrap
+}
+
+// Return the body of a sys/auth/<path>/tune request for enableOpts
+func authTuneData(enableOpts vaultApi.EnableAuthOptions) map[string]interface{} {
+	data := map[string]interface{}{
+		"description":                  enableOpts.Description,
+		"default_lease_ttl":            tuneTtl(enableOpts.Config.DefaultLeaseTTL),
+		"max_lease_ttl":                tuneTtl(enableOpts.Config.MaxLeaseTTL),
+		"audit_non_hmac_request_keys":  enableOpts.Config.AuditNonHMACRequestKeys,
+		"audit_non_hmac_response_keys": enableOpts.Config.AuditNonHMACResponseKeys,
+		"listing_visibility":           enableOpts.Config.ListingVisibility,
+		"passthrough_request_headers":  enableOpts.Config.PassthroughRequestHeaders,
+	}
+	if enableOpts.Options != nil {
+		data["options"] = enableOpts.Options
+	}
+	return data
+}
 
-	if reflect.DeepEqual(converted, remoteConfig) {
-		return nil, true
-	} else {
-		return nil, false
+// An empty ttl is left unchanged by the tune endpoint, so it must be reset to the system default
+// explicitly
+func tuneTtl(ttl string) string {
+	if ttl == "" {
+		return "system"
 	}
+	return ttl
 }
 
 func (sh *SysAuth) Order() int {
@@ -187,26 +267,15 @@ func (sh *SysAuth) Order() int {
 // does use this same method)
 func ConvertAuthConfig(input vaultApi.AuthConfigInput) (vaultApi.AuthConfigOutput, error) {
 	var output vaultApi.AuthConfigOutput
-	var dur time.Duration
-	var err error
 
-	var DefaultLeaseTTL int // was string
-
-	if input.DefaultLeaseTTL != "" {
-		dur, err = time.ParseDuration(input.DefaultLeaseTTL)
-		if err != nil {
-			return output, fmt.Errorf("could not parse DefaultLeaseTTL value %s as seconds: %s", input.DefaultLeaseTTL, err)
-		}
-		DefaultLeaseTTL = int(dur.Seconds())
+	DefaultLeaseTTL, err := ttlSeconds("DefaultLeaseTTL", input.DefaultLeaseTTL) // was string
+	if err != nil {
+		return output, err
 	}
 
-	var MaxLeaseTTL int // was string
-	if input.MaxLeaseTTL != "" {
-		dur, err = time.ParseDuration(input.MaxLeaseTTL)
-		if err != nil {
-			return output, fmt.Errorf("could not parse MaxLeaseTTL value %s as seconds: %s", input.MaxLeaseTTL, err)
-		}
-		MaxLeaseTTL = int(dur.Seconds())
+	MaxLeaseTTL, err := ttlSeconds("MaxLeaseTTL", input.MaxLeaseTTL) // was string
+	if err != nil {
+		return output, err
 	}
 
 	output = vaultApi.AuthConfigOutput{
@@ -221,3 +290,15 @@ func ConvertAuthConfig(input vaultApi.AuthConfigInput) (vaultApi.AuthConfigOutpu
 
 	return output, nil
 }
+
+// Convert a ttl string such as "1h" to seconds, as returned by Vault. Empty strings are zero.
+func ttlSeconds(name string, ttl string) (int, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s value %s as seconds: %s", name, ttl, err)
+	}
+	return int(dur.Seconds()), nil
+}
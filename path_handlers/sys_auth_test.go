@@ -2,9 +2,12 @@ package path_handlers
 
 import (
 	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/safety"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -27,12 +30,88 @@ func TestSysAuth_EnsureAuth(t *testing.T) {
 	}
 
 	enableOpts := vaultApi.EnableAuthOptions{}
-	err = sh.ensureAuth("foo", enableOpts)
+	err = sh.ensureAuth("foo", "foo.json", enableOpts)
 	if err != nil {
 		t.Errorf("Error calling ensureAuth: %s", err)
 	}
 }
 
+// Records the auth mount calls made, so that tuning can be told apart from re-enabling
+type authCallClient struct {
+	vault.MockClient
+	calls []string
+}
+
+func (c *authCallClient) EnableAuth(path string, options *vaultApi.EnableAuthOptions) error {
+	c.calls = append(c.calls, "EnableAuth")
+	return nil
+}
+
+func (c *authCallClient) DisableAuth(path string) error {
+	c.calls = append(c.calls, "DisableAuth")
+	return nil
+}
+
+func (c *authCallClient) TuneAuth(path string, data map[string]interface{}) error {
+	c.calls = append(c.calls, "TuneAuth")
+	return nil
+}
+
+func TestSysAuth_EnsureAuth_Changes(t *testing.T) {
+	live := &vaultApi.AuthMount{
+		Type:        "approle",
+		Description: "old",
+		Config:      vaultApi.AuthConfigOutput{DefaultLeaseTTL: 60},
+	}
+	tests := []struct {
+		name          string
+		enableOpts    vaultApi.EnableAuthOptions
+		allowRemount  bool
+		expectedCalls []string
+		expectError   bool
+	}{
+		{
+			name: "unchanged",
+			enableOpts: vaultApi.EnableAuthOptions{Type: "approle", Description: "old",
+				Config: vaultApi.AuthConfigInput{DefaultLeaseTTL: "1m"}},
+		},
+		{
+			name: "description and ttl changed",
+			enableOpts: vaultApi.EnableAuthOptions{Type: "approle", Description: "new",
+				Config: vaultApi.AuthConfigInput{DefaultLeaseTTL: "2m"}},
+			expectedCalls: []string{"TuneAuth"},
+		},
+		{
+			name:        "type changed",
+			enableOpts:  vaultApi.EnableAuthOptions{Type: "userpass", Description: "old"},
+			expectError: true,
+		},
+		{
+			name:          "local changed with remount allowed",
+			enableOpts:    vaultApi.EnableAuthOptions{Type: "approle", Local: true},
+			allowRemount:  true,
+			expectedCalls: []string{"DisableAuth", "EnableAuth"},
+		},
+	}
+
+	for _, test := range tests {
+		client := &authCallClient{}
+		sh, err := NewSysAuthHandler(client, PathHandlerConfig{AllowAuthRemount: test.allowRemount})
+		if err != nil {
+			t.Fatalf("Failed to create SysAuth: %s", err)
+		}
+		sh.liveAuthMap = map[string]*vaultApi.AuthMount{"approle/": live}
+
+		err = sh.ensureAuth("approle/", "approle.json", test.enableOpts)
+		if test.expectError != (err != nil) {
+			t.Errorf("%s: unexpected error result %v", test.name, err)
+		}
+		if !reflect.DeepEqual(client.calls, test.expectedCalls) {
+			t.Errorf("%s: expected calls %v, got %v", test.name, test.expectedCalls, client.calls)
+		}
+	}
+}
+
 func TestSysAuth_PutPoliciesFromDir_Empty(t *testing.T) {
 	// Should do nothing without error
 	client := &vault.MockClient{}
@@ -63,6 +142,34 @@ func TestSysAuth_PutPoliciesFromDir_Example(t *testing.T) {
 	}
 }
 
+// Auth mounts outside the managed paths, or protected ones, are left enabled
+func TestSysAuth_DisableUnconfiguredAuths_safety(t *testing.T) {
+	changes := plan.NewChangeSet()
+	sh, err := NewSysAuthHandler(&vault.MockClient{}, PathHandlerConfig{
+		Changes: changes,
+		Safety: &safety.Rules{
+			Protected: []string{"sys/auth/ldap"},
+			Managed:   []string{"sys/auth/approle*", "sys/auth/ldap"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysAuth: %s", err)
+	}
+	sh.liveAuthMap = map[string]*vaultApi.AuthMount{
+		"approle/": {Type: "approle"},
+		"aws/":     {Type: "aws"},
+		"ldap/":    {Type: "ldap"},
+	}
+
+	err = sh.DisableUnconfiguredAuths()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Path != "sys/auth/approle/" {
+		t.Errorf("Expected only sys/auth/approle/ to be disabled, got %+v", changes.Changes)
+	}
+}
+
 func TestSysAuth_WalkFile(t *testing.T) {
 	//client := &vaultClient.MockClient{}
 	//sh, err := NewSysAuthHandler(client, "")
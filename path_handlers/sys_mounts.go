@@ -0,0 +1,264 @@
+package path_handlers
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/vault"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	SysMounts handles the mounting and tuning of secret engines, described in the configuration
+	under sys/mounts. Each file is a MountInput, e.g. sys/mounts/pki.json mounts at pki/.
+
+	A mount whose config differs is tuned rather than remounted, as remounting would destroy the
+	data stored in it. For the same reason, changing the type of a mount is refused, and undeclared
+	mounts are only unmounted if AllowUnmount is set.
+*/
+type SysMounts struct {
+	BaseHandler
+	liveMountMap       map[string]*vaultApi.MountOutput
+	configuredMountMap map[string]*vaultApi.MountOutput
+}
+
+// Mount types which are built in to Vault and cannot be unmounted
+var systemMountTypes = map[string]bool{
+	"cubbyhole": true,
+	"identity":  true,
+	"system":    true,
+}
+
+func NewSysMountsHandler(client vault.Vault, config PathHandlerConfig) (*SysMounts, error) {
+	// Build a map of currently mounted secret engines, so walkFile() can reference it
+	liveMountMap, err := client.ListMounts()
+	if err != nil {
+		return &SysMounts{}, err
+	}
+
+	return &SysMounts{
+		BaseHandler: BaseHandler{
+			name:   "SysMounts",
+			client: client,
+			config: config,
+			order:  config.Order,
+			log: log.WithFields(log.Fields{
+				"handler": "SysMounts",
+			}),
+		},
+		liveMountMap:       liveMountMap,
+		configuredMountMap: make(map[string]*vaultApi.MountOutput),
+	}, nil
+}
+
+func (sh *SysMounts) walkFile(path string, f os.FileInfo, err error) error {
+	if f == nil {
+		logger := sh.log.WithFields(log.Fields{"path": path, "error": err})
+		logger.Debug("Path does not exist, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+	// not doing anything with dirs
+	if f.IsDir() {
+		return nil
+	}
+
+	mountPath, err := apiPath(sh.config.DocumentPath, path)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mountPath, "sys/mounts") {
+		return fmt.Errorf("found file without sys/mounts prefix: %s", mountPath)
+	}
+
+	fileContents, err := sh.readFile(path)
+	if err != nil {
+		return err
+	}
+
+	var mountInput vaultApi.MountInput
+	err = document.Decode(f.Name(), fileContents, &mountInput)
+	if err != nil {
+		return fmt.Errorf("could not parse document from file %s: %s", path, err)
+	}
+
+	sysMountPath := strings.TrimPrefix(mountPath, "sys/mounts/") + "/"
+	err = sh.ensureMount(sysMountPath, f.Name(), mountInput)
+	if err != nil {
+		return fmt.Errorf("error while ensuring mount for path %s: %s", path, err)
+	}
+
+	return nil
+}
+
+func (sh *SysMounts) PutPoliciesFromDir(path string) error {
+	err := filepath.Walk(path, sh.walkFile)
+	if err != nil {
+		return err
+	}
+	return sh.UnmountUnconfigured()
+}
+
+// Ensure that this secret engine is mounted and has the correct configuration
+func (sh *SysMounts) ensureMount(path string, sourceFile string, mountInput vaultApi.MountInput) error {
+	// we need to convert to MountConfigOutput in order to compare with existing config
+	configOutput, err := ConvertMountConfig(mountInput.Config)
+	if err != nil {
+		return err
+	}
+
+	mount := vaultApi.MountOutput{
+		Type:        mountInput.Type,
+		Description: mountInput.Description,
+		Config:      configOutput,
+		Options:     mountOptions(mountInput),
+	}
+	sh.configuredMountMap[path] = &mount
+
+	logger := sh.log.WithFields(log.Fields{
+		"mount path": path,
+		"mount.Type": mountInput.Type,
+	})
+
+	change := plan.Change{
+		Path:       "sys/mounts/" + path,
+		Action:     plan.Create,
+		SourceFile: sourceFile,
+		After:      mountInput,
+	}
+	liveMount, ok := sh.liveMountMap[path]
+	if !ok {
+		if !sh.recordChange(change) {
+			return nil
+		}
+		logger.Infof("Mounting secret engine")
+		err = sh.client.Mount(path, &mountInput)
+		if err != nil {
+			return fmt.Errorf("could not mount %s: %s", path, err)
+		}
+		return nil
+	}
+
+	if liveMount.Type != mountInput.Type {
+		return fmt.Errorf("mount %s has type %s but is configured as %s; changing the type "+
+			"would destroy its data, so it must be unmounted by hand", path, liveMount.Type,
+			mountInput.Type)
+	}
+	diff := mountDiff(&mount, liveMount)
+	if len(diff) == 0 {
+		logger.Debugf("Mount configuration already applied")
+		sh.recordResult(change.Path, report.Unchanged, sourceFile)
+		return nil
+	}
+
+	change.Action = plan.Update
+	change.Before = liveMount
+	change.Diff = diff
+	if !sh.recordChange(change) {
+		return nil
+	}
+
+	logger.Infof("Tuning secret engine")
+	err = sh.client.TuneMount(path, tuneConfig(mountInput))
+	if err != nil {
+		return fmt.Errorf("could not tune mount %s: %s", path, err)
+	}
+	return nil
+}
+
+func (sh *SysMounts) UnmountUnconfigured() error {
+	// unmount entries not in configured list
+	for _, path := range sortedNames(sh.liveMountMap) {
+		mount := sh.liveMountMap[path]
+		logger := log.WithFields(log.Fields{"mount.Type": mount.Type, "path": path})
+		if _, ok := sh.configuredMountMap[path]; ok {
+			logger.Debugf("Not unmounting secret engine, is configured")
+			continue // present, do nothing
+		} else if systemMountTypes[mount.Type] {
+			continue // cannot be unmounted, would give http 400 if attempted
+		}
+		if !sh.config.AllowUnmount {
+			logger.Warnf("Not unmounting secret engine, as that would delete its secrets. " +
+				"Declare it, or use --allow-unmount")
+			sh.recordResult("sys/mounts/"+path, report.SkippedProtected, "")
+			continue
+		}
+
+		if !sh.recordChange(plan.Change{
+			Path:   "sys/mounts/" + path,
+			Action: plan.Delete,
+			Before: mount,
+		}) {
+			continue
+		}
+		logger.Infof("Unmounting secret engine")
+		err := sh.client.Unmount(path)
+		if err != nil {
+			return fmt.Errorf("failed to unmount %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Return the options of a mount. They may be declared either at the top level of a mount, as they
+// are when mounting, or in the config, as they are when tuning, which takes precedence.
+func mountOptions(mountInput vaultApi.MountInput) map[string]string {
+	if mountInput.Config.Options == nil {
+		return mountInput.Options
+	}
+	options := map[string]string{}
+	for k, v := range mountInput.Options {
+		options[k] = v
+	}
+	for k, v := range mountInput.Config.Options {
+		options[k] = v
+	}
+	return options
+}
+
+// Return the config to tune a mount with, including its description, which is tuned with it. As
+// with auth mounts, ttls which are not declared are reset to the system default.
+func tuneConfig(mountInput vaultApi.MountInput) vaultApi.MountConfigInput {
+	config := mountInput.Config
+	config.DefaultLeaseTTL = tuneTtl(config.DefaultLeaseTTL)
+	config.MaxLeaseTTL = tuneTtl(config.MaxLeaseTTL)
+	config.Description = &mountInput.Description
+	config.Options = mountOptions(mountInput)
+	return config
+}
+
+// convert MountConfigInput type to MountConfigOutput type, converting ttls in the same way as
+// ConvertAuthConfig
+func ConvertMountConfig(input vaultApi.MountConfigInput) (vaultApi.MountConfigOutput, error) {
+	var output vaultApi.MountConfigOutput
+
+	DefaultLeaseTTL, err := ttlSeconds("DefaultLeaseTTL", input.DefaultLeaseTTL) // was string
+	if err != nil {
+		return output, err
+	}
+
+	MaxLeaseTTL, err := ttlSeconds("MaxLeaseTTL", input.MaxLeaseTTL) // was string
+	if err != nil {
+		return output, err
+	}
+
+	output = vaultApi.MountConfigOutput{
+		DefaultLeaseTTL:           DefaultLeaseTTL,
+		MaxLeaseTTL:               MaxLeaseTTL,
+		ForceNoCache:              input.ForceNoCache,
+		PluginName:                input.PluginName,
+		AuditNonHMACRequestKeys:   input.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys:  input.AuditNonHMACResponseKeys,
+		ListingVisibility:         input.ListingVisibility,
+		PassthroughRequestHeaders: input.PassthroughRequestHeaders,
+	}
+
+	return output, nil
+}
@@ -0,0 +1,189 @@
+package path_handlers
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/vault"
+	"path/filepath"
+	"testing"
+)
+
+func TestSysMounts_PutPoliciesFromDir_Example(t *testing.T) {
+	client := &vault.MockClient{}
+	sh, err := NewSysMountsHandler(client, PathHandlerConfig{
+		DocumentPath: examplePath(),
+	})
+	if err != nil {
+		t.Errorf("Failed to create SysMounts: %s", err)
+	}
+
+	sysPath := filepath.Join(examplePath(), "sys/mounts")
+	err = sh.PutPoliciesFromDir(sysPath)
+
+	if err != nil {
+		t.Errorf("Expected no error, got %q", err)
+	}
+}
+
+// A mount with different config should be tuned, and system mounts should never be unmounted
+func TestSysMounts_PutPoliciesFromDir_Tune(t *testing.T) {
+	changes := plan.NewChangeSet()
+	sh, err := NewSysMountsHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: examplePath(),
+		Changes:      changes,
+		AllowUnmount: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysMounts: %s", err)
+	}
+	sh.liveMountMap = map[string]*vaultApi.MountOutput{
+		"cubbyhole/": {Type: "cubbyhole"},
+		"secret/": {
+			Type:        "kv",
+			Description: "Key/value secrets",
+			Options:     map[string]string{"version": "1"},
+		},
+		"transit/": {Type: "transit", Config: vaultApi.MountConfigOutput{DefaultLeaseTTL: 60}},
+		"old/":     {Type: "kv"},
+	}
+
+	err = sh.PutPoliciesFromDir(filepath.Join(examplePath(), "sys/mounts"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	expected := map[string]plan.Action{
+		"sys/mounts/transit/": plan.Update,
+		"sys/mounts/old/":     plan.Delete,
+	}
+	if len(changes.Changes) != len(expected) {
+		t.Errorf("Expected %d changes, got %+v", len(expected), changes.Changes)
+	}
+	for _, c := range changes.Changes {
+		if expected[c.Path] != c.Action {
+			t.Errorf("Unexpected change %s for %s", c.Action, c.Path)
+		}
+	}
+}
+
+// Unmounting deletes the secrets in a mount, so undeclared mounts are left alone unless allowed
+func TestSysMounts_UnmountUnconfigured_notAllowed(t *testing.T) {
+	changes := plan.NewChangeSet()
+	runReport := report.New(false)
+	runReport.StartHandler("SysMounts", "sys/mounts", "")
+	sh, err := NewSysMountsHandler(&vault.MockClient{}, PathHandlerConfig{
+		Changes: changes,
+		Report:  runReport,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysMounts: %s", err)
+	}
+	sh.liveMountMap = map[string]*vaultApi.MountOutput{"old/": {Type: "kv"}}
+
+	err = sh.UnmountUnconfigured()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(changes.Changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes.Changes)
+	}
+	paths := runReport.Handlers[0].Paths
+	if len(paths) != 1 || paths[0].Action != report.SkippedProtected {
+		t.Errorf("Expected sys/mounts/old/ to be skipped, got %+v", paths)
+	}
+}
+
+func TestSysMounts_ensureMount_typeChange(t *testing.T) {
+	sh, err := NewSysMountsHandler(&vault.MockClient{}, PathHandlerConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create SysMounts: %s", err)
+	}
+	sh.liveMountMap = map[string]*vaultApi.MountOutput{"secret/": {Type: "kv"}}
+
+	err = sh.ensureMount("secret/", "secret.json", vaultApi.MountInput{Type: "pki"})
+	if err == nil {
+		t.Errorf("Expected error when changing mount type")
+	}
+}
+
+func TestMountDiff_applied(t *testing.T) {
+	config, err := ConvertMountConfig(vaultApi.MountConfigInput{DefaultLeaseTTL: "1h"})
+	if err != nil {
+		t.Fatalf("Error converting config: %s", err)
+	}
+	configured := &vaultApi.MountOutput{
+		Type:    "kv",
+		Config:  config,
+		Options: map[string]string{"version": "2"},
+	}
+	live := &vaultApi.MountOutput{
+		Type:    "kv",
+		Config:  vaultApi.MountConfigOutput{DefaultLeaseTTL: 3600},
+		Options: map[string]string{"version": "2", "other": "x"},
+	}
+	// lists which are not configured are returned empty by Vault
+	live.Config.AuditNonHMACRequestKeys = []string{}
+	if diff := mountDiff(configured, live); len(diff) != 0 {
+		t.Errorf("Expected mount to be applied, got %v", diff)
+	}
+
+	live.Options["version"] = "1"
+	if len(mountDiff(configured, live)) == 0 {
+		t.Errorf("Expected mount with different options not to be applied")
+	}
+
+	live.Options["version"] = "2"
+	live.Description = "old"
+	if len(mountDiff(configured, live)) == 0 {
+		t.Errorf("Expected mount with different description not to be applied")
+	}
+}
+
+// Options declared in the config should be compared, and the description tuned with the config
+func TestSysMounts_ensureMount_descriptionAndOptions(t *testing.T) {
+	changes := plan.NewChangeSet()
+	sh, err := NewSysMountsHandler(&vault.MockClient{}, PathHandlerConfig{Changes: changes})
+	if err != nil {
+		t.Fatalf("Failed to create SysMounts: %s", err)
+	}
+	sh.liveMountMap = map[string]*vaultApi.MountOutput{
+		"secret/": {Type: "kv", Description: "old", Options: map[string]string{"version": "1"}},
+	}
+	mountInput := vaultApi.MountInput{
+		Type:        "kv",
+		Description: "new",
+		Config: vaultApi.MountConfigInput{
+			Options: map[string]string{"version": "2"},
+		},
+	}
+
+	err = sh.ensureMount("secret/", "secret.json", mountInput)
+	if err != nil {
+		t.Fatalf("Error calling ensureMount: %s", err)
+	}
+	if len(changes.Changes) != 1 || len(changes.Changes[0].Diff) != 2 {
+		t.Fatalf("Expected description and options.version to be changed, got %+v",
+			changes.Changes)
+	}
+
+	config := tuneConfig(mountInput)
+	if config.Description == nil || *config.Description != "new" {
+		t.Errorf("Expected description to be tuned, got %v", config.Description)
+	}
+	if config.Options["version"] != "2" {
+		t.Errorf("Expected options to be tuned, got %+v", config.Options)
+	}
+}
+
+// A ttl removed from a document should be reset, as the tune endpoint leaves empty ones unchanged
+func TestTuneConfig_ttls(t *testing.T) {
+	config := tuneConfig(vaultApi.MountInput{
+		Type:   "transit",
+		Config: vaultApi.MountConfigInput{MaxLeaseTTL: "24h"},
+	})
+	if config.DefaultLeaseTTL != "system" || config.MaxLeaseTTL != "24h" {
+		t.Errorf("Expected ttls system and 24h, got %q and %q", config.DefaultLeaseTTL,
+			config.MaxLeaseTTL)
+	}
+}
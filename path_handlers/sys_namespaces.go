@@ -0,0 +1,124 @@
+package path_handlers
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+)
+
+/*
+	SysNamespaces creates and deletes Vault Enterprise namespaces, declared as directories under
+	_namespaces, e.g. _namespaces/team-a declares the namespace team-a. The documents within each
+	directory are applied to its namespace by a ConfigWalker of their own, so this handler only
+	ensures that the namespaces themselves exist.
+
+	Deleting a namespace deletes everything within it, so undeclared namespaces are only deleted
+	when a _namespaces directory is present.
+*/
+type SysNamespaces struct {
+	BaseHandler
+	liveNamespaces       map[string]bool
+	configuredNamespaces map[string]bool
+}
+
+func NewSysNamespacesHandler(client vault.Vault, config PathHandlerConfig) (*SysNamespaces, error) {
+	// Build a set of existing namespaces, so PutPoliciesFromDir() can reference it
+	names, err := client.ListNamespaces()
+	if err != nil {
+		return &SysNamespaces{}, err
+	}
+	liveNamespaces := map[string]bool{}
+	for _, name := range names {
+		liveNamespaces[name] = true
+	}
+
+	return &SysNamespaces{
+		BaseHandler: BaseHandler{
+			name:   "SysNamespaces",
+			client: client,
+			config: config,
+			order:  config.Order,
+			log: log.WithFields(log.Fields{
+				"handler": "SysNamespaces",
+			}),
+		},
+		liveNamespaces:       liveNamespaces,
+		configuredNamespaces: map[string]bool{},
+	}, nil
+}
+
+func (sh *SysNamespaces) PutPoliciesFromDir(path string) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+	for _, f := range entries {
+		if !f.IsDir() {
+			sh.log.WithField("file", f.Name()).Warn("Ignoring file, namespaces are directories")
+			continue
+		}
+		err = sh.ensureNamespace(f.Name())
+		if err != nil {
+			return fmt.Errorf("error while ensuring namespace %s: %s", f.Name(), err)
+		}
+	}
+	return sh.DeleteUndeclaredNamespaces()
+}
+
+// Ensure that this namespace exists
+func (sh *SysNamespaces) ensureNamespace(name string) error {
+	sh.configuredNamespaces[name] = true
+	path := "sys/namespaces/" + name
+
+	logger := sh.log.WithField("namespace", name)
+	if sh.liveNamespaces[name] {
+		logger.Debug("Namespace already exists")
+		sh.recordResult(path, report.Unchanged, "")
+		return nil
+	}
+
+	if !sh.recordChange(plan.Change{
+		Path:   path,
+		Action: plan.Create,
+	}) {
+		return nil
+	}
+	logger.Info("Creating namespace")
+	return sh.client.CreateNamespace(name)
+}
+
+func (sh *SysNamespaces) DeleteUndeclaredNamespaces() error {
+	for _, name := range sortedNames(sh.liveNamespaces) {
+		logger := sh.log.WithField("namespace", name)
+		if sh.configuredNamespaces[name] {
+			continue // present, do nothing
+		}
+
+		if !sh.recordChange(plan.Change{
+			Path:   "sys/namespaces/" + name,
+			Action: plan.Delete,
+			Before: name,
+		}) {
+			continue
+		}
+		logger.Info("Deleting namespace")
+		err := sh.client.DeleteNamespace(name)
+		if err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Return the declared namespaces, in order
+func (sh *SysNamespaces) Namespaces() []string {
+	return sortedNames(sh.configuredNamespaces)
+}
+
+// true if the namespace existed before this handler ran
+func (sh *SysNamespaces) Exists(name string) bool {
+	return sh.liveNamespaces[name]
+}
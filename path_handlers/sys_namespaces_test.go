@@ -0,0 +1,84 @@
+package path_handlers
+
+import (
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Has the namespaces in live, and records the namespaces created and deleted
+type namespaceCallClient struct {
+	vault.MockClient
+	live  []string
+	calls []string
+}
+
+func (c *namespaceCallClient) ListNamespaces() ([]string, error) {
+	return c.live, nil
+}
+
+func (c *namespaceCallClient) CreateNamespace(name string) error {
+	c.calls = append(c.calls, "CreateNamespace "+name)
+	return nil
+}
+
+func (c *namespaceCallClient) DeleteNamespace(name string) error {
+	c.calls = append(c.calls, "DeleteNamespace "+name)
+	return nil
+}
+
+func TestSysNamespaces_PutPoliciesFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"team-a", "team-b"} {
+		err = os.Mkdir(filepath.Join(dir, name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files are not namespaces
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("namespaces"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &namespaceCallClient{live: []string{"old", "team-a"}}
+	changes := plan.NewChangeSet()
+	sh, err := NewSysNamespacesHandler(client, PathHandlerConfig{Changes: changes, Namespace: "org"})
+	if err != nil {
+		t.Fatalf("Failed to create SysNamespaces: %s", err)
+	}
+
+	err = sh.PutPoliciesFromDir(dir)
+	if err != nil {
+		t.Fatalf("Error calling PutPoliciesFromDir: %s", err)
+	}
+
+	expectedCalls := []string{"CreateNamespace team-b", "DeleteNamespace old"}
+	if !reflect.DeepEqual(client.calls, expectedCalls) {
+		t.Errorf("Expected calls %v, got %v", expectedCalls, client.calls)
+	}
+	expectedNamespaces := []string{"team-a", "team-b"}
+	if !reflect.DeepEqual(sh.Namespaces(), expectedNamespaces) {
+		t.Errorf("Expected namespaces %v, got %v", expectedNamespaces, sh.Namespaces())
+	}
+	if sh.Exists("team-b") {
+		t.Errorf("Expected team-b not to have existed before the handler ran")
+	}
+
+	var paths []string
+	for _, c := range changes.Changes {
+		paths = append(paths, c.FullPath())
+	}
+	expectedPaths := []string{"org/sys/namespaces/team-b", "org/sys/namespaces/old"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Expected changes to %v, got %v", expectedPaths, paths)
+	}
+}
@@ -1,21 +1,23 @@
 package path_handlers
 
 import (
-	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/starlingbank/vaultsmith/document"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
 	"github.com/starlingbank/vaultsmith/vault"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strings"
+	"sync"
 )
 
 /*
 	SysPolicy handles the creation/enabling of auth methods and policies, described in the
 	configuration under sys
 
+	Policies are either documents with a "policy" key, or .hcl files containing only the policy.
 	Unlike SysAuthHandler, it supports templating
 */
 
@@ -27,7 +29,11 @@ var fixedPolicies = map[string]bool{
 
 type SysPolicy struct {
 	BaseHandler
-	livePolicyList       []string
+	livePolicyList []string
+	policies       []policy // policies found by walkFile, ensured once the walk is done
+
+	// updated by the workers which ensure policies
+	mutex                sync.Mutex
 	configuredPolicyList []string
 }
 
@@ -103,50 +109,115 @@ func (sh *SysPolicy) walkFile(path string, f os.FileInfo, err error) error {
 			Name:       td.Name,
 			SourceFile: f.Name(),
 		}
-		err = json.Unmarshal([]byte(td.Content), &policy)
-		if err != nil {
-			return fmt.Errorf("failed to parse json from %s: %s", path, err)
+		if filepath.Ext(path) == ".hcl" {
+			// the whole file is the policy
+			policy.Policy = td.Content
+		} else {
+			err = document.Decode(f.Name(), td.Content, &policy)
+			if err != nil {
+				return fmt.Errorf("failed to parse document from %s: %s", path, err)
+			}
 		}
 
-		err = sh.EnsurePolicy(policy)
+		// check the policy before uploading, as Vault's errors don't say which file is wrong
+		_, err = parsePolicy(policy.Policy)
 		if err != nil {
-			return fmt.Errorf("failed to apply policy at %s: %s", apiPath, err)
+			return fmt.Errorf("invalid policy %s in %s: %s", policy.Name, path, err)
 		}
+
+		sh.policies = append(sh.policies, policy)
 	}
 
 	return nil
 }
 
 func (sh *SysPolicy) PutPoliciesFromDir(path string) error {
+	sh.policies = nil
 	err := filepath.Walk(path, sh.walkFile)
 	if err != nil {
 		return err
 	}
+	err = sh.ensurePolicies(sh.policies)
+	if err != nil {
+		return err
+	}
 	_, err = sh.RemoveUndeclaredPolicies()
 	return err
 }
 
-func (sh *SysPolicy) EnsurePolicy(policy policy) error {
-	logger := sh.log.WithFields(log.Fields{
-		"name":       policy.Name,
-		"sourceFile": policy.SourceFile,
+func (sh *SysPolicy) EnsurePolicy(p policy) error {
+	return sh.ensurePolicies([]policy{p})
+}
+
+// Ensure the policies are applied, with up to config.Workers requests to Vault at once. The
+// outcomes are recorded in the order of policies, so that they do not depend on timing.
+func (sh *SysPolicy) ensurePolicies(policies []policy) error {
+	changes := make([]*plan.Change, len(policies))
+	err := forEach(sh.config.Workers, len(policies), func(i int) (err error) {
+		changes[i], err = sh.planPolicy(policies[i])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var writes []policy
+	for i, policy := range policies {
+		if changes[i] == nil {
+			sh.recordResult("sys/policy/"+policy.Name, report.Unchanged, policy.SourceFile)
+		} else if sh.recordChange(*changes[i]) {
+			writes = append(writes, policy)
+		}
+	}
+
+	return forEach(sh.config.Workers, len(writes), func(i int) error {
+		sh.log.WithFields(log.Fields{
+			"name":       writes[i].Name,
+			"sourceFile": writes[i].SourceFile,
+		}).Info("Applying policy")
+		err := sh.client.PutPolicy(writes[i].Name, writes[i].Policy)
+		if err != nil {
+			return fmt.Errorf("failed to apply policy %s: %s", writes[i].Name, err)
+		}
+		return nil
 	})
+}
 
+// Compare the policy with the one in Vault, and return the change which applies it, or nil if it
+// is already applied
+func (sh *SysPolicy) planPolicy(policy policy) (*plan.Change, error) {
+	sh.mutex.Lock()
 	sh.configuredPolicyList = append(sh.configuredPolicyList, policy.Name)
-	applied, err := sh.isPolicyApplied(policy)
+	sh.mutex.Unlock()
+
+	applied, livePolicy, err := sh.isPolicyApplied(policy)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if applied {
-		logger.Debugf("Policy already applied")
-		return nil
+		sh.log.WithFields(log.Fields{
+			"name":       policy.Name,
+			"sourceFile": policy.SourceFile,
+		}).Debugf("Policy already applied")
+		return nil, nil
+	}
+
+	change := plan.Change{
+		Path:       "sys/policy/" + policy.Name,
+		Action:     plan.Create,
+		SourceFile: policy.SourceFile,
+		After:      policy.Policy,
+	}
+	if sh.policyExists(policy) {
+		change.Action = plan.Update
+		change.Before = livePolicy
 	}
-	logger.Info("Applying policy")
-	return sh.client.PutPolicy(policy.Name, policy.Policy)
+	change.Diff = policyDiff(policy.Name, policy.Policy, livePolicy)
+	return &change, nil
 }
 
 func (sh *SysPolicy) RemoveUndeclaredPolicies() (deleted []string, err error) {
-	// only real reason to track the deleted policies is for testing as logs inform user
+	var undeclared []string
 	for _, liveName := range sh.livePolicyList {
 		if fixedPolicies[liveName] {
 			// never want to delete default or root
@@ -164,12 +235,40 @@ func (sh *SysPolicy) RemoveUndeclaredPolicies() (deleted []string, err error) {
 
 		if !found {
 			// not declared, delete
-			sh.log.WithFields(log.Fields{"policy": liveName}).Infof("Deleting policy")
-			sh.client.DeletePolicy(liveName)
-			deleted = append(deleted, liveName)
+			undeclared = append(undeclared, liveName)
+		}
+	}
+
+	// the current value is kept for backups and plans, so must be read before deleting
+	livePolicies := make([]string, len(undeclared))
+	err = forEach(sh.config.Workers, len(undeclared), func(i int) (err error) {
+		livePolicies[i], err = sh.client.GetPolicy(undeclared[i])
+		if err != nil {
+			return fmt.Errorf("could not read policy %s before removal: %s", undeclared[i], err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return deleted, nil
+
+	// only real reason to track the deleted policies is for testing as logs inform user
+	for i, name := range undeclared {
+		if sh.recordChange(plan.Change{
+			Path:   "sys/policy/" + name,
+			Action: plan.Delete,
+			Before: livePolicies[i],
+			Diff:   policyDiff(name, "", livePolicies[i]),
+		}) {
+			deleted = append(deleted, name)
+		}
+	}
+
+	err = forEach(sh.config.Workers, len(deleted), func(i int) error {
+		sh.log.WithFields(log.Fields{"policy": deleted[i]}).Infof("Deleting policy")
+		return sh.client.DeletePolicy(deleted[i])
+	})
+	return deleted, err
 }
 
 // true if the policy exists on the server
@@ -184,24 +283,29 @@ func (sh *SysPolicy) policyExists(policy policy) bool {
 	return false
 }
 
-// true if the policy is applied on the server
-func (sh *SysPolicy) isPolicyApplied(policy policy) (bool, error) {
+// true if the policy is applied on the server. Also returns the policy on the server, which is
+// empty if there is none.
+func (sh *SysPolicy) isPolicyApplied(policy policy) (bool, string, error) {
 	if !sh.policyExists(policy) {
-		return false, nil
+		return false, "", nil
 	}
 
 	remotePolicy, err := sh.client.GetPolicy(policy.Name)
 	if err != nil {
-		return false, nil
+		return false, "", fmt.Errorf("could not read policy %s: %s", policy.Name, err)
 	}
 
-	// TODO Need a proper HCL parser here, testing strings is error prone
-	if reflect.DeepEqual(policy.Policy, remotePolicy) {
-		return true, nil
-	} else {
-		log.Debugf("Policy not equal (local != remote): \n%+v\n!=\n%+v\n", policy.Policy, remotePolicy)
-		return false, nil
+	// compare the permissions granted, so that formatting differences are ignored
+	equivalent, err := isPolicyEquivalent(policy.Policy, remotePolicy)
+	if err != nil {
+		return false, "", fmt.Errorf("invalid policy %s in %s: %s", policy.Name, policy.SourceFile,
+			err)
+	}
+	if !equivalent {
+		log.Debugf("Policy not equal (local != remote):\n%s",
+			strings.Join(policyDiff(policy.Name, policy.Policy, remotePolicy), "\n"))
 	}
+	return equivalent, remotePolicy, nil
 }
 
 func (sh *SysPolicy) Order() int {
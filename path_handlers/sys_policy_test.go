@@ -1,9 +1,16 @@
 package path_handlers
 
 import (
+	"errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/safety"
 	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,18 +60,19 @@ func TestSysPolicyHandler_PolicyExistsFalse(t *testing.T) {
 // isPolicyApplied should return true when the policy is present and the content matches
 func TestSysPolicyHandler_IsPolicyApplied(t *testing.T) {
 	client := &vault.MockClient{}
-	client.ReturnString = "testPolicy"
+	client.ReturnString = `path "secret/*" { capabilities = ["read", "list"] }`
 	sph, err := NewSysPolicyHandler(client, PathHandlerConfig{})
 	if err != nil {
 		t.Errorf("Failed to create SysAuth: %s", err)
 	}
 
+	// formatting and comments differ, but the permissions are the same
 	p := policy{
 		Name:   "testName",
-		Policy: "testPolicy",
+		Policy: "# read secrets\npath \"/secret/*\" {\n  capabilities = [\"list\", \"read\"]\n}\n",
 	}
 	sph.livePolicyList = []string{"testName"}
-	rv, err := sph.isPolicyApplied(p)
+	rv, _, err := sph.isPolicyApplied(p)
 	if err != nil {
 		t.Errorf("Error calling isPolicyApplied: %s", err)
 	}
@@ -76,7 +84,7 @@ func TestSysPolicyHandler_IsPolicyApplied(t *testing.T) {
 // isPolicyApplied should return false when policy is present but content differs
 func TestSysPolicyHandler_IsPolicyApplied_PresentButDifferent(t *testing.T) {
 	client := &vault.MockClient{}
-	client.ReturnString = "testPolicy"
+	client.ReturnString = `path "secret/*" { capabilities = ["read", "list"] }`
 
 	sph, err := NewSysPolicyHandler(client, PathHandlerConfig{})
 	if err != nil {
@@ -85,10 +93,10 @@ func TestSysPolicyHandler_IsPolicyApplied_PresentButDifferent(t *testing.T) {
 
 	p := policy{
 		Name:   "testName",
-		Policy: "this content is different",
+		Policy: `path "secret/*" { capabilities = ["read", "list", "update"] }`,
 	}
 	sph.livePolicyList = []string{"testName"}
-	rv, err := sph.isPolicyApplied(p)
+	rv, _, err := sph.isPolicyApplied(p)
 	if err != nil {
 		t.Errorf("Error calling isPolicyApplied: %s", err)
 	}
@@ -97,6 +105,61 @@ func TestSysPolicyHandler_IsPolicyApplied_PresentButDifferent(t *testing.T) {
 	}
 }
 
+// isPolicyApplied should return an error when the configured policy is not valid
+func TestSysPolicyHandler_IsPolicyApplied_Invalid(t *testing.T) {
+	client := &vault.MockClient{}
+	client.ReturnString = `path "secret/*" { capabilities = ["read"] }`
+
+	sph, err := NewSysPolicyHandler(client, PathHandlerConfig{})
+	if err != nil {
+		t.Errorf("Failed to create SysAuth: %s", err)
+	}
+
+	p := policy{
+		Name:   "testName",
+		Policy: `path "secret/*" { capabilities = ["read"]`,
+	}
+	sph.livePolicyList = []string{"testName"}
+	_, _, err = sph.isPolicyApplied(p)
+	if err == nil {
+		t.Errorf("Expected error for invalid policy")
+	}
+}
+
+// Counts the reads of each policy
+type policyReadsClient struct {
+	vault.MockClient
+	reads int
+}
+
+func (c *policyReadsClient) GetPolicy(name string) (string, error) {
+	c.reads++
+	return c.MockClient.GetPolicy(name)
+}
+
+// A changed policy should be read once, both to compare it and to record its current value
+func TestSysPolicyHandler_planPolicy(t *testing.T) {
+	client := &policyReadsClient{}
+	client.ReturnString = `path "secret/*" { capabilities = ["read"] }`
+	sph, err := NewSysPolicyHandler(client, PathHandlerConfig{})
+	if err != nil {
+		t.Errorf("Failed to create SysPolicy: %s", err)
+	}
+
+	p := policy{Name: "testName", Policy: `path "secret/*" { capabilities = ["read", "list"] }`}
+	sph.livePolicyList = []string{"testName"}
+	change, err := sph.planPolicy(p)
+	if err != nil {
+		t.Fatalf("Error calling planPolicy: %s", err)
+	}
+	if change == nil || change.Action != plan.Update || change.Before != client.ReturnString {
+		t.Errorf("Expected update from the live policy, got %+v", change)
+	}
+	if client.reads != 1 {
+		t.Errorf("Expected policy to be read once, got %d reads", client.reads)
+	}
+}
+
 func TestSysPolicyHandler_RemoveUndeclaredPolicies(t *testing.T) {
 	sph, err := NewSysPolicyHandler(&vault.MockClient{}, PathHandlerConfig{})
 	if err != nil {
@@ -116,3 +179,109 @@ func TestSysPolicyHandler_RemoveUndeclaredPolicies(t *testing.T) {
 			deleted, expected)
 	}
 }
+
+func TestSysPolicyHandler_RemoveUndeclaredPolicies_protected(t *testing.T) {
+	sph, err := NewSysPolicyHandler(&vault.MockClient{}, PathHandlerConfig{
+		Safety: &safety.Rules{Protected: []string{"sys/policy/q*"}},
+	})
+	if err != nil {
+		t.Errorf("Failed to create SysPolicy: %s", err)
+	}
+
+	sph.livePolicyList = []string{"foo", "qux", "bar", "quux"}
+	sph.configuredPolicyList = []string{"foo"}
+
+	expected := []string{"bar"}
+	deleted, err := sph.RemoveUndeclaredPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("List of deleted policies does not match expected (%+v != %+v)",
+			deleted, expected)
+	}
+}
+
+// Policies which cannot be read first are not deleted, as their content would be lost
+func TestSysPolicyHandler_RemoveUndeclaredPolicies_readError(t *testing.T) {
+	client := &vault.MockClient{}
+	sph, err := NewSysPolicyHandler(client, PathHandlerConfig{})
+	if err != nil {
+		t.Errorf("Failed to create SysPolicy: %s", err)
+	}
+
+	sph.livePolicyList = []string{"foo", "qux"}
+	sph.configuredPolicyList = []string{"foo"}
+	client.ReturnError = errors.New("connection refused")
+
+	deleted, err := sph.RemoveUndeclaredPolicies()
+	if err == nil || !strings.Contains(err.Error(), "could not read policy qux") {
+		t.Errorf("Expected error reading policy, got %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Expected no policies deleted, got %+v", deleted)
+	}
+}
+
+// .hcl files should be applied alongside json ones
+func TestSysPolicyHandler_PutPoliciesFromDir_Hcl(t *testing.T) {
+	changes := plan.NewChangeSet()
+	sph, err := NewSysPolicyHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: examplePath(),
+		TemplateFile: filepath.Join(examplePath(), "_vaultsmith.json"),
+		Changes:      changes,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysPolicy: %s", err)
+	}
+
+	err = sph.PutPoliciesFromDir(filepath.Join(examplePath(), "sys", "policy"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	for _, c := range changes.Changes {
+		if c.Path == "sys/policy/list_secrets" {
+			if !strings.Contains(c.After.(string), `capabilities = ["list"]`) {
+				t.Errorf("Unexpected policy for list_secrets: %s", c.After)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected list_secrets to be created, got %+v", changes.Changes)
+}
+
+// .hcl files which do not parse should not be uploaded
+func TestSysPolicyHandler_PutPoliciesFromDir_InvalidHcl(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyDir := filepath.Join(dir, "sys", "policy")
+	err = os.MkdirAll(policyDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(policyDir, "broken.hcl"), []byte(`path "secret/*" {`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := plan.NewChangeSet()
+	sph, err := NewSysPolicyHandler(&vault.MockClient{}, PathHandlerConfig{
+		DocumentPath: dir,
+		Changes:      changes,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SysPolicy: %s", err)
+	}
+
+	err = sph.PutPoliciesFromDir(policyDir)
+	if err == nil || !strings.Contains(err.Error(), "broken.hcl") {
+		t.Errorf("Expected error naming broken.hcl, got %v", err)
+	}
+	if !changes.Empty() {
+		t.Errorf("Expected no changes, got %+v", changes.Changes)
+	}
+}
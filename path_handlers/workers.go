@@ -0,0 +1,60 @@
+package path_handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/*
+	A bounded pool of workers, so that a handler can make its requests to Vault for many paths at
+	once. Results are kept by index, so that the handler can record them in the order the paths were
+	found, whichever order the requests finish in.
+*/
+
+// Call fn for each index from 0 to n - 1, with up to workers calls running at once, and return the
+// errors of all calls which failed, in index order
+func forEach(workers int, n int, fn func(i int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return joinErrors(errs)
+}
+
+// Combine the errors which are not nil into one, or return nil if there are none
+func joinErrors(errs []error) error {
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(failed) == 1 {
+		return failed[0]
+	}
+	messages := make([]string, len(failed))
+	for i, err := range failed {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("%d errors: %s", len(failed), strings.Join(messages, "; "))
+}
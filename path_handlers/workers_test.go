@@ -0,0 +1,61 @@
+package path_handlers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	var mutex sync.Mutex
+	running, most := 0, 0
+	results := make([]int, 20)
+	err := forEach(3, len(results), func(i int) error {
+		mutex.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+		results[i] = i * i
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error calling forEach: %s", err)
+	}
+	if most > 3 {
+		t.Errorf("Expected at most 3 calls at once, got %d", most)
+	}
+	for i, result := range results {
+		if result != i*i {
+			t.Errorf("Expected result %d for index %d, got %d", i*i, i, result)
+		}
+	}
+}
+
+// Every call is made, and all errors are returned in index order
+func TestForEach_errors(t *testing.T) {
+	calls := make([]bool, 5)
+	err := forEach(2, len(calls), func(i int) error {
+		calls[i] = true
+		if i%2 == 1 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "2 errors: failed 1; failed 3" {
+		t.Errorf("Expected both errors, got %v", err)
+	}
+	for i, called := range calls {
+		if !called {
+			t.Errorf("Expected call for index %d", i)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package plan
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Action describes what is done to a path in Vault
+type Action string
+
+const (
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+)
+
+// Order in which actions are listed in summaries
+var actions = []Action{Create, Update, Delete}
+
+// Prefix used for each action when printing a summary
+var actionSymbols = map[Action]string{
+	Create: "+",
+	Update: "~",
+	Delete: "-",
+}
+
+// A Change is a single write or delete that a path handler will make to Vault
+type Change struct {
+	Path       string      `json:"path"`
+	Namespace  string      `json:"namespace,omitempty"` // Vault Enterprise namespace the path is in
+	Action     Action      `json:"action"`
+	Handler    string      `json:"handler"`
+	SourceFile string      `json:"source_file,omitempty"` // document the change was declared in, empty for deletions
+	Before     interface{} `json:"before"`                // live value in Vault, nil when creating
+	After      interface{} `json:"after"`                 // configured value, nil when deleting
+	Diff       []string    `json:"diff,omitempty"`        // human readable differences between Before and After
+}
+
+// The path including its namespace, as it would be addressed in Vault
+func (c Change) FullPath() string {
+	if c.Namespace == "" {
+		return c.Path
+	}
+	return strings.TrimSuffix(c.Namespace, "/") + "/" + c.Path
+}
+
+// A ChangeSet collects the changes made by all handlers during a run
+type ChangeSet struct {
+	Changes []Change
+}
+
+func NewChangeSet() *ChangeSet {
+	return &ChangeSet{
+		Changes: []Change{},
+	}
+}
+
+// Add a change to the set. Safe to call on a nil ChangeSet, in which case the change is discarded;
+// this lets handlers be created without one, e.g. in tests.
+func (cs *ChangeSet) Add(change Change) {
+	if cs == nil {
+		return
+	}
+	cs.Changes = append(cs.Changes, change)
+}
+
+// Return the number of changes with the given action
+func (cs *ChangeSet) Count(action Action) (count int) {
+	if cs == nil {
+		return 0
+	}
+	for _, c := range cs.Changes {
+		if c.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// true if there are no changes in the set
+func (cs *ChangeSet) Empty() bool {
+	return cs == nil || len(cs.Changes) == 0
+}
+
+// Write a human readable summary of the changes, one line per change followed by counts per action
+func (cs *ChangeSet) WriteSummary(w io.Writer) (err error) {
+	if cs.Empty() {
+		_, err = fmt.Fprintln(w, "No changes.")
+		return err
+	}
+
+	for _, c := range cs.Changes {
+		line := fmt.Sprintf("  %s %-6s %s (%s", actionSymbols[c.Action], c.Action, c.FullPath(), c.Handler)
+		if c.SourceFile != "" {
+			line += fmt.Sprintf(", from %s", c.SourceFile)
+		}
+		if _, err = fmt.Fprintln(w, line+")"); err != nil {
+			return err
+		}
+		for _, d := range c.Diff {
+			if _, err = fmt.Fprintf(w, "      %s\n", d); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "\n%s\n", cs.countSummary())
+	return err
+}
+
+// e.g. "2 to create, 1 to update, 0 to delete"
+func (cs *ChangeSet) countSummary() (summary string) {
+	for i, a := range actions {
+		if i > 0 {
+			summary += ", "
+		}
+		summary += fmt.Sprintf("%d to %s", cs.Count(a), a)
+	}
+	return summary
+}
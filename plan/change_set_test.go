@@ -0,0 +1,64 @@
+package plan
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestChangeSet_Add_nil(t *testing.T) {
+	var cs *ChangeSet
+	cs.Add(Change{Path: "foo", Action: Create})
+	if !cs.Empty() {
+		t.Errorf("Expected nil ChangeSet to remain empty")
+	}
+}
+
+func TestChangeSet_Count(t *testing.T) {
+	cs := NewChangeSet()
+	cs.Add(Change{Path: "foo", Action: Create})
+	cs.Add(Change{Path: "bar", Action: Create})
+	cs.Add(Change{Path: "baz", Action: Delete})
+
+	tests := map[Action]int{Create: 2, Update: 0, Delete: 1}
+	for action, expected := range tests {
+		if c := cs.Count(action); c != expected {
+			t.Errorf("Expected %d changes with action %s, got %d", expected, action, c)
+		}
+	}
+}
+
+func TestChangeSet_WriteSummary(t *testing.T) {
+	cs := NewChangeSet()
+	cs.Add(Change{Path: "sys/policy/foo", Action: Update, Handler: "SysPolicy", SourceFile: "foo.json"})
+	cs.Add(Change{Path: "sys/auth/approle/", Action: Delete, Handler: "SysAuth"})
+	cs.Add(Change{Path: "sys/policy/bar", Namespace: "team-a", Action: Create, Handler: "SysPolicy"})
+
+	var buf bytes.Buffer
+	if err := cs.WriteSummary(&buf); err != nil {
+		t.Fatalf("Error writing summary: %s", err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"~ update sys/policy/foo (SysPolicy, from foo.json)",
+		"- delete sys/auth/approle/ (SysAuth)",
+		"+ create team-a/sys/policy/bar (SysPolicy)",
+		"1 to create, 1 to update, 1 to delete",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Summary does not contain %q:\n%s", e, out)
+		}
+	}
+}
+
+func TestChangeSet_WriteSummary_empty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewChangeSet().WriteSummary(&buf); err != nil {
+		t.Fatalf("Error writing summary: %s", err)
+	}
+	if buf.String() != "No changes.\n" {
+		t.Errorf("Unexpected summary for empty set: %q", buf.String())
+	}
+}
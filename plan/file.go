@@ -0,0 +1,88 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Increment when the format of File changes in an incompatible way
+const fileVersion = 1
+
+// A File is a saved plan, which can be reviewed and then applied exactly as it was computed
+type File struct {
+	Version             int       `json:"version"`
+	Created             time.Time `json:"created"`
+	DocumentFingerprint string    `json:"document_fingerprint"` // fingerprint of the document set
+	VaultFingerprint    string    `json:"vault_fingerprint"`    // fingerprint of the Vault state the plan was computed against
+	Changes             []Change  `json:"changes"`
+}
+
+// Create a plan File from a ChangeSet, given the fingerprint of the documents it was computed from
+func NewFile(cs *ChangeSet, documentFingerprint string) (*File, error) {
+	changes := []Change{}
+	if cs != nil {
+		changes = cs.Changes
+	}
+
+	vaultFingerprint, err := StateFingerprint(changes)
+	if err != nil {
+		return nil, fmt.Errorf("could not fingerprint vault state: %s", err)
+	}
+
+	return &File{
+		Version:             fileVersion,
+		Created:             time.Now().UTC(),
+		DocumentFingerprint: documentFingerprint,
+		VaultFingerprint:    vaultFingerprint,
+		Changes:             changes,
+	}, nil
+}
+
+// Write the plan to path as json
+func (f *File) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode plan: %s", err)
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write plan to %s: %s", path, err)
+	}
+	return nil
+}
+
+// Return the changes in the plan as a ChangeSet, e.g. for printing a summary
+func (f *File) ChangeSet() *ChangeSet {
+	return &ChangeSet{Changes: f.Changes}
+}
+
+// Read a plan previously written with Save. An error is returned if the plan was written by an
+// incompatible version of vaultsmith, or if its changes no longer match its vault fingerprint.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read plan file %s: %s", path, err)
+	}
+
+	var f File
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse plan file %s: %s", path, err)
+	}
+	if f.Version != fileVersion {
+		return nil, fmt.Errorf("plan file %s has version %d, expected %d", path, f.Version,
+			fileVersion)
+	}
+
+	fingerprint, err := StateFingerprint(f.Changes)
+	if err != nil {
+		return nil, fmt.Errorf("could not fingerprint plan file %s: %s", path, err)
+	}
+	if fingerprint != f.VaultFingerprint {
+		return nil, fmt.Errorf("plan file %s has been modified since it was created", path)
+	}
+
+	return &f, nil
+}
@@ -0,0 +1,90 @@
+package plan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPlanPath(t *testing.T) (path string, cleanUp func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "plan.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestFile_SaveAndLoad(t *testing.T) {
+	path, cleanUp := testPlanPath(t)
+	defer cleanUp()
+
+	cs := NewChangeSet()
+	cs.Add(Change{
+		Path:    "auth/approle/role/foo",
+		Action:  Update,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"policies": "old"},
+		After:   map[string]interface{}{"policies": "new"},
+	})
+	f, err := NewFile(cs, "docfingerprint")
+	if err != nil {
+		t.Fatalf("Error creating plan file: %s", err)
+	}
+	if err = f.Save(path); err != nil {
+		t.Fatalf("Error saving plan file: %s", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Error loading plan file: %s", err)
+	}
+	if loaded.DocumentFingerprint != "docfingerprint" {
+		t.Errorf("Unexpected document fingerprint %q", loaded.DocumentFingerprint)
+	}
+	if !reflect.DeepEqual(loaded.Changes, cs.Changes) {
+		t.Errorf("Loaded changes differ from saved: %+v != %+v", loaded.Changes, cs.Changes)
+	}
+}
+
+// Editing the recorded state in a plan file should stop it from being loaded
+func TestLoad_modified(t *testing.T) {
+	path, cleanUp := testPlanPath(t)
+	defer cleanUp()
+
+	cs := NewChangeSet()
+	cs.Add(Change{Path: "sys/policy/foo", Action: Update, Handler: "SysPolicy", Before: "old"})
+	f, err := NewFile(cs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Changes[0].Before = "edited"
+	if err = f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load(path)
+	if err == nil || !strings.Contains(err.Error(), "has been modified") {
+		t.Errorf("Expected modification error, got %v", err)
+	}
+}
+
+func TestFingerprint_fieldOrder(t *testing.T) {
+	type s struct {
+		B string `json:"b"`
+		A string `json:"a"`
+	}
+	a, err := Fingerprint(s{A: "1", B: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Fingerprint(map[string]interface{}{"a": "1", "b": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("Expected struct and equivalent map to have the same fingerprint")
+	}
+}
@@ -0,0 +1,47 @@
+package plan
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Return a sha256 fingerprint of value, based on its JSON representation. The JSON is decoded and
+// encoded again before hashing, so that values which are equivalent in JSON have the same
+// fingerprint; e.g. a struct and a map with the same fields, or a Change before and after being
+// saved to a plan file.
+func Fingerprint(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("could not encode %+v as json: %s", value, err)
+	}
+
+	var normalised interface{}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber() // avoid converting numbers to float64, which could lose precision
+	err = dec.Decode(&normalised)
+	if err != nil {
+		return "", fmt.Errorf("could not decode json %s: %s", encoded, err)
+	}
+
+	// encoding/json sorts map keys, so this is consistent regardless of the original field order
+	encoded, err = json.Marshal(normalised)
+	if err != nil {
+		return "", fmt.Errorf("could not encode %+v as json: %s", normalised, err)
+	}
+
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Return a fingerprint of the state of Vault that a list of changes was computed against, i.e.
+// the value of each path before the change
+func StateFingerprint(changes []Change) (string, error) {
+	var state []interface{}
+	for _, c := range changes {
+		state = append(state, []interface{}{c.Handler, c.Path, c.Before})
+	}
+	return Fingerprint(state)
+}
@@ -0,0 +1,119 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Action describes what was done to a path in Vault
+type Action string
+
+const (
+	Unchanged               Action = "unchanged"
+	Created                 Action = "created"
+	Updated                 Action = "updated"
+	Deleted                 Action = "deleted"
+	SkippedPermissionDenied Action = "skipped-permission-denied"
+	SkippedProtected        Action = "skipped-protected"
+)
+
+// The outcome for a single path in Vault
+type PathResult struct {
+	Path       string `json:"path"`
+	Action     Action `json:"action"`
+	SourceFile string `json:"source_file,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// A single invocation of a path handler on a directory of documents
+type HandlerRun struct {
+	Handler         string       `json:"handler"`
+	Directory       string       `json:"directory"`           // relative to the document path
+	Namespace       string       `json:"namespace,omitempty"` // Vault Enterprise namespace, if any
+	Started         time.Time    `json:"started"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Paths           []PathResult `json:"paths"`
+	Error           string       `json:"error,omitempty"`
+}
+
+// A Report is a machine readable record of a vaultsmith run, e.g. for use by CI pipelines
+type Report struct {
+	Started         time.Time     `json:"started"`
+	Finished        time.Time     `json:"finished"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Dry             bool          `json:"dry"` // if true, actions are those that would have been taken
+	Handlers        []*HandlerRun `json:"handlers"`
+	Error           string        `json:"error,omitempty"`
+	current         *HandlerRun
+}
+
+func New(dry bool) *Report {
+	return &Report{
+		Started:  time.Now().UTC(),
+		Dry:      dry,
+		Handlers: []*HandlerRun{},
+	}
+}
+
+// Record the start of a handler run. Paths added until FinishHandler is called are attributed to
+// it. All methods are safe to call on a nil Report, so that handlers can be used without one.
+func (r *Report) StartHandler(handler string, directory string, namespace string) {
+	if r == nil {
+		return
+	}
+	r.current = &HandlerRun{
+		Handler:   handler,
+		Directory: directory,
+		Namespace: namespace,
+		Started:   time.Now().UTC(),
+		Paths:     []PathResult{},
+	}
+	r.Handlers = append(r.Handlers, r.current)
+}
+
+// Record the end of the current handler run, and the error it returned if any
+func (r *Report) FinishHandler(err error) {
+	if r == nil || r.current == nil {
+		return
+	}
+	r.current.DurationSeconds = time.Since(r.current.Started).Seconds()
+	if err != nil {
+		r.current.Error = err.Error()
+	}
+	r.current = nil
+}
+
+// Record the outcome for a path against the current handler run
+func (r *Report) AddPath(result PathResult) {
+	if r == nil || r.current == nil {
+		return
+	}
+	r.current.Paths = append(r.current.Paths, result)
+}
+
+// Record the end of the run, and the error it returned if any
+func (r *Report) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.Finished = time.Now().UTC()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Write the report to path as json
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode report: %s", err)
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write report to %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReport_AddPath(t *testing.T) {
+	r := New(false)
+	r.StartHandler("Generic", "auth/approle", "")
+	r.AddPath(PathResult{Path: "auth/approle/role/foo", Action: Created})
+	r.AddPath(PathResult{Path: "auth/approle/role/bar", Action: Unchanged})
+	r.FinishHandler(errors.New("failed"))
+
+	// not attributed to any handler, so discarded
+	r.AddPath(PathResult{Path: "auth/approle/role/baz", Action: Deleted})
+
+	if len(r.Handlers) != 1 {
+		t.Fatalf("Expected 1 handler run, got %d", len(r.Handlers))
+	}
+	run := r.Handlers[0]
+	if len(run.Paths) != 2 {
+		t.Errorf("Expected 2 paths for handler run, got %+v", run.Paths)
+	}
+	if run.Error != "failed" {
+		t.Errorf("Expected handler error to be recorded, got %q", run.Error)
+	}
+}
+
+func TestReport_nil(t *testing.T) {
+	var r *Report
+	r.StartHandler("Generic", "foo", "")
+	r.AddPath(PathResult{Path: "foo/bar", Action: Created})
+	r.FinishHandler(nil)
+	r.Finish(nil)
+}
+
+func TestReport_Save(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := New(true)
+	r.StartHandler("SysPolicy", "sys/policy", "")
+	r.AddPath(PathResult{Path: "sys/policy/foo", Action: SkippedPermissionDenied})
+	r.FinishHandler(nil)
+	r.Finish(nil)
+
+	path := filepath.Join(dir, "report.json")
+	if err = r.Save(path); err != nil {
+		t.Fatalf("Error saving report: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Report
+	if err = json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Could not parse saved report: %s", err)
+	}
+	if !saved.Dry || saved.Handlers[0].Paths[0].Action != SkippedPermissionDenied {
+		t.Errorf("Saved report does not match: %s", data)
+	}
+}
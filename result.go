@@ -0,0 +1,24 @@
+package main
+
+import "github.com/starlingbank/vaultsmith/plan"
+
+// Exit codes, so that a dry run can be used to detect drift between the documents and Vault
+const (
+	exitOK             = 0 // success, and in dry mode no changes are needed
+	exitError          = 1
+	exitChangesPending = 2 // dry mode only; changes would have been made
+)
+
+// The outcome of a successful Run, Apply or Export
+type Result struct {
+	Dry     bool
+	Changes *plan.ChangeSet
+}
+
+// Return the code vaultsmith should exit with for this result
+func (r *Result) ExitCode() int {
+	if r.Dry && !r.Changes.Empty() {
+		return exitChangesPending
+	}
+	return exitOK
+}
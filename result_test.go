@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/starlingbank/vaultsmith/plan"
+	"testing"
+)
+
+func TestResult_ExitCode(t *testing.T) {
+	changes := plan.NewChangeSet()
+	changes.Add(plan.Change{Path: "sys/policy/foo", Action: plan.Create})
+
+	tests := []struct {
+		name     string
+		result   Result
+		expected int
+	}{
+		{name: "dry, no changes", result: Result{Dry: true, Changes: plan.NewChangeSet()}, expected: exitOK},
+		{name: "dry, nil changes", result: Result{Dry: true}, expected: exitOK},
+		{name: "dry, changes", result: Result{Dry: true, Changes: changes}, expected: exitChangesPending},
+		{name: "applied changes", result: Result{Dry: false, Changes: changes}, expected: exitOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := test.result.ExitCode(); code != test.expected {
+				t.Errorf("Expected exit code %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
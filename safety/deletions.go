@@ -0,0 +1,139 @@
+package safety
+
+import (
+	"fmt"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"sort"
+	"strings"
+)
+
+/*
+	A circuit breaker for deletions. A broken tarball or the wrong --tar-dir can produce a nearly
+	empty document set, which vaultsmith would faithfully apply by deleting almost everything in
+	Vault. The deletions planned for a run are counted before any are made, and the run is refused
+	if there are more than the limits allow.
+*/
+
+// The percentage limit is not applied to handlers which found fewer paths than this in Vault, so
+// that small sets can be changed freely
+const minPathsForPercentLimit = 10
+
+// DeletionLimits are the most deletions a run may make. A negative limit is no limit.
+type DeletionLimits struct {
+	MaxDeletions    int // most paths deleted by any handler, or by all of them together
+	MaxPercent      int // most paths deleted as a percentage of those found in Vault, likewise
+	MaxAuthDisables int // most auth mounts disabled, as this deletes all of their roles too
+
+	// Stricter limits for handlers which delete everything under the paths they delete
+	MaxUnmounts         int // most secret engines unmounted, deleting all of their secrets
+	MaxNamespaceDeletes int // most namespaces deleted, deleting everything in them
+}
+
+// The number of paths a handler found in Vault, and how many of those it deletes. Existing is 0
+// when it is not known.
+type DeletionCount struct {
+	Existing int
+	Deleted  int
+}
+
+// Count the deletions of each handler in a report of a dry run. Every path the report has for a
+// handler was found in Vault, apart from those it creates.
+func CountDeletions(r *report.Report) map[string]*DeletionCount {
+	counts := map[string]*DeletionCount{}
+	for _, run := range r.Handlers {
+		count := counts[run.Handler]
+		if count == nil {
+			count = &DeletionCount{}
+			counts[run.Handler] = count
+		}
+		for _, p := range run.Paths {
+			switch p.Action {
+			case report.Created:
+				continue
+			case report.Deleted:
+				count.Deleted++
+			}
+			count.Existing++
+		}
+	}
+	return counts
+}
+
+// Count the deletions of each handler in a plan. How many paths were in Vault is not known, so only
+// the absolute limits apply.
+func CountPlanDeletions(changes []plan.Change) map[string]*DeletionCount {
+	counts := map[string]*DeletionCount{}
+	for _, change := range changes {
+		if counts[change.Handler] == nil {
+			counts[change.Handler] = &DeletionCount{}
+		}
+		if change.Action == plan.Delete {
+			counts[change.Handler].Deleted++
+		}
+	}
+	return counts
+}
+
+// Return an error listing every limit exceeded by the deletions counted for each handler. Nil
+// limits allow any number of deletions.
+func (l *DeletionLimits) Check(counts map[string]*DeletionCount) error {
+	if l == nil {
+		return nil
+	}
+
+	var handlers []string
+	for handler := range counts {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+
+	var problems []string
+	total := DeletionCount{}
+	for _, handler := range handlers {
+		count := counts[handler]
+		total.Existing += count.Existing
+		total.Deleted += count.Deleted
+		problems = append(problems, l.exceeded(handler, *count)...)
+		if limit, deletes, ok := l.handlerLimit(handler); ok && limit >= 0 && count.Deleted > limit {
+			problems = append(problems, fmt.Sprintf("%s would %s %d %s, more than the limit of "+
+				"%d", handler, deletes[0], count.Deleted, deletes[1], limit))
+		}
+	}
+	if len(handlers) > 1 {
+		problems = append(problems, l.exceeded("all handlers", total)...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("too many deletions: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Return the stricter limit on deletions by a handler, if it has one, and the verb and noun for
+// what it deletes
+func (l *DeletionLimits) handlerLimit(handler string) (limit int, deletes [2]string, ok bool) {
+	switch handler {
+	case "SysAuth":
+		return l.MaxAuthDisables, [2]string{"disable", "auth mounts"}, true
+	case "SysMounts":
+		return l.MaxUnmounts, [2]string{"unmount", "secret engines"}, true
+	case "SysNamespaces":
+		return l.MaxNamespaceDeletes, [2]string{"delete", "namespaces"}, true
+	}
+	return 0, deletes, false
+}
+
+// Return the absolute and percentage limits exceeded by count
+func (l *DeletionLimits) exceeded(name string, count DeletionCount) (problems []string) {
+	if l.MaxDeletions >= 0 && count.Deleted > l.MaxDeletions {
+		problems = append(problems, fmt.Sprintf("%s would delete %d paths, more than the limit "+
+			"of %d", name, count.Deleted, l.MaxDeletions))
+	}
+	if l.MaxPercent >= 0 && count.Existing >= minPathsForPercentLimit &&
+		count.Deleted*100 > l.MaxPercent*count.Existing {
+		problems = append(problems, fmt.Sprintf("%s would delete %d of %d paths, more than the "+
+			"limit of %d%%", name, count.Deleted, count.Existing, l.MaxPercent))
+	}
+	return problems
+}
@@ -0,0 +1,99 @@
+package safety
+
+import (
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCountDeletions(t *testing.T) {
+	r := report.New(true)
+	r.StartHandler("Generic", "secret/foo", "")
+	r.AddPath(report.PathResult{Path: "secret/foo/a", Action: report.Unchanged})
+	r.AddPath(report.PathResult{Path: "secret/foo/b", Action: report.Created})
+	r.AddPath(report.PathResult{Path: "secret/foo/c", Action: report.Deleted})
+	r.FinishHandler(nil)
+	r.StartHandler("Generic", "secret/bar", "")
+	r.AddPath(report.PathResult{Path: "secret/bar/a", Action: report.Deleted})
+	r.FinishHandler(nil)
+	r.StartHandler("SysPolicy", "sys/policy", "")
+	r.AddPath(report.PathResult{Path: "sys/policy/a", Action: report.Updated})
+	r.FinishHandler(nil)
+
+	expected := map[string]*DeletionCount{
+		"Generic":   {Existing: 3, Deleted: 2},
+		"SysPolicy": {Existing: 1, Deleted: 0},
+	}
+	counts := CountDeletions(r)
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, counts)
+	}
+}
+
+func TestDeletionLimits_Check(t *testing.T) {
+	limits := &DeletionLimits{
+		MaxDeletions:        10,
+		MaxPercent:          50,
+		MaxAuthDisables:     1,
+		MaxUnmounts:         1,
+		MaxNamespaceDeletes: 0,
+	}
+	tests := []struct {
+		counts   map[string]*DeletionCount
+		expected string // part of the error, or empty for none
+	}{
+		{map[string]*DeletionCount{"Generic": {Existing: 20, Deleted: 10}}, ""},
+		{map[string]*DeletionCount{"Generic": {Existing: 30, Deleted: 11}}, "Generic would delete 11 paths"},
+		{map[string]*DeletionCount{"Generic": {Existing: 10, Deleted: 6}}, "6 of 10 paths, more than the limit of 50%"},
+		// too few paths for the percentage to matter
+		{map[string]*DeletionCount{"SysPolicy": {Existing: 3, Deleted: 3}}, ""},
+		{map[string]*DeletionCount{"SysAuth": {Existing: 4, Deleted: 2}}, "SysAuth would disable 2 auth mounts"},
+		{map[string]*DeletionCount{"SysMounts": {Existing: 4, Deleted: 1}}, ""},
+		{map[string]*DeletionCount{"SysMounts": {Existing: 4, Deleted: 2}}, "SysMounts would unmount 2 secret engines"},
+		{map[string]*DeletionCount{"SysNamespaces": {Existing: 4, Deleted: 1}}, "SysNamespaces would delete 1 namespaces"},
+		{map[string]*DeletionCount{
+			"Generic":   {Existing: 100, Deleted: 8},
+			"SysPolicy": {Existing: 10, Deleted: 5},
+		}, "all handlers would delete 13 paths"},
+	}
+	for _, test := range tests {
+		err := limits.Check(test.counts)
+		if test.expected == "" && err != nil {
+			t.Errorf("Expected no error for %+v, got %s", test.counts, err)
+		} else if test.expected != "" && (err == nil || !strings.Contains(err.Error(), test.expected)) {
+			t.Errorf("Expected error containing %q for %+v, got %v", test.expected, test.counts, err)
+		}
+	}
+
+	unlimited := &DeletionLimits{
+		MaxDeletions:        -1,
+		MaxPercent:          -1,
+		MaxAuthDisables:     -1,
+		MaxUnmounts:         -1,
+		MaxNamespaceDeletes: -1,
+	}
+	if err := unlimited.Check(map[string]*DeletionCount{"SysAuth": {Existing: 50, Deleted: 50}}); err != nil {
+		t.Errorf("Expected no error without limits, got %s", err)
+	}
+	var none *DeletionLimits
+	if err := none.Check(map[string]*DeletionCount{"SysAuth": {Existing: 50, Deleted: 50}}); err != nil {
+		t.Errorf("Expected no error for nil limits, got %s", err)
+	}
+}
+
+func TestCountPlanDeletions(t *testing.T) {
+	counts := CountPlanDeletions([]plan.Change{
+		{Path: "sys/auth/ldap/", Action: plan.Delete, Handler: "SysAuth"},
+		{Path: "sys/auth/aws/", Action: plan.Update, Handler: "SysAuth"},
+		{Path: "secret/foo", Action: plan.Delete, Handler: "Generic"},
+	})
+	expected := map[string]*DeletionCount{
+		"SysAuth": {Deleted: 1},
+		"Generic": {Deleted: 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, counts)
+	}
+}
@@ -0,0 +1,89 @@
+package safety
+
+import (
+	"fmt"
+	"github.com/starlingbank/vaultsmith/plan"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+/*
+	Rules limit which paths in Vault vaultsmith may change, whatever the documents say, so that a
+	mistake such as an empty directory cannot wipe out secrets that must be kept.
+
+	Paths are matched as globs (see path.Match), against the full path of a change including its
+	namespace, e.g. "secret/prod/*" or "team-a/sys/policy/admin". A pattern also matches everything
+	beneath the paths it matches, so "secret/prod" covers all of secret/prod/.
+*/
+
+// Rules are read from a yaml or json file, e.g.
+// {"protected": ["secret/prod", "sys/auth/ldap"], "managed": ["secret", "sys/policy"]}
+type Rules struct {
+	Protected []string `yaml:"protected"` // paths which may be created, but never updated or deleted
+	Managed   []string `yaml:"managed"`   // if not empty, the only paths which may be changed
+}
+
+// Read the rules from the file at filePath. If filePath is empty, there are no rules and nil is
+// returned, which allows every change.
+func Load(filePath string) (*Rules, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read safety rules: %s", err)
+	}
+	// json is also yaml, so either can be read
+	var rules Rules
+	err = yaml.UnmarshalStrict(content, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse safety rules in %s: %s", filePath, err)
+	}
+	for _, pattern := range append(rules.Protected, rules.Managed...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %s", pattern, filePath, err)
+		}
+	}
+	return &rules, nil
+}
+
+// Return an error if the rules do not allow action on the path p
+func (r *Rules) Check(p string, action plan.Action) error {
+	if r == nil {
+		return nil
+	}
+	if len(r.Managed) > 0 && !matchesAny(r.Managed, p) {
+		return fmt.Errorf("%s is not a managed path", p)
+	}
+	if action != plan.Create && matchesAny(r.Protected, p) {
+		return fmt.Errorf("%s is protected", p)
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matches(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if pattern matches p, or any of the paths above it
+func matches(pattern string, p string) bool {
+	pattern = strings.Trim(pattern, "/")
+	p = strings.Trim(p, "/")
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
@@ -0,0 +1,98 @@
+package safety
+
+import (
+	"github.com/starlingbank/vaultsmith/plan"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"secret/prod", "secret/prod", true},
+		{"secret/prod", "secret/prod/db/password", true},
+		{"secret/prod", "secret/production", false},
+		{"secret/*/db", "secret/prod/db/password", true},
+		{"secret/*/db", "secret/db", false},
+		{"sys/policy/admin*", "sys/policy/admins", true},
+		{"/sys/auth/ldap/", "sys/auth/ldap", true},
+		{"team-a/secret", "secret/foo", false},
+	}
+	for _, test := range tests {
+		if matches(test.pattern, test.path) != test.expected {
+			t.Errorf("Expected match of %q against %q to be %t", test.pattern, test.path, test.expected)
+		}
+	}
+}
+
+func TestRules_Check(t *testing.T) {
+	rules := &Rules{
+		Protected: []string{"secret/prod"},
+		Managed:   []string{"secret", "sys/policy"},
+	}
+	tests := []struct {
+		path    string
+		action  plan.Action
+		allowed bool
+	}{
+		{"secret/dev/foo", plan.Delete, true},
+		{"secret/prod/foo", plan.Create, true},
+		{"secret/prod/foo", plan.Update, false},
+		{"secret/prod/foo", plan.Delete, false},
+		{"sys/policy/foo", plan.Delete, true},
+		{"sys/auth/ldap", plan.Create, false},
+	}
+	for _, test := range tests {
+		err := rules.Check(test.path, test.action)
+		if (err == nil) != test.allowed {
+			t.Errorf("Expected %s of %s to be allowed: %t, got error %v", test.action, test.path,
+				test.allowed, err)
+		}
+	}
+
+	// no rules allow every change
+	var none *Rules
+	if err := none.Check("sys/auth/ldap", plan.Delete); err != nil {
+		t.Errorf("Expected nil rules to allow changes, got %s", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesFile := filepath.Join(dir, "safety.yaml")
+	err = ioutil.WriteFile(rulesFile, []byte("protected:\n  - secret/prod\nmanaged:\n  - secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Load(rulesFile)
+	if err != nil {
+		t.Fatalf("Error loading rules: %s", err)
+	}
+	expected := &Rules{Protected: []string{"secret/prod"}, Managed: []string{"secret"}}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rules)
+	}
+
+	badFile := filepath.Join(dir, "bad.json")
+	err = ioutil.WriteFile(badFile, []byte(`{"protected": ["secret/[prod"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(badFile); err == nil {
+		t.Errorf("Expected error for invalid pattern")
+	}
+
+	if rules, err = Load(""); rules != nil || err != nil {
+		t.Errorf("Expected no rules without a file, got %+v, %v", rules, err)
+	}
+}
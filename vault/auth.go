@@ -0,0 +1,187 @@
+package vault
+
+import (
+	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
+	credAws "github.com/hashicorp/vault/builtin/credential/aws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	Auth methods which vaultsmith can use to log in to Vault, when no token is given in the
+	environment. Credentials are read from the environment when logging in, either directly or from
+	a file named by the same variable with a _FILE suffix, e.g. VAULT_SECRET_ID_FILE.
+*/
+
+// An AuthMethod logs in to Vault to obtain a token for vaultsmith
+type AuthMethod interface {
+	// Log in as role, for methods which have roles, and return the secret holding the token
+	Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error)
+}
+
+// Auth methods by the name given to --auth-method, each taking the path it is mounted at
+var authMethods = map[string]func(mount string) AuthMethod{
+	"aws": func(mount string) AuthMethod {
+		return &awsAuth{mount: defaultMount(mount, "aws"), handler: &credAws.CLIHandler{}}
+	},
+	"approle": func(mount string) AuthMethod {
+		return &appRoleAuth{mount: defaultMount(mount, "approle")}
+	},
+	"userpass": func(mount string) AuthMethod {
+		return &userpassAuth{mount: defaultMount(mount, "userpass")}
+	},
+	"token-file": func(mount string) AuthMethod {
+		return &tokenFileAuth{}
+	},
+	"kubernetes": func(mount string) AuthMethod {
+		return &kubernetesAuth{mount: defaultMount(mount, "kubernetes"), tokenPath: kubernetesTokenPath}
+	},
+}
+
+// Where Kubernetes mounts the service account token in a pod
+const kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Return the auth method with the given name, mounted at mount. If mount is empty, the default
+// path for the method is used, e.g. approle.
+func NewAuthMethod(name string, mount string) (AuthMethod, error) {
+	newMethod, ok := authMethods[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown auth method %q, valid values are %s", name,
+			strings.Join(AuthMethodNames(), ", "))
+	}
+	return newMethod(strings.Trim(mount, "/")), nil
+}
+
+// Return the names of the supported auth methods, in order
+func AuthMethodNames() (names []string) {
+	for name := range authMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultMount(mount string, defaultPath string) string {
+	if mount == "" {
+		return defaultPath
+	}
+	return mount
+}
+
+// Logs in with the AWS credentials of the environment, using the IAM method
+type awsAuth struct {
+	mount   string
+	handler *credAws.CLIHandler
+}
+
+func (a *awsAuth) Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error) {
+	return a.handler.Auth(client, map[string]string{"role": role, "mount": a.mount})
+}
+
+// Logs in with the role id in VAULT_ROLE_ID and secret id in VAULT_SECRET_ID
+type appRoleAuth struct {
+	mount string
+}
+
+func (a *appRoleAuth) Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error) {
+	roleID, err := credential("VAULT_ROLE_ID")
+	if err != nil {
+		return nil, err
+	}
+	secretID, err := credential("VAULT_SECRET_ID")
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write("auth/"+a.mount+"/login", map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+}
+
+// Logs in with the username in VAULT_USERNAME and password in VAULT_PASSWORD
+type userpassAuth struct {
+	mount string
+}
+
+func (a *userpassAuth) Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error) {
+	username, err := credential("VAULT_USERNAME")
+	if err != nil {
+		return nil, err
+	}
+	password, err := credential("VAULT_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write("auth/"+a.mount+"/login/"+username, map[string]interface{}{
+		"password": password,
+	})
+}
+
+// Logs in as role with the service account token of the pod vaultsmith runs in, which is read from
+// the file named by VAULT_KUBERNETES_TOKEN_FILE if set, e.g. for a projected token
+type kubernetesAuth struct {
+	mount     string
+	tokenPath string
+}
+
+func (a *kubernetesAuth) Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error) {
+	path := a.tokenPath
+	if p := os.Getenv("VAULT_KUBERNETES_TOKEN_FILE"); p != "" {
+		path = p
+	}
+	jwt, err := readCredentialFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %s", err)
+	}
+	return client.Logical().Write("auth/"+a.mount+"/login", map[string]interface{}{
+		"role": role,
+		"jwt":  jwt,
+	})
+}
+
+// Uses the token in the file named by VAULT_TOKEN_FILE, or ~/.vault-token as the Vault cli does
+type tokenFileAuth struct{}
+
+func (a *tokenFileAuth) Login(client *vaultApi.Client, role string) (*vaultApi.Secret, error) {
+	path := os.Getenv("VAULT_TOKEN_FILE")
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, fmt.Errorf("VAULT_TOKEN_FILE must be set when HOME is not")
+		}
+		path = filepath.Join(home, ".vault-token")
+	}
+	token, err := readCredentialFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultApi.Secret{Auth: &vaultApi.SecretAuth{ClientToken: token}}, nil
+}
+
+// Return the value of the environment variable name, or the contents of the file named by name
+// with a _FILE suffix
+func credential(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		return readCredentialFile(path)
+	}
+	return "", fmt.Errorf("%s or %s_FILE must be set", name, name)
+}
+
+func readCredentialFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read credential file: %s", err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("credential file %s is empty", path)
+	}
+	return value, nil
+}
@@ -0,0 +1,191 @@
+package vault
+
+import (
+	"encoding/json"
+	vaultApi "github.com/hashicorp/vault/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A Vault stand-in which accepts logins at loginPath with the given body, and token lookups
+func newLoginServer(t *testing.T, loginPath string, expectedBody map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/" + loginPath:
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			for k, v := range expectedBody {
+				if body[k] != v {
+					t.Errorf("Expected %s of %v in login, got %v", k, v, body[k])
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			w.Write([]byte(`{"auth": {"client_token": "login-token", "lease_duration": 60}}`))
+		case "/v1/auth/token/lookup-self":
+			if r.Header.Get("X-Vault-Token") != "login-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"data": {"id": "login-token"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func newTestClient(t *testing.T, address string, auth AuthMethod) *BaseClient {
+	config := &vaultApi.Config{Address: address}
+	apiClient, err := vaultApi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiClient.ClearToken() // in case VAULT_TOKEN is set where the tests run
+	return newBaseClient(config, apiClient, false, "", auth)
+}
+
+func TestAuthenticate_appRole(t *testing.T) {
+	server := newLoginServer(t, "auth/ci-approle/login", map[string]interface{}{
+		"role_id":   "my-role",
+		"secret_id": "my-secret",
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret-id")
+	err = ioutil.WriteFile(secretFile, []byte("my-secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("VAULT_ROLE_ID", "my-role")
+	os.Setenv("VAULT_SECRET_ID_FILE", secretFile)
+	defer os.Unsetenv("VAULT_ROLE_ID")
+	defer os.Unsetenv("VAULT_SECRET_ID_FILE")
+
+	auth, err := NewAuthMethod("approle", "/ci-approle/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, server.URL, auth)
+	err = c.Authenticate("root")
+	if err != nil {
+		t.Fatalf("Error calling Authenticate: %s", err)
+	}
+	if c.client.Token() != "login-token" {
+		t.Errorf("Expected token from login, got %q", c.client.Token())
+	}
+}
+
+func TestAuthenticate_userpass(t *testing.T) {
+	server := newLoginServer(t, "auth/userpass/login/jenkins", map[string]interface{}{
+		"password": "hunter2",
+	})
+	defer server.Close()
+
+	os.Setenv("VAULT_USERNAME", "jenkins")
+	os.Setenv("VAULT_PASSWORD", "hunter2")
+	defer os.Unsetenv("VAULT_USERNAME")
+	defer os.Unsetenv("VAULT_PASSWORD")
+
+	auth, err := NewAuthMethod("userpass", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, server.URL, auth)
+	err = c.Authenticate("root")
+	if err != nil {
+		t.Fatalf("Error calling Authenticate: %s", err)
+	}
+}
+
+func TestAuthenticate_missingCredentials(t *testing.T) {
+	auth, err := NewAuthMethod("approle", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, "http://127.0.0.1:0", auth)
+	err = c.Authenticate("root")
+	if err == nil {
+		t.Errorf("Expected error when VAULT_ROLE_ID is not set")
+	}
+}
+
+func TestTokenFileAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("VAULT_TOKEN_FILE", tokenFile)
+	defer os.Unsetenv("VAULT_TOKEN_FILE")
+
+	secret, err := (&tokenFileAuth{}).Login(nil, "")
+	if err != nil {
+		t.Fatalf("Error calling Login: %s", err)
+	}
+	if secret.Auth.ClientToken != "file-token" {
+		t.Errorf("Expected token from file, got %q", secret.Auth.ClientToken)
+	}
+}
+
+func TestNewAuthMethod_unknown(t *testing.T) {
+	_, err := NewAuthMethod("ldap", "")
+	if err == nil {
+		t.Errorf("Expected error for unknown auth method")
+	}
+}
+
+func TestAuthenticate_kubernetes(t *testing.T) {
+	server := newLoginServer(t, "auth/k8s-prod/login", map[string]interface{}{
+		"role": "vaultsmith",
+		"jwt":  "service-account-jwt",
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "vaultsmith-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("service-account-jwt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := NewAuthMethod("kubernetes", "k8s-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.(*kubernetesAuth).tokenPath = tokenFile
+	c := newTestClient(t, server.URL, auth)
+	err = c.Authenticate("vaultsmith")
+	if err != nil {
+		t.Fatalf("Error calling Authenticate: %s", err)
+	}
+	if c.client.Token() != "login-token" {
+		t.Errorf("Expected token from login, got %q", c.client.Token())
+	}
+}
+
+// Outside a pod there is no service account token
+func TestKubernetesAuth_missingToken(t *testing.T) {
+	auth := &kubernetesAuth{mount: "kubernetes", tokenPath: "/nonexistent/token"}
+	_, err := auth.Login(nil, "vaultsmith")
+	if err == nil {
+		t.Errorf("Expected error when the service account token is missing")
+	}
+}
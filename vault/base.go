@@ -5,10 +5,10 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
 
 	"crypto/tls"
 	vaultApi "github.com/hashicorp/vault/api"
-	credAws "github.com/hashicorp/vault/builtin/credential/aws"
 )
 
 /*
@@ -21,40 +21,67 @@ If there is a possibility that the configuration might be different, they should
 put.
 */
 
+// The header which selects the Vault Enterprise namespace of a request
+const namespaceHeader = "X-Vault-Namespace"
+
 // Vault is an abstraction of hashicorp's vault api client
 type Vault interface {
 	readMethods
 	writeMethods
 	Authenticate(string) error
+	Logout() error
+	WithNamespace(namespace string) (Vault, error)
+	WithDryRun() (Vault, error)
 }
 
 type readMethods interface {
 	GetPolicy(name string) (string, error)
 	List(path string) (*vaultApi.Secret, error)
+	ListAudit() (map[string]*vaultApi.Audit, error)
 	ListAuth() (map[string]*vaultApi.AuthMount, error)
+	ListMounts() (map[string]*vaultApi.MountOutput, error)
+	ListNamespaces() ([]string, error)
 	ListPolicies() ([]string, error)
 	Read(path string) (*vaultApi.Secret, error)
 }
 
 type writeMethods interface {
+	CreateNamespace(name string) error
 	Delete(path string) (*vaultApi.Secret, error)
+	DeleteNamespace(name string) error
 	DeletePolicy(name string) error
+	DisableAudit(path string) error
 	DisableAuth(string) error
+	EnableAudit(path string, options *vaultApi.EnableAuditOptions) error
 	EnableAuth(path string, options *vaultApi.EnableAuthOptions) error
+	Mount(path string, mountInfo *vaultApi.MountInput) error
 	PutPolicy(string, string) error
+	TuneAuth(path string, data map[string]interface{}) error
+	TuneMount(path string, config vaultApi.MountConfigInput) error
+	Unmount(path string) error
 	Write(path string, data map[string]interface{}) (*vaultApi.Secret, error)
 }
 
 type BaseClient struct {
 	readMethods
 	writeMethods
-	client  *vaultApi.Client
-	handler *credAws.CLIHandler
-	logger  *log.Entry
+	client    *vaultApi.Client
+	config    *vaultApi.Config // used to create clients for other namespaces
+	readonly  bool
+	namespace string
+	auth      AuthMethod // used to log in when there is no token in the environment
+	ownsToken bool       // whether the token was obtained by logging in, and so is revoked by Logout
+	logger    *log.Entry
+
+	stopRenewal chan struct{} // closed to stop renewing the token
+	renewalDone chan struct{} // closed once renewal has stopped
 }
 
-func NewVaultClient(readonly bool) (c Vault, err error) {
-	config := vaultApi.Config{
+// Create a client for Vault, configured by the environment. If namespace is not empty, all requests
+// are made in that Vault Enterprise namespace. auth is used to log in if the environment does not
+// provide a token.
+func NewVaultClient(readonly bool, namespace string, auth AuthMethod) (c Vault, err error) {
+	config := &vaultApi.Config{
 		HttpClient: &http.Client{
 			Transport: &http.Transport{
 				// lack of TLSClientConfig can cause SIGSEGV on config.ReadEnvironment() below
@@ -68,12 +95,22 @@ func NewVaultClient(readonly bool) (c Vault, err error) {
 	if err != nil {
 		return c, err
 	}
+	// calls are retried by WithRetries, which only retries those which are safe to make again
+	config.MaxRetries = 0
 
-	vaultApiClient, err := vaultApi.NewClient(&config)
+	vaultApiClient, err := vaultApi.NewClient(config)
 	if err != nil {
 		return c, err
 	}
+	return newBaseClient(config, vaultApiClient, readonly, namespace, auth), nil
+}
+
+func newBaseClient(config *vaultApi.Config, vaultApiClient *vaultApi.Client, readonly bool, namespace string, auth AuthMethod) *BaseClient {
+	setNamespace(vaultApiClient, namespace)
 	logger := log.WithFields(log.Fields{"readonly": readonly})
+	if namespace != "" {
+		logger = logger.WithField("namespace", namespace)
+	}
 
 	var writer writeMethods
 	if readonly {
@@ -89,36 +126,75 @@ func NewVaultClient(readonly bool) (c Vault, err error) {
 	return &BaseClient{
 		writeMethods: writer,
 		client:       vaultApiClient,
-		handler:      &credAws.CLIHandler{},
+		config:       config,
+		readonly:     readonly,
+		namespace:    namespace,
+		auth:         auth,
 		logger:       logger,
-	}, nil
+	}
+}
+
+// Set the namespace header on all requests made by client, which is new and so has no other
+// headers. The root namespace has no header.
+func setNamespace(client *vaultApi.Client, namespace string) {
+	headers := http.Header{}
+	if namespace != "" {
+		headers.Set(namespaceHeader, namespace)
+	}
+	client.SetHeaders(headers)
+}
+
+// Return a client for another namespace, which shares the token of this one. namespace is the full
+// path of the namespace, e.g. "team/project", and is the root namespace if empty.
+func (c *BaseClient) WithNamespace(namespace string) (Vault, error) {
+	return c.sharingToken(c.readonly, namespace)
+}
+
+// Return a client for the same namespace, which shares the token of this one but makes no changes
+// to Vault, e.g. to plan a run before making it
+func (c *BaseClient) WithDryRun() (Vault, error) {
+	return c.sharingToken(true, c.namespace)
+}
 
+// The token is renewed and revoked by this client, not the one returned
+func (c *BaseClient) sharingToken(readonly bool, namespace string) (Vault, error) {
+	vaultApiClient, err := vaultApi.NewClient(c.config)
+	if err != nil {
+		return nil, err
+	}
+	vaultApiClient.SetToken(c.client.Token())
+	return newBaseClient(c.config, vaultApiClient, readonly, namespace, c.auth), nil
 }
 
+// Authenticate with the token in the environment, or by logging in with the client's auth method,
+// and keep the token renewed until Logout is called
 func (c *BaseClient) Authenticate(role string) error {
 	if c.client.Token() != "" {
 		// Already authenticated. Supposedly.
 		c.logger.Debugf("Already authenticated by environment variable")
-		return nil
-	}
+	} else {
+		secret, err := c.auth.Login(c.client, role)
+		if err != nil {
+			c.logger.Errorf("Auth error: %s", err)
+			return err
+		}
 
-	secret, err := c.handler.Auth(c.client, map[string]string{"role": role})
-	if err != nil {
-		c.logger.Errorf("Auth error: %s", err)
-		return err
-	}
+		if secret == nil || secret.Auth == nil {
+			return errors.New("no token returned from Vault")
+		}
 
-	if secret == nil {
-		return errors.New("no secret returned from Vault")
+		c.client.SetToken(secret.Auth.ClientToken)
+		// a token read from a file was not obtained by vaultsmith, so belongs to the caller
+		_, fromFile := c.auth.(*tokenFileAuth)
+		c.ownsToken = !fromFile
 	}
 
-	c.client.SetToken(secret.Auth.ClientToken)
-
-	secret, err = c.client.Auth().Token().LookupSelf()
+	secret, err := c.client.Auth().Token().LookupSelf()
 	if err != nil {
 		return errors.New(fmt.Sprintf("no token found in Vault client (%s)", err))
 	}
 
+	c.startRenewal(secret)
 	return nil
 }
 
@@ -131,10 +207,35 @@ func (c *BaseClient) List(path string) (*vaultApi.Secret, error) {
 	return c.client.Logical().List(path)
 }
 
+func (c *BaseClient) ListAudit() (map[string]*vaultApi.Audit, error) {
+	return c.client.Sys().ListAudit()
+}
+
 func (c *BaseClient) ListAuth() (map[string]*vaultApi.AuthMount, error) {
 	return c.client.Sys().ListAuth()
 }
 
+func (c *BaseClient) ListMounts() (map[string]*vaultApi.MountOutput, error) {
+	return c.client.Sys().ListMounts()
+}
+
+// Return the names of the namespaces directly within this client's namespace
+func (c *BaseClient) ListNamespaces() ([]string, error) {
+	secret, err := c.client.Logical().List("sys/namespaces")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if secret == nil || secret.Data == nil {
+		return names, nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, k := range keys {
+		names = append(names, strings.TrimSuffix(fmt.Sprintf("%v", k), "/"))
+	}
+	return names, nil
+}
+
 func (c *BaseClient) GetPolicy(name string) (string, error) {
 	return c.client.Sys().GetPolicy(name)
 }
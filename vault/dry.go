@@ -19,6 +19,15 @@ func (c *dryClient) EnableAuth(path string, options *vaultApi.EnableAuthOptions)
 	return nil
 }
 
+func (c *dryClient) TuneAuth(path string, data map[string]interface{}) error {
+	c.logger.WithFields(log.Fields{
+		"action": "TuneAuth",
+		"data":   data,
+		"path":   path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
 func (c *dryClient) DisableAuth(path string) error {
 	c.logger.WithFields(log.Fields{
 		"action": "DisableAuth",
@@ -27,6 +36,65 @@ func (c *dryClient) DisableAuth(path string) error {
 	return nil
 }
 
+func (c *dryClient) CreateNamespace(name string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "CreateNamespace",
+		"name":   name,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) DeleteNamespace(name string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "DeleteNamespace",
+		"name":   name,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) EnableAudit(path string, options *vaultApi.EnableAuditOptions) error {
+	c.logger.WithFields(log.Fields{
+		"action":  "EnableAudit",
+		"options": options,
+		"path":    path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) DisableAudit(path string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "DisableAudit",
+		"path":   path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) Mount(path string, mountInfo *vaultApi.MountInput) error {
+	c.logger.WithFields(log.Fields{
+		"action":    "Mount",
+		"mountInfo": mountInfo,
+		"path":      path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) TuneMount(path string, config vaultApi.MountConfigInput) error {
+	c.logger.WithFields(log.Fields{
+		"action": "TuneMount",
+		"config": config,
+		"path":   path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
+func (c *dryClient) Unmount(path string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "Unmount",
+		"path":   path,
+	}).Debug("No Vault API call made")
+	return nil
+}
+
 func (c *dryClient) PutPolicy(name string, data string) error {
 	c.logger.WithFields(log.Fields{
 		"action": "PutPolicy",
@@ -23,6 +23,45 @@ func (m *MockClient) Authenticate(role string) error {
 	return m.ReturnError
 }
 
+func (m *MockClient) Logout() error {
+	return nil
+}
+
+// Namespaces are not simulated, so the same client is used for all of them
+func (m *MockClient) WithNamespace(namespace string) (Vault, error) {
+	return m, m.ReturnError
+}
+
+// The mock makes no changes anyway, so the same client is used for dry runs
+func (m *MockClient) WithDryRun() (Vault, error) {
+	return m, m.ReturnError
+}
+
+func (m *MockClient) ListNamespaces() ([]string, error) {
+	return []string{}, m.ReturnError
+}
+
+func (m *MockClient) CreateNamespace(name string) error {
+	return m.ReturnError
+}
+
+func (m *MockClient) DeleteNamespace(name string) error {
+	return m.ReturnError
+}
+
+func (m *MockClient) ListAudit() (map[string]*vaultApi.Audit, error) {
+	rv := make(map[string]*vaultApi.Audit)
+	return rv, m.ReturnError
+}
+
+func (m *MockClient) EnableAudit(path string, options *vaultApi.EnableAuditOptions) error {
+	return m.ReturnError
+}
+
+func (m *MockClient) DisableAudit(path string) error {
+	return m.ReturnError
+}
+
 func (m *MockClient) DisableAuth(string) error {
 	return m.ReturnError
 }
@@ -31,11 +70,32 @@ func (m *MockClient) EnableAuth(path string, options *vaultApi.EnableAuthOptions
 	return m.ReturnError
 }
 
+func (m *MockClient) TuneAuth(path string, data map[string]interface{}) error {
+	return m.ReturnError
+}
+
 func (m *MockClient) ListAuth() (map[string]*vaultApi.AuthMount, error) {
 	rv := make(map[string]*vaultApi.AuthMount)
 	return rv, m.ReturnError
 }
 
+func (m *MockClient) ListMounts() (map[string]*vaultApi.MountOutput, error) {
+	rv := make(map[string]*vaultApi.MountOutput)
+	return rv, m.ReturnError
+}
+
+func (m *MockClient) Mount(path string, mountInfo *vaultApi.MountInput) error {
+	return m.ReturnError
+}
+
+func (m *MockClient) TuneMount(path string, config vaultApi.MountConfigInput) error {
+	return m.ReturnError
+}
+
+func (m *MockClient) Unmount(path string) error {
+	return m.ReturnError
+}
+
 func (m *MockClient) ListPolicies() ([]string, error) {
 	rv := make([]string, 0)
 	return rv, m.ReturnError
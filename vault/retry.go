@@ -0,0 +1,341 @@
+package vault
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	A client which wraps any other, retrying calls which fail for a reason which may pass, such as a
+	network error or a 5xx response while a standby takes over from the active node, and limiting
+	the rate of calls so that a large run does not overload Vault. As it only sees the Vault
+	interface, it wraps a dry client just as well as one which makes changes.
+
+	Calls are retried as a whole, so only those which have the same effect when made again are
+	retried. Others, such as enabling a mount or a check-and-set write, would fail or act twice if
+	the response to the first attempt was lost, so are made once, subject only to the rate limit.
+*/
+
+type RetryConfig struct {
+	MaxRetries        int           // retries of a failed call, after which its error is returned
+	MinBackoff        time.Duration // longest wait before the first retry, doubled for each after it
+	MaxBackoff        time.Duration // longest wait before any retry
+	RequestsPerSecond float64       // most calls started per second, unlimited if 0
+}
+
+// The status codes of responses to requests which may succeed if made again
+var retryableStatusCodes = map[int]bool{
+	412: true, // a performance standby has not yet caught up with the active node
+	429: true, // rate limited, or a performance standby which cannot serve the request
+	500: true, // e.g. "local node not active but active cluster node not found" during a failover
+	502: true,
+	503: true, // sealed, or a standby which cannot forward the request
+	504: true,
+}
+
+// The status code in the errors of the Vault api, e.g. "Code: 503. Errors:"
+var statusCodePattern = regexp.MustCompile(`Code: (\d+)\.`)
+
+// Parts of the messages of network errors which have lost their type by being wrapped
+var networkErrors = []string{"connection refused", "connection reset", "i/o timeout", "EOF"}
+
+type retryClient struct {
+	client  Vault
+	config  RetryConfig
+	limiter *rateLimiter // shared with the clients for other namespaces, so the limit is overall
+}
+
+// Wrap client with retries and a rate limit
+func WithRetries(client Vault, config RetryConfig) Vault {
+	return &retryClient{
+		client:  client,
+		config:  config,
+		limiter: newRateLimiter(config.RequestsPerSecond),
+	}
+}
+
+// Make a call which is not safe to retry, once
+func (c *retryClient) once(fn func() error) error {
+	c.limiter.wait()
+	return fn()
+}
+
+// Make the call, retrying it with a backoff while it fails with a retryable error
+func (c *retryClient) do(call string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		c.limiter.wait()
+		err := fn()
+		if err == nil || attempt >= c.config.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		wait := c.backoff(attempt)
+		log.WithFields(log.Fields{
+			"call":    call,
+			"attempt": attempt + 1,
+		}).Warnf("Vault call failed, retrying in %s: %s", wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// Return the wait before the given retry: exponential, with a random half of it as jitter so that
+// workers which failed together do not all retry together
+func (c *retryClient) backoff(attempt int) time.Duration {
+	ceiling := c.config.MinBackoff << uint(attempt)
+	if ceiling > c.config.MaxBackoff || ceiling <= 0 {
+		ceiling = c.config.MaxBackoff
+	}
+	return ceiling/2 + time.Duration(rand.Int63n(int64(ceiling/2)+1))
+}
+
+// Return true if the call which returned err may succeed if it is made again
+func isRetryable(err error) bool {
+	if match := statusCodePattern.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return retryableStatusCodes[code]
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	for _, message := range networkErrors {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Spaces out calls so that no more than a given number start each second
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time // when the next call may start
+}
+
+// Return a limiter for perSecond calls a second, or nil, which does not limit, if perSecond is 0
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait until the next call may start
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mutex.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+// Not retried, as a login whose response was lost leaves a token which would never be revoked
+func (c *retryClient) Authenticate(role string) error {
+	return c.once(func() error {
+		return c.client.Authenticate(role)
+	})
+}
+
+// Not retried, as the token may have been revoked by the attempt which failed
+func (c *retryClient) Logout() error {
+	return c.client.Logout()
+}
+
+func (c *retryClient) WithNamespace(namespace string) (Vault, error) {
+	client, err := c.client.WithNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &retryClient{client: client, config: c.config, limiter: c.limiter}, nil
+}
+
+func (c *retryClient) WithDryRun() (Vault, error) {
+	client, err := c.client.WithDryRun()
+	if err != nil {
+		return nil, err
+	}
+	return &retryClient{client: client, config: c.config, limiter: c.limiter}, nil
+}
+
+func (c *retryClient) GetPolicy(name string) (policy string, err error) {
+	err = c.do("GetPolicy "+name, func() error {
+		policy, err = c.client.GetPolicy(name)
+		return err
+	})
+	return policy, err
+}
+
+func (c *retryClient) List(path string) (secret *vaultApi.Secret, err error) {
+	err = c.do("List "+path, func() error {
+		secret, err = c.client.List(path)
+		return err
+	})
+	return secret, err
+}
+
+func (c *retryClient) ListAudit() (audits map[string]*vaultApi.Audit, err error) {
+	err = c.do("ListAudit", func() error {
+		audits, err = c.client.ListAudit()
+		return err
+	})
+	return audits, err
+}
+
+func (c *retryClient) ListAuth() (auths map[string]*vaultApi.AuthMount, err error) {
+	err = c.do("ListAuth", func() error {
+		auths, err = c.client.ListAuth()
+		return err
+	})
+	return auths, err
+}
+
+func (c *retryClient) ListMounts() (mounts map[string]*vaultApi.MountOutput, err error) {
+	err = c.do("ListMounts", func() error {
+		mounts, err = c.client.ListMounts()
+		return err
+	})
+	return mounts, err
+}
+
+func (c *retryClient) ListNamespaces() (names []string, err error) {
+	err = c.do("ListNamespaces", func() error {
+		names, err = c.client.ListNamespaces()
+		return err
+	})
+	return names, err
+}
+
+func (c *retryClient) ListPolicies() (names []string, err error) {
+	err = c.do("ListPolicies", func() error {
+		names, err = c.client.ListPolicies()
+		return err
+	})
+	return names, err
+}
+
+func (c *retryClient) Read(path string) (secret *vaultApi.Secret, err error) {
+	err = c.do("Read "+path, func() error {
+		secret, err = c.client.Read(path)
+		return err
+	})
+	return secret, err
+}
+
+// Not retried, as creating a namespace which exists is an error, as is deleting one which does not
+func (c *retryClient) CreateNamespace(name string) error {
+	return c.once(func() error {
+		return c.client.CreateNamespace(name)
+	})
+}
+
+func (c *retryClient) Delete(path string) (secret *vaultApi.Secret, err error) {
+	err = c.do("Delete "+path, func() error {
+		secret, err = c.client.Delete(path)
+		return err
+	})
+	return secret, err
+}
+
+func (c *retryClient) DeleteNamespace(name string) error {
+	return c.once(func() error {
+		return c.client.DeleteNamespace(name)
+	})
+}
+
+func (c *retryClient) DeletePolicy(name string) error {
+	return c.do("DeletePolicy "+name, func() error {
+		return c.client.DeletePolicy(name)
+	})
+}
+
+// Not retried, as Vault refuses to disable a device which is not enabled
+func (c *retryClient) DisableAudit(path string) error {
+	return c.once(func() error {
+		return c.client.DisableAudit(path)
+	})
+}
+
+func (c *retryClient) DisableAuth(path string) error {
+	return c.do("DisableAuth "+path, func() error {
+		return c.client.DisableAuth(path)
+	})
+}
+
+// Enabling and mounting are not retried, as enabling a path which is already in use is an error
+func (c *retryClient) EnableAudit(path string, options *vaultApi.EnableAuditOptions) error {
+	return c.once(func() error {
+		return c.client.EnableAudit(path, options)
+	})
+}
+
+func (c *retryClient) EnableAuth(path string, options *vaultApi.EnableAuthOptions) error {
+	return c.once(func() error {
+		return c.client.EnableAuth(path, options)
+	})
+}
+
+func (c *retryClient) Mount(path string, mountInfo *vaultApi.MountInput) error {
+	return c.once(func() error {
+		return c.client.Mount(path, mountInfo)
+	})
+}
+
+func (c *retryClient) PutPolicy(name string, policy string) error {
+	return c.do("PutPolicy "+name, func() error {
+		return c.client.PutPolicy(name, policy)
+	})
+}
+
+func (c *retryClient) TuneAuth(path string, data map[string]interface{}) error {
+	return c.do("TuneAuth "+path, func() error {
+		return c.client.TuneAuth(path, data)
+	})
+}
+
+func (c *retryClient) TuneMount(path string, config vaultApi.MountConfigInput) error {
+	return c.do("TuneMount "+path, func() error {
+		return c.client.TuneMount(path, config)
+	})
+}
+
+func (c *retryClient) Unmount(path string) error {
+	return c.do("Unmount "+path, func() error {
+		return c.client.Unmount(path)
+	})
+}
+
+// Writes are retried unless they are check-and-set, which fails when made again once it succeeded
+func (c *retryClient) Write(path string, data map[string]interface{}) (secret *vaultApi.Secret, err error) {
+	fn := func() error {
+		secret, err = c.client.Write(path, data)
+		return err
+	}
+	if isCheckAndSet(data) {
+		err = c.once(fn)
+	} else {
+		err = c.do("Write "+path, fn)
+	}
+	return secret, err
+}
+
+// Return true if data is for a KV version 2 write with the cas option
+func isCheckAndSet(data map[string]interface{}) bool {
+	options, _ := data["options"].(map[string]interface{})
+	_, ok := options["cas"]
+	return ok
+}
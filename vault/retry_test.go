@@ -0,0 +1,165 @@
+package vault
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryConfig = RetryConfig{
+	MaxRetries: 3,
+	MinBackoff: time.Millisecond,
+	MaxBackoff: 10 * time.Millisecond,
+}
+
+// A Vault stand-in which fails the first failures requests with status, then serves a secret, and
+// counts the requests it receives
+func newFlakyServer(failures int32, status int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"errors": ["failed"]}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"key": "value"}}`))
+	}))
+	return server, &requests
+}
+
+func TestWithRetries_retriesServerErrors(t *testing.T) {
+	server, requests := newFlakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	c := WithRetries(newTestClient(t, server.URL, nil), testRetryConfig)
+	secret, err := c.Read("secret/foo")
+	if err != nil {
+		t.Fatalf("Error calling Read: %s", err)
+	}
+	if secret == nil || secret.Data["key"] != "value" {
+		t.Errorf("Expected secret once retried, got %+v", secret)
+	}
+	if *requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestWithRetries_givesUp(t *testing.T) {
+	server, requests := newFlakyServer(10, http.StatusBadGateway)
+	defer server.Close()
+
+	c := WithRetries(newTestClient(t, server.URL, nil), testRetryConfig)
+	_, err := c.Read("secret/foo")
+	if err == nil {
+		t.Errorf("Expected error once retries are used up")
+	}
+	if *requests != 4 {
+		t.Errorf("Expected 4 requests, got %d", *requests)
+	}
+}
+
+func TestWithRetries_doesNotRetryClientErrors(t *testing.T) {
+	server, requests := newFlakyServer(10, http.StatusForbidden)
+	defer server.Close()
+
+	c := WithRetries(newTestClient(t, server.URL, nil), testRetryConfig)
+	_, err := c.Read("secret/foo")
+	if err == nil {
+		t.Errorf("Expected permission denied error")
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+}
+
+func TestWithRetries_retriesNetworkErrors(t *testing.T) {
+	server, _ := newFlakyServer(0, 0)
+	address := server.URL
+	server.Close()
+
+	c := WithRetries(newTestClient(t, address, nil), RetryConfig{MaxRetries: 2})
+	start := time.Now()
+	_, err := c.Read("secret/foo")
+	if err == nil {
+		t.Fatalf("Expected error when Vault is not listening")
+	}
+	if !isRetryable(err) {
+		t.Errorf("Expected connection error to be retryable: %s", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected retries without backoff to be quick")
+	}
+}
+
+// A check-and-set write may have succeeded even though its response was lost, and would then fail
+func TestWithRetries_doesNotRetryCheckAndSet(t *testing.T) {
+	server, requests := newFlakyServer(1, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	c := WithRetries(newTestClient(t, server.URL, nil), testRetryConfig)
+	_, err := c.Write("secret/data/foo", map[string]interface{}{
+		"data":    map[string]interface{}{"key": "value"},
+		"options": map[string]interface{}{"cas": 1},
+	})
+	if err == nil {
+		t.Errorf("Expected error from the only attempt")
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+
+	_, err = c.Write("secret/foo", map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Errorf("Expected plain write to succeed, got %s", err)
+	}
+}
+
+// Writes through a dry client are not made, however many times they are retried
+func TestWithRetries_dryRun(t *testing.T) {
+	server, requests := newFlakyServer(0, 0)
+	defer server.Close()
+
+	c, err := WithRetries(newTestClient(t, server.URL, nil), testRetryConfig).WithDryRun()
+	if err != nil {
+		t.Fatalf("Error calling WithDryRun: %s", err)
+	}
+	if _, ok := c.(*retryClient); !ok {
+		t.Errorf("Expected dry client to keep retrying, got %T", c)
+	}
+	_, err = c.Write("secret/foo", map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("Error calling Write: %s", err)
+	}
+	if *requests != 0 {
+		t.Errorf("Expected no requests, got %d", *requests)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected 6 calls at 100 per second to take at least 50ms, took %s", elapsed)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[string]bool{
+		"Error making API request.\n\nURL: GET /v1/secret\nCode: 503. Errors:\n\n": true,
+		"Error making API request.\n\nURL: GET /v1/secret\nCode: 429. Errors:\n\n": true,
+		"Error making API request.\n\nURL: GET /v1/secret\nCode: 400. Errors:\n\n": false,
+		"dial tcp [::1]:8200: getsockopt: connection refused":                      true,
+		"invalid policy foo": false,
+	}
+	for message, expected := range cases {
+		if isRetryable(errors.New(message)) != expected {
+			t.Errorf("Expected retryable %t for %q", expected, message)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package vault
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"time"
+)
+
+/*
+	The lifecycle of the token used by a client. Once authenticated, the token is renewed in the
+	background so that it does not expire during a long run, until Logout is called. Tokens which
+	vaultsmith obtained by logging in are revoked by Logout, so that no privileged tokens are left
+	behind; tokens given to vaultsmith, by VAULT_TOKEN or a token file, belong to the caller and are
+	left alone.
+*/
+
+// The least time to wait between renewals, so that a token close to its max TTL is not hammered
+const minRenewInterval = time.Second
+
+// Renew the token in the background if it is renewable. self is the token's lookup.
+func (c *BaseClient) startRenewal(self *vaultApi.Secret) {
+	renewable, _ := self.TokenIsRenewable()
+	ttl, _ := self.TokenTTL()
+	if !renewable || ttl <= 0 {
+		c.logger.Debug("Token is not renewable")
+		return
+	}
+	c.stopRenewal = make(chan struct{})
+	c.renewalDone = make(chan struct{})
+	go c.renew(ttl)
+}
+
+// Renew the token when half its TTL has passed, until stopRenewal is closed or the token can no
+// longer be renewed. When a renewal fails it is retried sooner, before the token expires.
+func (c *BaseClient) renew(ttl time.Duration) {
+	defer close(c.renewalDone)
+	for {
+		wait := ttl / 2
+		if wait < minRenewInterval {
+			wait = minRenewInterval
+		}
+		select {
+		case <-c.stopRenewal:
+			return
+		case <-time.After(wait):
+		}
+
+		secret, err := c.client.Auth().Token().RenewSelf(0)
+		if err != nil {
+			c.logger.Warnf("Could not renew token: %s", err)
+			ttl = wait
+			continue
+		}
+		ttl, _ = secret.TokenTTL()
+		if ttl <= 0 {
+			c.logger.Warn("Token has reached its max TTL and can no longer be renewed")
+			return
+		}
+		c.logger.Debugf("Renewed token, TTL %s", ttl)
+	}
+}
+
+// Stop renewing the token, and revoke it if vaultsmith obtained it by logging in
+func (c *BaseClient) Logout() error {
+	if c.stopRenewal != nil {
+		close(c.stopRenewal)
+		<-c.renewalDone
+		c.stopRenewal = nil
+	}
+	if !c.ownsToken {
+		return nil
+	}
+
+	c.logger.Debug("Revoking token")
+	c.ownsToken = false
+	err := c.client.Auth().Token().RevokeSelf("")
+	c.client.ClearToken()
+	return err
+}
@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Vault stand-in which issues renewable tokens with a short TTL, and counts renewals and
+// revocations
+type tokenServer struct {
+	*httptest.Server
+	renewals    int32
+	revocations int32
+}
+
+func newTokenServer() *tokenServer {
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.Write([]byte(`{"auth": {"client_token": "login-token", "lease_duration": 2, "renewable": true}}`))
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data": {"id": "login-token", "ttl": 2, "renewable": true}}`))
+		case "/v1/auth/token/renew-self":
+			atomic.AddInt32(&s.renewals, 1)
+			w.Write([]byte(`{"auth": {"client_token": "login-token", "lease_duration": 2, "renewable": true}}`))
+		case "/v1/auth/token/revoke-self":
+			atomic.AddInt32(&s.revocations, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func TestLogout_revokesOwnToken(t *testing.T) {
+	server := newTokenServer()
+	defer server.Close()
+
+	os.Setenv("VAULT_ROLE_ID", "my-role")
+	os.Setenv("VAULT_SECRET_ID", "my-secret")
+	defer os.Unsetenv("VAULT_ROLE_ID")
+	defer os.Unsetenv("VAULT_SECRET_ID")
+
+	c := newTestClient(t, server.URL, &appRoleAuth{mount: "approle"})
+	err := c.Authenticate("root")
+	if err != nil {
+		t.Fatalf("Error calling Authenticate: %s", err)
+	}
+
+	// renewed once half the TTL has passed
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&server.renewals) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&server.renewals) == 0 {
+		t.Errorf("Expected token to be renewed")
+	}
+
+	err = c.Logout()
+	if err != nil {
+		t.Fatalf("Error calling Logout: %s", err)
+	}
+	if server.revocations != 1 {
+		t.Errorf("Expected token to be revoked once, got %d", server.revocations)
+	}
+	if c.client.Token() != "" {
+		t.Errorf("Expected token to be cleared, got %q", c.client.Token())
+	}
+
+	renewals := atomic.LoadInt32(&server.renewals)
+	time.Sleep(1500 * time.Millisecond)
+	if atomic.LoadInt32(&server.renewals) != renewals {
+		t.Errorf("Expected renewal to stop after Logout")
+	}
+}
+
+// Tokens given by the environment belong to the caller, so are renewed but not revoked
+func TestLogout_keepsGivenToken(t *testing.T) {
+	server := newTokenServer()
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, &appRoleAuth{mount: "approle"})
+	c.client.SetToken("login-token")
+	err := c.Authenticate("root")
+	if err != nil {
+		t.Fatalf("Error calling Authenticate: %s", err)
+	}
+	if c.stopRenewal == nil {
+		t.Errorf("Expected token from the environment to be renewed")
+	}
+
+	err = c.Logout()
+	if err != nil {
+		t.Fatalf("Error calling Logout: %s", err)
+	}
+	if server.revocations != 0 {
+		t.Errorf("Expected token not to be revoked, got %d revocations", server.revocations)
+	}
+	if c.client.Token() != "login-token" {
+		t.Errorf("Expected token to be kept, got %q", c.client.Token())
+	}
+}
@@ -3,6 +3,7 @@ package vault
 import (
 	vaultApi "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 type writeClient struct {
@@ -20,6 +21,17 @@ func (c *writeClient) EnableAuth(path string, options *vaultApi.EnableAuthOption
 	return c.client.Sys().EnableAuthWithOptions(path, options)
 }
 
+// Tune the config of an auth mount in place, which unlike re-enabling it keeps its roles
+func (c *writeClient) TuneAuth(path string, data map[string]interface{}) error {
+	c.logger.WithFields(log.Fields{
+		"action": "TuneAuth",
+		"data":   data,
+		"path":   path,
+	}).Debug("Calling Vault API")
+	_, err := c.client.Logical().Write("sys/auth/"+strings.TrimSuffix(path, "/")+"/tune", data)
+	return err
+}
+
 func (c *writeClient) DisableAuth(path string) error {
 	c.logger.WithFields(log.Fields{
 		"action": "DisableAuth",
@@ -28,6 +40,70 @@ func (c *writeClient) DisableAuth(path string) error {
 	return c.client.Sys().DisableAuth(path)
 }
 
+// Used by sysNamespacesHandler
+func (c *writeClient) CreateNamespace(name string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "CreateNamespace",
+		"name":   name,
+	}).Debug("Calling Vault API")
+	_, err := c.client.Logical().Write("sys/namespaces/"+name, nil)
+	return err
+}
+
+func (c *writeClient) DeleteNamespace(name string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "DeleteNamespace",
+		"name":   name,
+	}).Debug("Calling Vault API")
+	_, err := c.client.Logical().Delete("sys/namespaces/" + name)
+	return err
+}
+
+// Used by sysAuditHandler
+func (c *writeClient) EnableAudit(path string, options *vaultApi.EnableAuditOptions) error {
+	c.logger.WithFields(log.Fields{
+		"action":  "EnableAudit",
+		"options": options,
+		"path":    path,
+	}).Debug("Calling Vault API")
+	return c.client.Sys().EnableAuditWithOptions(path, options)
+}
+
+func (c *writeClient) DisableAudit(path string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "DisableAudit",
+		"path":   path,
+	}).Debug("Calling Vault API")
+	return c.client.Sys().DisableAudit(path)
+}
+
+// Used by sysMountsHandler
+func (c *writeClient) Mount(path string, mountInfo *vaultApi.MountInput) error {
+	c.logger.WithFields(log.Fields{
+		"action":    "Mount",
+		"mountInfo": mountInfo,
+		"path":      path,
+	}).Debug("Calling Vault API")
+	return c.client.Sys().Mount(path, mountInfo)
+}
+
+func (c *writeClient) TuneMount(path string, config vaultApi.MountConfigInput) error {
+	c.logger.WithFields(log.Fields{
+		"action": "TuneMount",
+		"config": config,
+		"path":   path,
+	}).Debug("Calling Vault API")
+	return c.client.Sys().TuneMount(path, config)
+}
+
+func (c *writeClient) Unmount(path string) error {
+	c.logger.WithFields(log.Fields{
+		"action": "Unmount",
+		"path":   path,
+	}).Debug("Calling Vault API")
+	return c.client.Sys().Unmount(path)
+}
+
 // Used by sysPolicyHandler
 func (c *writeClient) PutPolicy(name string, data string) error {
 	c.logger.WithFields(log.Fields{
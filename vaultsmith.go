@@ -7,12 +7,19 @@ import (
 	"os"
 	"strings"
 
+	"github.com/starlingbank/vaultsmith/backup"
 	"github.com/starlingbank/vaultsmith/config"
 	"github.com/starlingbank/vaultsmith/document"
 	"github.com/starlingbank/vaultsmith/internal"
+	"github.com/starlingbank/vaultsmith/lock"
+	"github.com/starlingbank/vaultsmith/path_handlers"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/safety"
 	"github.com/starlingbank/vaultsmith/vault"
 	"io/ioutil"
 	"path/filepath"
+	"time"
 )
 
 var flags = flag.NewFlagSet("Vaultsmith", flag.ExitOnError)
@@ -25,6 +32,34 @@ var templateParams []string
 var httpAuthToken string
 var tarDir string
 var noCleanUp bool
+var planFile string
+var applyPlanFile string
+var reportFile string
+var exportDir string
+var exportPaths []string
+var allowNoAudit bool
+var allowAuthRemount bool
+var allowUnmount bool
+var namespace string
+var authMethod string
+var authMount string
+var safetyFile string
+var maxDeletions int
+var maxDeletionPercent int
+var maxAuthDisables int
+var maxUnmounts int
+var maxNamespaceDeletes int
+var allowMassDeletion bool
+var statePath string
+var strict bool
+var backupDir string
+var restoreFile string
+var lockPath string
+var lockTimeout time.Duration
+var forceUnlock bool
+var workers int
+var maxRetries int
+var rateLimit float64
 
 func init() {
 	flags.StringVar(
@@ -34,7 +69,17 @@ func init() {
 			"tarball or http url to a gz tarball.",
 	)
 	flags.StringVar(
-		&vaultRole, "role", "root", "The Vault role to authenticate as",
+		&vaultRole, "role", "root", "The Vault role to authenticate as, for the aws and "+
+			"kubernetes auth methods",
+	)
+	flags.StringVar(
+		&authMethod, "auth-method", "aws", fmt.Sprintf("The method to log in to Vault with when "+
+			"VAULT_TOKEN is not set, valid values are %v. See the notes below for the credentials "+
+			"each one needs.", vault.AuthMethodNames()),
+	)
+	flags.StringVar(
+		&authMount, "auth-mount", "", "The path the auth method is mounted at, if it is not the "+
+			"default for the method, e.g. approle",
 	)
 	flags.StringVar(
 		&templateFile, "template-file", "", "JSON file containing template "+
@@ -65,6 +110,126 @@ func init() {
 	flags.BoolVar(
 		&noCleanUp, "no-cleanup", false, "Don't clean up temp directory on exit",
 	)
+	flags.StringVar(
+		&planFile, "plan-file", "", "Write the planned changes to this file, so they can be "+
+			"reviewed and applied later with --apply-plan. Requires --dry.",
+	)
+	flags.StringVar(
+		&applyPlanFile, "apply-plan", "", "Apply exactly the changes in a file written by "+
+			"--plan-file. Refuses to run if Vault has changed since the plan was made. If "+
+			"document-path is also given, also refuses to run if the documents have changed.",
+	)
+	flags.StringVar(
+		&reportFile, "report-file", "", "Write a JSON report of the run to this file, listing "+
+			"the action taken for each path by each handler, timings and any errors. Cannot be "+
+			"used with --export-dir or --force-unlock.",
+	)
+	flags.StringVar(
+		&exportDir, "export-dir", "", "Instead of applying documents, export the current "+
+			"configuration of Vault to this directory, in the same layout as document-path. "+
+			"Exports sys/mounts, sys/audit, sys/auth, sys/policy, identity and any paths in "+
+			"--export-paths. The directory must be empty or not exist.",
+	)
+	flags.StringSliceVar(
+		&exportPaths, "export-paths", []string{}, "Paths to export with --export-dir, in "+
+			"addition to those always exported. E.G.: auth/approle/role,auth/aws/role",
+	)
+	flags.BoolVar(
+		&allowNoAudit, "allow-no-audit", false, "Allow disabling the last audit device when it "+
+			"is not declared in sys/audit. By default it is left enabled, so that Vault is never "+
+			"left without an audit log.",
+	)
+	flags.BoolVar(
+		&allowAuthRemount, "allow-auth-remount", false, "Allow disabling and enabling again an "+
+			"auth mount whose type, local or seal_wrap setting has changed. This DELETES all "+
+			"roles and config under the mount. Other changes are applied by tuning the mount.",
+	)
+	flags.BoolVar(
+		&allowUnmount, "allow-unmount", false, "Allow unmounting secret engines which are not "+
+			"declared in sys/mounts. This DELETES all secrets stored in them. By default they "+
+			"are left mounted.",
+	)
+	flags.StringVar(
+		&namespace, "namespace", "", "Vault Enterprise namespace to apply documents in, e.g. "+
+			"team-a. Namespaces declared under _namespaces in the document path are relative to "+
+			"this one. Defaults to the root namespace.",
+	)
+	flags.StringVar(
+		&safetyFile, "safety-file", "", "JSON or YAML file of safety rules: \"protected\" globs "+
+			"of paths which are never updated or deleted, and \"managed\" globs of the only paths "+
+			"which may be changed at all. Changes they refuse are skipped with a warning.",
+	)
+	flags.IntVar(
+		&maxDeletions, "max-deletions", 50, "Refuse to run if any handler, or all of them "+
+			"together, would delete more than this many paths. -1 for no limit.",
+	)
+	flags.IntVar(
+		&maxDeletionPercent, "max-deletion-percent", 50, "Refuse to run if any handler, or all "+
+			"of them together, would delete more than this percentage of the paths it found in "+
+			"Vault. Only applies from 10 paths upwards. -1 for no limit.",
+	)
+	flags.IntVar(
+		&maxAuthDisables, "max-auth-disables", 1, "Refuse to run if more than this many auth "+
+			"mounts would be disabled, as this deletes all of their roles. -1 for no limit.",
+	)
+	flags.IntVar(
+		&maxUnmounts, "max-unmounts", 1, "Refuse to run if more than this many secret engines "+
+			"would be unmounted, as this deletes all of their secrets. -1 for no limit.",
+	)
+	flags.IntVar(
+		&maxNamespaceDeletes, "max-namespace-deletes", 1, "Refuse to run if more than this many "+
+			"namespaces would be deleted, as this deletes everything in them. -1 for no limit.",
+	)
+	flags.BoolVar(
+		&allowMassDeletion, "allow-mass-deletion", false, "Ignore --max-deletions, "+
+			"--max-deletion-percent, --max-auth-disables, --max-unmounts and "+
+			"--max-namespace-deletes, e.g. when deleting a lot on purpose.",
+	)
+	flags.StringVar(
+		&statePath, "state-path", "", "Track the documents vaultsmith writes in a state document "+
+			"at this path in Vault, e.g. secret/vaultsmith/state, and only delete undeclared "+
+			"documents which it wrote before, so that a mount can be shared with documents "+
+			"managed by hand.",
+	)
+	flags.BoolVar(
+		&strict, "strict", false, "With --state-path, delete every undeclared document in a "+
+			"declared directory, as vaultsmith does without it, not only those it wrote.",
+	)
+	flags.StringVar(
+		&backupDir, "backup-dir", "", "Before making any changes, save the current value of "+
+			"every path about to be changed or deleted to a timestamped archive in this "+
+			"directory, which can be restored with --restore.",
+	)
+	flags.StringVar(
+		&restoreFile, "restore", "", "Put the paths in an archive written with --backup-dir back "+
+			"to the values saved in it, instead of applying documents.",
+	)
+	flags.StringVar(
+		&lockPath, "lock-path", "", "Hold a lock in this secret while making changes, e.g. "+
+			"secret/vaultsmith/lock, so that only one run changes Vault at a time. Must be in a KV "+
+			"version 2 mount.",
+	)
+	flags.DurationVar(
+		&lockTimeout, "lock-timeout", 5*time.Minute, "How long to wait for the lock at "+
+			"--lock-path while another run holds it.",
+	)
+	flags.BoolVar(
+		&forceUnlock, "force-unlock", false, "Remove the lock at --lock-path whoever holds it, "+
+			"e.g. after a run was killed, instead of applying documents.",
+	)
+	flags.IntVar(
+		&workers, "workers", 4, "How many documents, and how many policies, to compare with "+
+			"Vault and apply at once. Handlers still run one after another.",
+	)
+	flags.IntVar(
+		&maxRetries, "max-retries", 5, "How many times to retry a Vault request which fails "+
+			"with a network error or a 412, 429, 500, 502, 503 or 504 response, with an "+
+			"exponential backoff between attempts.",
+	)
+	flags.Float64Var(
+		&rateLimit, "rate-limit", 0, "The most requests per second to make to Vault. 0 for no "+
+			"limit.",
+	)
 
 	flags.Usage = func() {
 		fmt.Printf("Usage of vaultsmith:\n")
@@ -75,12 +240,21 @@ func init() {
 			"• Vault authentication is handled by environment variables (the same " +
 			"ones as the Vault client, as vaultsmith uses the same code). So ensure VAULT_ADDR " +
 			"and VAULT_TOKEN are set.\n" +
+			"• Without VAULT_TOKEN, vaultsmith logs in with --auth-method: aws uses the AWS " +
+			"credentials of the environment; approle uses VAULT_ROLE_ID and VAULT_SECRET_ID; " +
+			"kubernetes uses the service account token of the pod, or the file named by " +
+			"VAULT_KUBERNETES_TOKEN_FILE; userpass uses VAULT_USERNAME and VAULT_PASSWORD; " +
+			"token-file reads the token from VAULT_TOKEN_FILE, or ~/.vault-token. Each " +
+			"credential may instead be read from the file named by the same variable with a " +
+			"_FILE suffix, e.g. VAULT_SECRET_ID_FILE.\n" +
 			"• Files that start with an underscore (e.g. _vaultsmith.json) are not published to " +
 			"vault.\n" +
 			"• If template-file is not specified, it is not mandatory for _vaultsmith.json to be " +
 			"present.\n" +
 			"• Specifying a parameter with --template-params allows only a single value. If you " +
-			"need multiple values, please use a template-file." +
+			"need multiple values, please use a template-file.\n" +
+			"• Exit codes: 0 on success, 1 on error. With --dry, 0 means no changes are needed " +
+			"and 2 means changes are pending, so a dry run can be used to detect drift." +
 			"\n\n")
 	}
 
@@ -110,9 +284,19 @@ func main() {
 	if dry {
 		log.Info("Dry mode enabled, no changes will be made")
 	}
-	if documentPath == "" {
+	if documentPath == "" && applyPlanFile == "" && exportDir == "" && restoreFile == "" &&
+		!forceUnlock {
 		log.Fatalln("Please specify --document-path")
 	}
+	if forceUnlock && lockPath == "" {
+		log.Fatalln("--force-unlock requires --lock-path")
+	}
+	if planFile != "" && !dry {
+		log.Fatalln("--plan-file can only be used with --dry")
+	}
+	if reportFile != "" && (exportDir != "" || forceUnlock) {
+		log.Fatalln("--report-file cannot be used with --export-dir or --force-unlock")
+	}
 	// Only check if specified, otherwise no template file is OK
 	if templateFile != "" {
 		if _, err := os.Stat(templateFile); os.IsNotExist(err) {
@@ -120,27 +304,88 @@ func main() {
 		}
 	}
 
+	safetyRules, err := safety.Load(safetyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	conf := config.VaultsmithConfig{
-		DocumentPath:   documentPath,
-		VaultRole:      vaultRole,
-		TemplateFile:   templateFile,
-		Dry:            dry,
-		TemplateParams: templateParams,
-		HttpAuthToken:  httpAuthToken,
-		TarDir:         tarDir,
+		DocumentPath:     documentPath,
+		VaultRole:        vaultRole,
+		TemplateFile:     templateFile,
+		Dry:              dry,
+		TemplateParams:   templateParams,
+		HttpAuthToken:    httpAuthToken,
+		TarDir:           tarDir,
+		PlanFile:         planFile,
+		ApplyPlanFile:    applyPlanFile,
+		ReportFile:       reportFile,
+		ExportDir:        exportDir,
+		ExportPaths:      exportPaths,
+		AllowNoAudit:     allowNoAudit,
+		AllowAuthRemount: allowAuthRemount,
+		AllowUnmount:     allowUnmount,
+		Namespace:        namespace,
+		AuthMethod:       authMethod,
+		AuthMount:        authMount,
+		StatePath:        statePath,
+		Strict:           strict,
+		BackupDir:        backupDir,
+		RestoreFile:      restoreFile,
+		Workers:          workers,
+		MaxRetries:       maxRetries,
+		RateLimit:        rateLimit,
+		Safety:           safetyRules,
+		LockPath:         lockPath,
+		LockTimeout:      lockTimeout,
+		ForceUnlock:      forceUnlock,
+	}
+	if !allowMassDeletion {
+		conf.DeletionLimits = &safety.DeletionLimits{
+			MaxDeletions:    maxDeletions,
+			MaxPercent:      maxDeletionPercent,
+			MaxAuthDisables: maxAuthDisables,
+
+			MaxUnmounts:         maxUnmounts,
+			MaxNamespaceDeletes: maxNamespaceDeletes,
+		}
+	}
+
+	auth, err := vault.NewAuthMethod(conf.AuthMethod, conf.AuthMount)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	var client vault.Vault
-	client, err = vault.NewVaultClient(conf.Dry)
+	client, err = vault.NewVaultClient(conf.Dry, conf.Namespace, auth)
 	if err != nil {
 		log.Fatal(err)
 	}
+	client = vault.WithRetries(client, vault.RetryConfig{
+		MaxRetries:        conf.MaxRetries,
+		MinBackoff:        250 * time.Millisecond,
+		MaxBackoff:        10 * time.Second,
+		RequestsPerSecond: conf.RateLimit,
+	})
 
-	err = Run(client, conf)
+	var result *Result
+	if conf.ForceUnlock {
+		result, err = ForceUnlock(client, conf)
+	} else if conf.ExportDir != "" {
+		result, err = Export(client, conf)
+	} else if conf.RestoreFile != "" {
+		result, err = Restore(client, conf)
+	} else if conf.ApplyPlanFile != "" {
+		result, err = Apply(client, conf)
+	} else {
+		result, err = Run(client, conf)
+	}
 	if err != nil {
-		log.Fatalf("Error: %s", err)
+		log.Errorf("Error: %s", err)
+		os.Exit(exitError)
 	}
 	log.Debugf("Success")
+	os.Exit(result.ExitCode())
 }
 
 func whichFileExists(filePath ...string) (file string) {
@@ -155,25 +400,36 @@ func whichFileExists(filePath ...string) (file string) {
 	return ""
 }
 
-func Run(c vault.Vault, config config.VaultsmithConfig) error {
-	err := c.Authenticate(config.VaultRole)
+func Run(c vault.Vault, config config.VaultsmithConfig) (result *Result, err error) {
+	runReport := report.New(config.Dry)
+	// written however the run ends, so that failures are reported too
+	defer func() { saveReport(runReport, config, err) }()
+
+	err = c.Authenticate(config.VaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating with Vault: %s", err)
+	}
+	defer logout(c)
+
+	runLock, unlock, err := takeLock(c, config)
 	if err != nil {
-		return fmt.Errorf("failed authenticating with Vault: %s", err)
+		return nil, err
 	}
+	defer unlock()
 
 	workDir, err := ioutil.TempDir(os.TempDir(), "vaultsmith-")
 	if err != nil {
-		return fmt.Errorf("could not create temp directory: %s", err)
+		return nil, fmt.Errorf("could not create temp directory: %s", err)
 	}
 	defer os.Remove(workDir)
 
 	docSet, err := document.GetSet(workDir, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = docSet.Get()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !noCleanUp {
 		defer docSet.CleanUp()
@@ -181,7 +437,7 @@ func Run(c vault.Vault, config config.VaultsmithConfig) error {
 
 	docPath, err := docSet.Path()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Determine if we have a template file
@@ -190,9 +446,426 @@ func Run(c vault.Vault, config config.VaultsmithConfig) error {
 		filepath.Join(docPath, "_vaultsmith.json"),
 	)
 
-	cw, err := internal.NewConfigWalker(c, config, docPath)
+	// changes are made as the documents are walked, so must be planned beforehand to be checked
+	// or backed up
+	if !config.Dry && (config.DeletionLimits != nil || config.BackupDir != "") {
+		err = prepareRun(c, config, docPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cw, err := internal.NewConfigWalker(c, config, docPath, runReport)
+	if err != nil {
+		return nil, err
+	}
+	cw.Lock = runLock
+	err = cw.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Dry {
+		err = config.DeletionLimits.Check(safety.CountDeletions(runReport))
+		if err != nil {
+			// still show what would have been deleted
+			printChanges(cw.Changes, config.Dry)
+			return nil, deletionError(err)
+		}
+	}
+
+	if config.PlanFile != "" {
+		fingerprint, err := document.Fingerprint(docPath)
+		if err != nil {
+			return nil, err
+		}
+		f, err := plan.NewFile(cw.Changes, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Save(config.PlanFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Plan written to %s", config.PlanFile)
+	}
+
+	result = &Result{Dry: config.Dry, Changes: cw.Changes}
+	return result, printChanges(result.Changes, config.Dry)
+}
+
+// Apply the changes in a plan file written by Run, provided that the paths they affect have not
+// changed in Vault since. If a document path is configured, the documents must not have changed
+// either.
+func Apply(c vault.Vault, config config.VaultsmithConfig) (result *Result, err error) {
+	runReport := report.New(config.Dry)
+	defer func() { saveReport(runReport, config, err) }()
+
+	err = c.Authenticate(config.VaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating with Vault: %s", err)
+	}
+	defer logout(c)
+
+	runLock, unlock, err := takeLock(c, config)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	planFile, err := plan.Load(config.ApplyPlanFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DocumentPath != "" {
+		fingerprint, err := documentFingerprint(config)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint != planFile.DocumentFingerprint {
+			return nil, fmt.Errorf("documents in %s have changed since the plan was created, "+
+				"refusing to apply it", config.DocumentPath)
+		}
+	}
+
+	err = checkChanges(config, planFile.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted, err := path_handlers.DriftedChanges(c, planFile.Changes)
+	if err != nil {
+		return nil, fmt.Errorf("could not check for changes in Vault: %s", err)
+	}
+	if len(drifted) > 0 {
+		var paths []string
+		for _, change := range drifted {
+			paths = append(paths, change.FullPath())
+		}
+		return nil, fmt.Errorf("vault has changed since the plan was created, refusing to "+
+			"apply it. Changed paths: %s", strings.Join(paths, ", "))
+	}
+
+	if !config.Dry {
+		err = backUp(c, config.BackupDir, planFile.Changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = applyChanges(c, runLock, planFile.Changes, runReport)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Result{Dry: config.Dry, Changes: planFile.ChangeSet()}
+	return result, printChanges(result.Changes, config.Dry)
+}
+
+// Put the paths in the archive config.RestoreFile back to the values saved in it, undoing the
+// changes of the run which saved it in reverse order. Paths which already have their saved value
+// are left alone.
+func Restore(c vault.Vault, config config.VaultsmithConfig) (result *Result, err error) {
+	runReport := report.New(config.Dry)
+	defer func() { saveReport(runReport, config, err) }()
+
+	err = c.Authenticate(config.VaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating with Vault: %s", err)
+	}
+	defer logout(c)
+
+	runLock, unlock, err := takeLock(c, config)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshot, err := backup.Load(config.RestoreFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Restoring %d paths saved at %s", len(snapshot.Changes), snapshot.Created)
+
+	changes := plan.NewChangeSet()
+	for i := len(snapshot.Changes) - 1; i >= 0; i-- {
+		change, err := path_handlers.RestoreChange(c, snapshot.Changes[i])
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes.Add(*change)
+		}
+	}
+	err = checkChanges(config, changes.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyChanges(c, runLock, changes.Changes, runReport)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Result{Dry: config.Dry, Changes: changes}
+	return result, printChanges(result.Changes, config.Dry)
+}
+
+// Write the current configuration of Vault to config.ExportDir as a document tree, which can be
+// used as the document-path of a later run
+func Export(c vault.Vault, config config.VaultsmithConfig) (*Result, error) {
+	err := c.Authenticate(config.VaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating with Vault: %s", err)
+	}
+	defer logout(c)
+
+	// refuse to mix exported documents with existing ones
+	entries, err := ioutil.ReadDir(config.ExportDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %s", config.ExportDir, err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("export directory %s is not empty", config.ExportDir)
+	}
+
+	exporters := []func(vault.Vault, string) error{
+		path_handlers.ExportMounts,
+		path_handlers.ExportAudit,
+		path_handlers.ExportAuth,
+		path_handlers.ExportPolicies,
+		path_handlers.ExportIdentity,
+	}
+	for _, export := range exporters {
+		err = export(c, config.ExportDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range config.ExportPaths {
+		err = path_handlers.ExportGeneric(c, config.ExportDir, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof("Exported Vault configuration to %s", config.ExportDir)
+	return &Result{Dry: config.Dry}, nil
+}
+
+// Walk the documents with a client which makes no changes, and return an error if the run would
+// delete more than config.DeletionLimits allow. Then back up the paths the run will change.
+func prepareRun(c vault.Vault, config config.VaultsmithConfig, docPath string) error {
+	log.Info("Planning changes before making them")
+	dryClient, err := c.WithDryRun()
 	if err != nil {
 		return err
 	}
-	return cw.Run()
+	config.Dry = true
+	dryReport := report.New(true)
+	cw, err := internal.NewConfigWalker(dryClient, config, docPath, dryReport)
+	if err != nil {
+		return err
+	}
+	err = cw.Run()
+	if err != nil {
+		return err
+	}
+	err = config.DeletionLimits.Check(safety.CountDeletions(dryReport))
+	if err != nil {
+		return deletionError(err)
+	}
+	err = backUp(c, config.BackupDir, cw.Changes.Changes)
+	if err != nil {
+		return err
+	}
+	log.Info("Applying changes")
+	return nil
+}
+
+// Save the current value of the path of each change to an archive in dir, if dir is set
+func backUp(c vault.Vault, dir string, changes []plan.Change) error {
+	if dir == "" || len(changes) == 0 {
+		return nil
+	}
+	var captured []plan.Change
+	for _, change := range changes {
+		live, err := path_handlers.LiveValue(c, change)
+		if err != nil {
+			return fmt.Errorf("could not back up %s: %s", change.FullPath(), err)
+		}
+		captured = append(captured, plan.Change{
+			Path:       change.Path,
+			Action:     change.Action,
+			Handler:    change.Handler,
+			Namespace:  change.Namespace,
+			SourceFile: change.SourceFile,
+			Before:     live,
+		})
+	}
+	archive, err := backup.New(captured).Save(dir)
+	if err != nil {
+		return err
+	}
+	log.Infof("Backed up %d paths to %s", len(captured), archive)
+	return nil
+}
+
+// Make changes which were not computed by this run, provided l is still held, recording each in
+// r under a handler run for each group of consecutive changes by the same handler
+func applyChanges(c vault.Vault, l *lock.Lock, changes []plan.Change, r *report.Report) error {
+	var handler, namespace string
+	for i, change := range changes {
+		if i == 0 || change.Handler != handler || change.Namespace != namespace {
+			r.FinishHandler(nil)
+			r.StartHandler(change.Handler, "", change.Namespace)
+			handler, namespace = change.Handler, change.Namespace
+		}
+		log.WithFields(log.Fields{
+			"path":      change.Path,
+			"namespace": change.Namespace,
+			"action":    change.Action,
+			"handler":   change.Handler,
+		}).Info("Applying change")
+		// stop before changing Vault if another run may be changing it too
+		err := l.Check()
+		if err != nil {
+			r.FinishHandler(err)
+			return err
+		}
+		err = path_handlers.ApplyChange(c, change)
+		if err != nil {
+			err = fmt.Errorf("failed to %s %s: %s", change.Action, change.FullPath(), err)
+			r.FinishHandler(err)
+			return err
+		}
+		r.AddPath(report.PathResult{
+			Path:       change.Path,
+			Action:     path_handlers.ReportAction(change.Action),
+			SourceFile: change.SourceFile,
+		})
+	}
+	r.FinishHandler(nil)
+	return nil
+}
+
+// Write runReport to config.ReportFile, if set, with err as the outcome of the run
+func saveReport(runReport *report.Report, config config.VaultsmithConfig, err error) {
+	if config.ReportFile == "" {
+		return
+	}
+	runReport.Finish(err)
+	if saveErr := runReport.Save(config.ReportFile); saveErr != nil {
+		log.Errorf("Could not write report: %s", saveErr)
+	}
+}
+
+// Return an error if the safety rules or deletion limits of config refuse any of changes, which
+// were not computed by this run
+func checkChanges(config config.VaultsmithConfig, changes []plan.Change) error {
+	// the rules may have changed since the changes were computed, so are checked again
+	for _, change := range changes {
+		err := config.Safety.Check(change.FullPath(), change.Action)
+		if err != nil {
+			return fmt.Errorf("refusing to make changes the safety rules do not allow: %s", err)
+		}
+	}
+	err := config.DeletionLimits.Check(safety.CountPlanDeletions(changes))
+	if err != nil {
+		return deletionError(err)
+	}
+	return nil
+}
+
+func deletionError(err error) error {
+	return fmt.Errorf("%s. Check the document set, or use --allow-mass-deletion if this is "+
+		"intended", err)
+}
+
+// Remove the lock at config.LockPath, whoever holds it
+func ForceUnlock(c vault.Vault, config config.VaultsmithConfig) (*Result, error) {
+	err := c.Authenticate(config.VaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating with Vault: %s", err)
+	}
+	defer logout(c)
+
+	held, err := lock.ForceUnlock(c, config.LockPath)
+	if err != nil {
+		return nil, err
+	}
+	if held == nil {
+		log.Infof("Lock %s is not held", config.LockPath)
+	} else if config.Dry {
+		log.Infof("Would remove lock %s, held by %s", config.LockPath, held)
+	} else {
+		log.Infof("Removed lock %s, held by %s", config.LockPath, held)
+	}
+	return &Result{Dry: config.Dry, Changes: plan.NewChangeSet()}, nil
+}
+
+// Take the lock at config.LockPath, if there is one, unless this is a dry run, which changes
+// nothing. Returns the lock, or nil if there is none, and a function which releases it.
+func takeLock(c vault.Vault, config config.VaultsmithConfig) (*lock.Lock, func(), error) {
+	if config.LockPath == "" || config.Dry {
+		return nil, func() {}, nil
+	}
+	l, err := lock.New(c, config.LockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = l.Acquire(config.LockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, func() {
+		if err := l.Release(); err != nil {
+			log.Errorf("Could not release lock: %s", err)
+		}
+	}, nil
+}
+
+// Stop renewing the token of c, and revoke it if vaultsmith obtained it
+func logout(c vault.Vault) {
+	if err := c.Logout(); err != nil {
+		log.Warnf("Could not revoke Vault token: %s", err)
+	}
+}
+
+// Fetch the configured document set and return its fingerprint
+func documentFingerprint(config config.VaultsmithConfig) (string, error) {
+	workDir, err := ioutil.TempDir(os.TempDir(), "vaultsmith-")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp directory: %s", err)
+	}
+	defer os.Remove(workDir)
+
+	docSet, err := document.GetSet(workDir, config)
+	if err != nil {
+		return "", err
+	}
+	err = docSet.Get()
+	if err != nil {
+		return "", err
+	}
+	if !noCleanUp {
+		defer docSet.CleanUp()
+	}
+
+	docPath, err := docSet.Path()
+	if err != nil {
+		return "", err
+	}
+	return document.Fingerprint(docPath)
+}
+
+// Print a summary of changes for the user
+func printChanges(changes *plan.ChangeSet, dry bool) error {
+	if dry {
+		fmt.Println("Planned changes (dry run, nothing was written to Vault):")
+	} else {
+		fmt.Println("Applied changes:")
+	}
+	return changes.WriteSummary(os.Stdout)
 }
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	vaultApi "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
 	"github.com/starlingbank/vaultsmith/config"
+	"github.com/starlingbank/vaultsmith/plan"
+	"github.com/starlingbank/vaultsmith/report"
+	"github.com/starlingbank/vaultsmith/safety"
 	"github.com/starlingbank/vaultsmith/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -17,7 +26,7 @@ func TestRunWhenVaultNotListening(t *testing.T) {
 	conf.VaultRole = "ConnectionRefused"
 	mockClient.On("Authenticate", conf.VaultRole)
 
-	err := Run(mockClient, conf)
+	_, err := Run(mockClient, conf)
 	if err == nil {
 		log.Fatal("Expected error, got nil")
 	}
@@ -37,7 +46,7 @@ func TestRunWhenRoleIsInvalid(t *testing.T) {
 	conf.VaultRole = "InvalidRole"
 	mockClient.On("Authenticate", conf.VaultRole)
 
-	err := Run(mockClient, conf)
+	_, err := Run(mockClient, conf)
 	if err == nil {
 		log.Fatal("Expected error, got nil")
 	}
@@ -49,3 +58,257 @@ func TestRunWhenRoleIsInvalid(t *testing.T) {
 		t.Errorf("bad reason message '%s'", err.Error())
 	}
 }
+
+func writeTestPlan(t *testing.T, changes ...plan.Change) (path string, cleanUp func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := plan.NewChangeSet()
+	for _, c := range changes {
+		cs.Add(c)
+	}
+	f, err := plan.NewFile(cs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "plan.json")
+	if err = f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestApplyWhenVaultHasDrifted(t *testing.T) {
+	path, cleanUp := writeTestPlan(t, plan.Change{
+		Path:    "auth/approle/role/foo",
+		Action:  plan.Update,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"policies": "planned"},
+		After:   map[string]interface{}{"policies": "new"},
+	})
+	defer cleanUp()
+
+	conf := config.VaultsmithConfig{ApplyPlanFile: path}
+	mockClient := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"policies": "changed"}},
+	}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err := Apply(mockClient, conf)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "refusing to apply") {
+		t.Errorf("bad failure message '%s'", err.Error())
+	}
+}
+
+func TestApplyWhenVaultUnchanged(t *testing.T) {
+	path, cleanUp := writeTestPlan(t, plan.Change{
+		Path:    "auth/approle/role/foo",
+		Action:  plan.Update,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"policies": "planned"},
+		After:   map[string]interface{}{"policies": "new"},
+	})
+	defer cleanUp()
+
+	conf := config.VaultsmithConfig{ApplyPlanFile: path}
+	mockClient := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"policies": "planned"}},
+	}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err := Apply(mockClient, conf)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+}
+
+func TestApplyWritesBackup(t *testing.T) {
+	path, cleanUp := writeTestPlan(t, plan.Change{
+		Path:    "auth/approle/role/foo",
+		Action:  plan.Update,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"policies": "planned"},
+		After:   map[string]interface{}{"policies": "new"},
+	})
+	defer cleanUp()
+	backupDir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(backupDir)
+
+	conf := config.VaultsmithConfig{ApplyPlanFile: path, BackupDir: backupDir}
+	mockClient := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"policies": "planned"}},
+	}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err = Apply(mockClient, conf)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	archives, err := filepath.Glob(filepath.Join(backupDir, "vaultsmith-backup-*.tar.gz"))
+	if err != nil || len(archives) != 1 {
+		t.Fatalf("Expected one backup archive, got %v (%v)", archives, err)
+	}
+
+	// the mock still returns the saved value, so there is nothing to restore
+	result, err := Restore(mockClient, config.VaultsmithConfig{RestoreFile: archives[0]})
+	if err != nil {
+		t.Fatalf("Expected no error restoring, got %s", err)
+	}
+	if len(result.Changes.Changes) != 0 {
+		t.Errorf("Expected no changes restoring unchanged path, got %+v", result.Changes.Changes)
+	}
+}
+
+func TestApplyWhenChangeIsProtected(t *testing.T) {
+	path, cleanUp := writeTestPlan(t, plan.Change{
+		Path:    "secret/prod/db",
+		Action:  plan.Delete,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"password": "planned"},
+	})
+	defer cleanUp()
+
+	conf := config.VaultsmithConfig{
+		ApplyPlanFile: path,
+		Safety:        &safety.Rules{Protected: []string{"secret/prod"}},
+	}
+	mockClient := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"password": "planned"}},
+	}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err := Apply(mockClient, conf)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "secret/prod/db is protected") {
+		t.Errorf("bad failure message '%s'", err.Error())
+	}
+}
+
+func TestApplyWhenTooManyAuthDisables(t *testing.T) {
+	path, cleanUp := writeTestPlan(t,
+		plan.Change{Path: "sys/auth/ldap/", Action: plan.Delete, Handler: "SysAuth"},
+		plan.Change{Path: "sys/auth/github/", Action: plan.Delete, Handler: "SysAuth"},
+	)
+	defer cleanUp()
+
+	conf := config.VaultsmithConfig{
+		ApplyPlanFile:  path,
+		DeletionLimits: &safety.DeletionLimits{MaxDeletions: 50, MaxPercent: 50, MaxAuthDisables: 1},
+	}
+	mockClient := &vault.MockClient{}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err := Apply(mockClient, conf)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "--allow-mass-deletion") {
+		t.Errorf("bad failure message '%s'", err.Error())
+	}
+}
+
+// The report should be written even when the run fails
+func TestRunWritesReportOnError(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := config.VaultsmithConfig{
+		VaultRole:  "ConnectionRefused",
+		ReportFile: filepath.Join(dir, "report.json"),
+	}
+	mockClient := new(vault.MockClient)
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, runErr := Run(mockClient, conf)
+	if runErr == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	data, err := ioutil.ReadFile(conf.ReportFile)
+	if err != nil {
+		t.Fatalf("Report was not written: %s", err)
+	}
+	var r report.Report
+	if err = json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("Could not parse report: %s", err)
+	}
+	if r.Error != runErr.Error() {
+		t.Errorf("Expected report error %q, got %q", runErr.Error(), r.Error)
+	}
+}
+
+func TestApplyWritesReport(t *testing.T) {
+	path, cleanUp := writeTestPlan(t, plan.Change{
+		Path:    "auth/approle/role/foo",
+		Action:  plan.Update,
+		Handler: "Generic",
+		Before:  map[string]interface{}{"policies": "planned"},
+		After:   map[string]interface{}{"policies": "new"},
+	})
+	defer cleanUp()
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := config.VaultsmithConfig{ApplyPlanFile: path, ReportFile: filepath.Join(dir, "report.json")}
+	mockClient := &vault.MockClient{
+		ReturnSecret: &vaultApi.Secret{Data: map[string]interface{}{"policies": "planned"}},
+	}
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err = Apply(mockClient, conf)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	data, err := ioutil.ReadFile(conf.ReportFile)
+	if err != nil {
+		t.Fatalf("Report was not written: %s", err)
+	}
+	var r report.Report
+	if err = json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("Could not parse report: %s", err)
+	}
+	if len(r.Handlers) != 1 || r.Handlers[0].Handler != "Generic" {
+		t.Fatalf("Expected one Generic handler run, got %+v", r.Handlers)
+	}
+	expected := []report.PathResult{{Path: "auth/approle/role/foo", Action: report.Updated}}
+	if !reflect.DeepEqual(r.Handlers[0].Paths, expected) {
+		t.Errorf("Expected paths %+v, got %+v", expected, r.Handlers[0].Paths)
+	}
+}
+
+func TestExportToNonEmptyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-vaultsmith-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "existing.json"), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.VaultsmithConfig{ExportDir: dir}
+	mockClient := new(vault.MockClient)
+	mockClient.On("Authenticate", conf.VaultRole)
+
+	_, err = Export(mockClient, conf)
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("Expected error for non-empty directory, got %v", err)
+	}
+}